@@ -23,298 +23,343 @@ const (
 type opCodeData struct {
 	opName   string
 	addrMode AddrMode
+	// number of cycles the instruction takes when no penalties apply
+	cycles int
+	// extra cycles when the effective address crosses a page boundary.
+	// for branches, this is only paid when the branch is taken.
+	pageCrossCycles int
+	// extra cycles when a branch is taken
+	branchTakenCycles int
+}
+
+// Opcode describes a single entry in the 6502 op code table.
+type Opcode struct {
+	Name              string
+	AddrMode          AddrMode
+	Size              int
+	Cycles            int
+	PageCrossCycles   int
+	BranchTakenCycles int
+}
+
+// OpcodeInfo returns the name, size and timing of op.
+// Undefined op codes have an empty Name and a Size of 0.
+func OpcodeInfo(op byte) Opcode {
+	info := opCodeDataMap[op]
+	return Opcode{
+		Name:              info.opName,
+		AddrMode:          info.addrMode,
+		Size:              info.addrMode.size(),
+		Cycles:            info.cycles,
+		PageCrossCycles:   info.pageCrossCycles,
+		BranchTakenCycles: info.branchTakenCycles,
+	}
+}
+
+// number of bytes an instruction with this addressing mode takes,
+// including the op code
+func (mode AddrMode) size() int {
+	switch mode {
+	case nilAddr:
+		return 0
+	case impliedAddr:
+		return 1
+	case absAddr, absXAddr, absYAddr, indirectAddr:
+		return 3
+	}
+	return 2
 }
 
 var opNameToOpCode [addrModeCount]map[string]byte
 
 var opCodeDataMap = []opCodeData{
 	// 0x00
-	{"brk", impliedAddr},
-	{"ora", xIndexIndirectAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"ora", zeroPageAddr},
-	{"asl", zeroPageAddr},
-	{"", nilAddr},
-	{"php", impliedAddr},
-	{"ora", immedAddr},
-	{"asl", impliedAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"ora", absAddr},
-	{"asl", absAddr},
-	{"", nilAddr},
+	{"brk", impliedAddr, 7, 0, 0},
+	{"ora", xIndexIndirectAddr, 6, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"ora", zeroPageAddr, 3, 0, 0},
+	{"asl", zeroPageAddr, 5, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"php", impliedAddr, 3, 0, 0},
+	{"ora", immedAddr, 2, 0, 0},
+	{"asl", impliedAddr, 2, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"ora", absAddr, 4, 0, 0},
+	{"asl", absAddr, 6, 0, 0},
+	{"", nilAddr, 0, 0, 0},
 
 	// 0x10
-	{"bpl", relativeAddr},
-	{"ora", indirectYIndexAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"ora", zeroXIndexAddr},
-	{"asl", zeroXIndexAddr},
-	{"", nilAddr},
-	{"clc", impliedAddr},
-	{"ora", absYAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"ora", absXAddr},
-	{"asl", absXAddr},
-	{"", nilAddr},
+	{"bpl", relativeAddr, 2, 1, 1},
+	{"ora", indirectYIndexAddr, 5, 1, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"ora", zeroXIndexAddr, 4, 0, 0},
+	{"asl", zeroXIndexAddr, 6, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"clc", impliedAddr, 2, 0, 0},
+	{"ora", absYAddr, 4, 1, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"ora", absXAddr, 4, 1, 0},
+	{"asl", absXAddr, 7, 0, 0},
+	{"", nilAddr, 0, 0, 0},
 
 	// 0x20
-	{"jsr", absAddr},
-	{"and", xIndexIndirectAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"bit", zeroPageAddr},
-	{"and", zeroPageAddr},
-	{"rol", zeroPageAddr},
-	{"", nilAddr},
-	{"plp", impliedAddr},
-	{"and", immedAddr},
-	{"rol", impliedAddr},
-	{"", nilAddr},
-	{"bit", absAddr},
-	{"and", absAddr},
-	{"rol", absAddr},
-	{"", nilAddr},
+	{"jsr", absAddr, 6, 0, 0},
+	{"and", xIndexIndirectAddr, 6, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"bit", zeroPageAddr, 3, 0, 0},
+	{"and", zeroPageAddr, 3, 0, 0},
+	{"rol", zeroPageAddr, 5, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"plp", impliedAddr, 4, 0, 0},
+	{"and", immedAddr, 2, 0, 0},
+	{"rol", impliedAddr, 2, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"bit", absAddr, 4, 0, 0},
+	{"and", absAddr, 4, 0, 0},
+	{"rol", absAddr, 6, 0, 0},
+	{"", nilAddr, 0, 0, 0},
 
 	// 0x30
-	{"bmi", relativeAddr},
-	{"and", indirectYIndexAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"and", zeroXIndexAddr},
-	{"rol", zeroXIndexAddr},
-	{"", nilAddr},
-	{"sec", impliedAddr},
-	{"and", absYAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"and", absXAddr},
-	{"rol", absXAddr},
-	{"", nilAddr},
+	{"bmi", relativeAddr, 2, 1, 1},
+	{"and", indirectYIndexAddr, 5, 1, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"and", zeroXIndexAddr, 4, 0, 0},
+	{"rol", zeroXIndexAddr, 6, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"sec", impliedAddr, 2, 0, 0},
+	{"and", absYAddr, 4, 1, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"and", absXAddr, 4, 1, 0},
+	{"rol", absXAddr, 7, 0, 0},
+	{"", nilAddr, 0, 0, 0},
 
 	// 0x40
-	{"rti", impliedAddr},
-	{"eor", xIndexIndirectAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"eor", zeroPageAddr},
-	{"lsr", zeroPageAddr},
-	{"", nilAddr},
-	{"pha", impliedAddr},
-	{"eor", immedAddr},
-	{"lsr", impliedAddr},
-	{"", nilAddr},
-	{"jmp", absAddr},
-	{"eor", absAddr},
-	{"lsr", absAddr},
-	{"", nilAddr},
+	{"rti", impliedAddr, 6, 0, 0},
+	{"eor", xIndexIndirectAddr, 6, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"eor", zeroPageAddr, 3, 0, 0},
+	{"lsr", zeroPageAddr, 5, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"pha", impliedAddr, 3, 0, 0},
+	{"eor", immedAddr, 2, 0, 0},
+	{"lsr", impliedAddr, 2, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"jmp", absAddr, 3, 0, 0},
+	{"eor", absAddr, 4, 0, 0},
+	{"lsr", absAddr, 6, 0, 0},
+	{"", nilAddr, 0, 0, 0},
 
 	// 0x50
-	{"bvc", relativeAddr},
-	{"eor", indirectYIndexAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"eor", zeroXIndexAddr},
-	{"lsr", zeroXIndexAddr},
-	{"", nilAddr},
-	{"cli", impliedAddr},
-	{"eor", absYAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"eor", absXAddr},
-	{"lsr", absXAddr},
-	{"", nilAddr},
+	{"bvc", relativeAddr, 2, 1, 1},
+	{"eor", indirectYIndexAddr, 5, 1, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"eor", zeroXIndexAddr, 4, 0, 0},
+	{"lsr", zeroXIndexAddr, 6, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"cli", impliedAddr, 2, 0, 0},
+	{"eor", absYAddr, 4, 1, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"eor", absXAddr, 4, 1, 0},
+	{"lsr", absXAddr, 7, 0, 0},
+	{"", nilAddr, 0, 0, 0},
 
 	// 0x60
-	{"rts", impliedAddr},
-	{"adc", xIndexIndirectAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"adc", zeroPageAddr},
-	{"ror", zeroPageAddr},
-	{"", nilAddr},
-	{"pla", impliedAddr},
-	{"adc", immedAddr},
-	{"ror", impliedAddr},
-	{"", nilAddr},
-	{"jmp", indirectAddr},
-	{"adc", absAddr},
-	{"ror", absAddr},
-	{"", nilAddr},
+	{"rts", impliedAddr, 6, 0, 0},
+	{"adc", xIndexIndirectAddr, 6, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"adc", zeroPageAddr, 3, 0, 0},
+	{"ror", zeroPageAddr, 5, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"pla", impliedAddr, 4, 0, 0},
+	{"adc", immedAddr, 2, 0, 0},
+	{"ror", impliedAddr, 2, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"jmp", indirectAddr, 5, 0, 0},
+	{"adc", absAddr, 4, 0, 0},
+	{"ror", absAddr, 6, 0, 0},
+	{"", nilAddr, 0, 0, 0},
 
 	// 0x70
-	{"bvs", relativeAddr},
-	{"adc", indirectYIndexAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"adc", zeroXIndexAddr},
-	{"ror", zeroXIndexAddr},
-	{"", nilAddr},
-	{"sei", impliedAddr},
-	{"adc", absYAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"adc", absXAddr},
-	{"ror", absXAddr},
-	{"", nilAddr},
+	{"bvs", relativeAddr, 2, 1, 1},
+	{"adc", indirectYIndexAddr, 5, 1, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"adc", zeroXIndexAddr, 4, 0, 0},
+	{"ror", zeroXIndexAddr, 6, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"sei", impliedAddr, 2, 0, 0},
+	{"adc", absYAddr, 4, 1, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"adc", absXAddr, 4, 1, 0},
+	{"ror", absXAddr, 7, 0, 0},
+	{"", nilAddr, 0, 0, 0},
 
 	// 0x80
-	{"", nilAddr},
-	{"sta", xIndexIndirectAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"sty", zeroPageAddr},
-	{"sta", zeroPageAddr},
-	{"stx", zeroPageAddr},
-	{"", nilAddr},
-	{"dey", impliedAddr},
-	{"", nilAddr},
-	{"txa", impliedAddr},
-	{"", nilAddr},
-	{"sty", absAddr},
-	{"sta", absAddr},
-	{"stx", absAddr},
-	{"", nilAddr},
+	{"", nilAddr, 0, 0, 0},
+	{"sta", xIndexIndirectAddr, 6, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"sty", zeroPageAddr, 3, 0, 0},
+	{"sta", zeroPageAddr, 3, 0, 0},
+	{"stx", zeroPageAddr, 3, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"dey", impliedAddr, 2, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"txa", impliedAddr, 2, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"sty", absAddr, 4, 0, 0},
+	{"sta", absAddr, 4, 0, 0},
+	{"stx", absAddr, 4, 0, 0},
+	{"", nilAddr, 0, 0, 0},
 
 	// 0x90
-	{"bcc", relativeAddr},
-	{"sta", indirectYIndexAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"sty", zeroXIndexAddr},
-	{"sta", zeroXIndexAddr},
-	{"stx", zeroYIndexAddr},
-	{"", nilAddr},
-	{"tya", impliedAddr},
-	{"sta", absYAddr},
-	{"txs", impliedAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"sta", absXAddr},
-	{"", nilAddr},
-	{"", nilAddr},
+	{"bcc", relativeAddr, 2, 1, 1},
+	{"sta", indirectYIndexAddr, 6, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"sty", zeroXIndexAddr, 4, 0, 0},
+	{"sta", zeroXIndexAddr, 4, 0, 0},
+	{"stx", zeroYIndexAddr, 4, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"tya", impliedAddr, 2, 0, 0},
+	{"sta", absYAddr, 5, 0, 0},
+	{"txs", impliedAddr, 2, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"sta", absXAddr, 5, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
 
 	// 0xa0
-	{"ldy", immedAddr},
-	{"lda", xIndexIndirectAddr},
-	{"ldx", immedAddr},
-	{"", nilAddr},
-	{"ldy", zeroPageAddr},
-	{"lda", zeroPageAddr},
-	{"ldx", zeroPageAddr},
-	{"", nilAddr},
-	{"tay", impliedAddr},
-	{"lda", immedAddr},
-	{"tax", impliedAddr},
-	{"", nilAddr},
-	{"ldy", absAddr},
-	{"lda", absAddr},
-	{"ldx", absAddr},
-	{"", nilAddr},
+	{"ldy", immedAddr, 2, 0, 0},
+	{"lda", xIndexIndirectAddr, 6, 0, 0},
+	{"ldx", immedAddr, 2, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"ldy", zeroPageAddr, 3, 0, 0},
+	{"lda", zeroPageAddr, 3, 0, 0},
+	{"ldx", zeroPageAddr, 3, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"tay", impliedAddr, 2, 0, 0},
+	{"lda", immedAddr, 2, 0, 0},
+	{"tax", impliedAddr, 2, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"ldy", absAddr, 4, 0, 0},
+	{"lda", absAddr, 4, 0, 0},
+	{"ldx", absAddr, 4, 0, 0},
+	{"", nilAddr, 0, 0, 0},
 
 	// 0xb0
-	{"bcs", relativeAddr},
-	{"lda", indirectYIndexAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"ldy", zeroXIndexAddr},
-	{"lda", zeroXIndexAddr},
-	{"ldx", zeroYIndexAddr},
-	{"", nilAddr},
-	{"clv", impliedAddr},
-	{"lda", absYAddr},
-	{"tsx", impliedAddr},
-	{"", nilAddr},
-	{"ldy", absXAddr},
-	{"lda", absXAddr},
-	{"ldx", absYAddr},
-	{"", nilAddr},
+	{"bcs", relativeAddr, 2, 1, 1},
+	{"lda", indirectYIndexAddr, 5, 1, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"ldy", zeroXIndexAddr, 4, 0, 0},
+	{"lda", zeroXIndexAddr, 4, 0, 0},
+	{"ldx", zeroYIndexAddr, 4, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"clv", impliedAddr, 2, 0, 0},
+	{"lda", absYAddr, 4, 1, 0},
+	{"tsx", impliedAddr, 2, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"ldy", absXAddr, 4, 1, 0},
+	{"lda", absXAddr, 4, 1, 0},
+	{"ldx", absYAddr, 4, 1, 0},
+	{"", nilAddr, 0, 0, 0},
 
 	// 0xc0
-	{"cpy", immedAddr},
-	{"cmp", xIndexIndirectAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"cpy", zeroPageAddr},
-	{"cmp", zeroPageAddr},
-	{"dec", zeroPageAddr},
-	{"", nilAddr},
-	{"iny", impliedAddr},
-	{"cmp", immedAddr},
-	{"dex", impliedAddr},
-	{"", nilAddr},
-	{"cpy", absAddr},
-	{"cmp", absAddr},
-	{"dec", absAddr},
-	{"", nilAddr},
+	{"cpy", immedAddr, 2, 0, 0},
+	{"cmp", xIndexIndirectAddr, 6, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"cpy", zeroPageAddr, 3, 0, 0},
+	{"cmp", zeroPageAddr, 3, 0, 0},
+	{"dec", zeroPageAddr, 5, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"iny", impliedAddr, 2, 0, 0},
+	{"cmp", immedAddr, 2, 0, 0},
+	{"dex", impliedAddr, 2, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"cpy", absAddr, 4, 0, 0},
+	{"cmp", absAddr, 4, 0, 0},
+	{"dec", absAddr, 6, 0, 0},
+	{"", nilAddr, 0, 0, 0},
 
 	// 0xd0
-	{"bne", relativeAddr},
-	{"cmp", indirectYIndexAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"cmp", zeroXIndexAddr},
-	{"dec", zeroXIndexAddr},
-	{"", nilAddr},
-	{"cld", impliedAddr},
-	{"cmp", absYAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"cmp", absXAddr},
-	{"dec", absXAddr},
-	{"", nilAddr},
+	{"bne", relativeAddr, 2, 1, 1},
+	{"cmp", indirectYIndexAddr, 5, 1, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"cmp", zeroXIndexAddr, 4, 0, 0},
+	{"dec", zeroXIndexAddr, 6, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"cld", impliedAddr, 2, 0, 0},
+	{"cmp", absYAddr, 4, 1, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"cmp", absXAddr, 4, 1, 0},
+	{"dec", absXAddr, 7, 0, 0},
+	{"", nilAddr, 0, 0, 0},
 
 	// 0xe0
-	{"cpx", immedAddr},
-	{"sbc", xIndexIndirectAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"cpx", zeroPageAddr},
-	{"sbc", zeroPageAddr},
-	{"inc", zeroPageAddr},
-	{"", nilAddr},
-	{"inx", impliedAddr},
-	{"sbc", immedAddr},
-	{"nop", impliedAddr},
-	{"", nilAddr},
-	{"cpx", absAddr},
-	{"sbc", absAddr},
-	{"inc", absAddr},
-	{"", nilAddr},
+	{"cpx", immedAddr, 2, 0, 0},
+	{"sbc", xIndexIndirectAddr, 6, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"cpx", zeroPageAddr, 3, 0, 0},
+	{"sbc", zeroPageAddr, 3, 0, 0},
+	{"inc", zeroPageAddr, 5, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"inx", impliedAddr, 2, 0, 0},
+	{"sbc", immedAddr, 2, 0, 0},
+	{"nop", impliedAddr, 2, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"cpx", absAddr, 4, 0, 0},
+	{"sbc", absAddr, 4, 0, 0},
+	{"inc", absAddr, 6, 0, 0},
+	{"", nilAddr, 0, 0, 0},
 
 	// 0xf0
-	{"beq", relativeAddr},
-	{"sbc", indirectYIndexAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"sbc", zeroXIndexAddr},
-	{"inc", zeroXIndexAddr},
-	{"", nilAddr},
-	{"sed", impliedAddr},
-	{"sbc", absYAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"", nilAddr},
-	{"sbc", absXAddr},
-	{"inc", absXAddr},
-	{"", nilAddr},
+	{"beq", relativeAddr, 2, 1, 1},
+	{"sbc", indirectYIndexAddr, 5, 1, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"sbc", zeroXIndexAddr, 4, 0, 0},
+	{"inc", zeroXIndexAddr, 6, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"sed", impliedAddr, 2, 0, 0},
+	{"sbc", absYAddr, 4, 1, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"", nilAddr, 0, 0, 0},
+	{"sbc", absXAddr, 4, 1, 0},
+	{"inc", absXAddr, 7, 0, 0},
+	{"", nilAddr, 0, 0, 0},
 }
 
 func init() {
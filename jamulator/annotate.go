@@ -0,0 +1,169 @@
+package jamulator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// names of the memory mapped PPU, APU and controller registers
+var nesRegisterNames = map[int]string{
+	0x2000: "PPUCTRL",
+	0x2001: "PPUMASK",
+	0x2002: "PPUSTATUS",
+	0x2003: "OAMADDR",
+	0x2004: "OAMDATA",
+	0x2005: "PPUSCROLL",
+	0x2006: "PPUADDR",
+	0x2007: "PPUDATA",
+	0x4000: "SQ1_VOL",
+	0x4001: "SQ1_SWEEP",
+	0x4002: "SQ1_LO",
+	0x4003: "SQ1_HI",
+	0x4004: "SQ2_VOL",
+	0x4005: "SQ2_SWEEP",
+	0x4006: "SQ2_LO",
+	0x4007: "SQ2_HI",
+	0x4008: "TRI_LINEAR",
+	0x400a: "TRI_LO",
+	0x400b: "TRI_HI",
+	0x400c: "NOISE_VOL",
+	0x400e: "NOISE_LO",
+	0x400f: "NOISE_HI",
+	0x4010: "DMC_FREQ",
+	0x4011: "DMC_RAW",
+	0x4012: "DMC_START",
+	0x4013: "DMC_LEN",
+	0x4014: "OAMDMA",
+	0x4015: "SND_CHN",
+	0x4016: "JOY1",
+	0x4017: "JOY2",
+}
+
+// returns a description of the hardware register at addr, if any
+func registerComment(addr int) string {
+	switch {
+	case addr == 0x2008:
+		return "putchar (homebrew ABI)"
+	case addr == 0x2009:
+		return "exit (homebrew ABI)"
+	case addr >= 0x2008 && addr < 0x4000:
+		return nesRegisterNames[0x2000+(addr&0x7)] + " (mirror)"
+	}
+	return nesRegisterNames[addr]
+}
+
+// whether the register at addr can be referred to by name. a label with
+// the same name would be shadowed by the equate.
+func (d *Disassembly) canNameRegister(addr int) bool {
+	name, ok := nesRegisterNames[addr]
+	if !ok {
+		return false
+	}
+	_, isLabel := d.prog.Labels[name]
+	return !isLabel
+}
+
+// replaces absolute operands which refer to hardware registers with the
+// register name. the assembler always uses absolute addressing for
+// labeled operands, so the output still assembles to the same bytes.
+func (d *Disassembly) symbolizeRegisters() {
+	for e := d.prog.List.Front(); e != nil; e = e.Next() {
+		i, ok := e.Value.(*Instruction)
+		if !ok || !d.canNameRegister(i.Value) {
+			continue
+		}
+		switch opCodeDataMap[i.OpCode].addrMode {
+		case absAddr:
+			i.Type = DirectWithLabelInstruction
+		case absXAddr, absYAddr:
+			i.Type = DirectWithLabelIndexedInstruction
+		default:
+			continue
+		}
+		i.LabelName = nesRegisterNames[i.Value]
+	}
+}
+
+// puts the register equates at the top of the program
+func (d *Disassembly) insertRegisterEquates() {
+	addrs := make([]int, 0, len(nesRegisterNames))
+	for addr := range nesRegisterNames {
+		if d.canNameRegister(addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Ints(addrs)
+	for n := len(addrs) - 1; n >= 0; n-- {
+		name := nesRegisterNames[addrs[n]]
+		d.prog.Variables[name] = addrs[n]
+		d.prog.List.PushFront(&AssignStatement{VarName: name, Value: addrs[n]})
+	}
+	d.prog.List.PushFront(&CommentStatement{Text: "NES hardware registers"})
+}
+
+func (i *Instruction) addComment(comment string) {
+	if len(comment) == 0 {
+		return
+	}
+	if len(i.Comment) > 0 {
+		i.Comment += "  "
+	}
+	i.Comment += comment
+}
+
+// adds comments to the disassembled program: hardware register names,
+// which instructions jump to each label, and optionally the address and
+// bytes of each instruction.
+func (d *Disassembly) annotate(showBytes bool) {
+	callers := make(map[int][]int)
+	jumpers := make(map[int][]int)
+	for e := d.prog.List.Front(); e != nil; e = e.Next() {
+		i, ok := e.Value.(*Instruction)
+		if !ok {
+			continue
+		}
+		if showBytes {
+			hex := make([]string, len(i.Payload))
+			for n, b := range i.Payload {
+				hex[n] = fmt.Sprintf("%02x", b)
+			}
+			i.addComment(fmt.Sprintf("$%04x: %s", i.Offset, strings.Join(hex, " ")))
+		}
+		switch i.Type {
+		case DirectInstruction, DirectIndexedInstruction:
+			switch opCodeDataMap[i.OpCode].addrMode {
+			case absAddr, absXAddr, absYAddr:
+				i.addComment(registerComment(i.Value))
+			}
+		}
+		switch i.OpCode {
+		case 0x20: // jsr
+			callers[i.Value] = append(callers[i.Value], i.Offset)
+		case 0x4c: // jmp
+			jumpers[i.Value] = append(jumpers[i.Value], i.Offset)
+		}
+	}
+	d.addXrefComments(callers, "called from")
+	d.addXrefComments(jumpers, "jumped to from")
+}
+
+func (d *Disassembly) addXrefComments(refs map[int][]int, verb string) {
+	targets := make([]int, 0, len(refs))
+	for addr := range refs {
+		targets = append(targets, addr)
+	}
+	sort.Ints(targets)
+	for _, addr := range targets {
+		if d.prog.elemAtAddr(addr) == nil {
+			continue
+		}
+		sources := refs[addr]
+		sort.Ints(sources)
+		strs := make([]string, len(sources))
+		for n, source := range sources {
+			strs[n] = fmt.Sprintf("$%04x", source)
+		}
+		d.prog.addComment(addr, fmt.Sprintf("%s %s", verb, strings.Join(strs, ", ")))
+	}
+}
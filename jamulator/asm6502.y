@@ -10,11 +10,19 @@ import (
 type AssignStatement struct {
 	VarName string
 	Value int
+	Comment string
 }
 
 type LabelStatement struct {
 	LabelName string
 	Line int
+	Comment string
+}
+
+// a comment on a line by itself
+type CommentStatement struct {
+	Text string
+	Line int
 }
 
 type LabeledStatement struct {
@@ -26,6 +34,7 @@ type OrgPseudoOp struct {
 	Value int
 	Fill byte
 	Line int
+	Comment string
 }
 
 type InstructionType int
@@ -51,10 +60,16 @@ type Instruction struct {
 	LabelName string
 	RegisterName string
 
+	// comment at the end of the line
+	Comment string
+
 	// filled in later
 	OpCode byte
 	Offset int
 	Payload []byte
+	// the operand is a symbol which was known to be in zero page when
+	// the instruction was resolved
+	zeroPage bool
 }
 
 type DataStmtType int
@@ -67,10 +82,14 @@ type DataStatement struct {
 	Type DataStmtType
 	dataList *list.List
 	Line int
+	// comment at the end of the line
+	Comment string
 
 	// filled in later
 	Offset int
 	Payload []byte
+	// encoding of the strings, or nil for ASCII
+	table *TextTable
 }
 
 
@@ -84,6 +103,27 @@ type ProgramAst struct {
 }
 
 var programAst ProgramAst
+
+// attaches a comment at the end of a line to the statement on that line
+func withComment(node interface{}, comment string) interface{} {
+	switch t := node.(type) {
+	case nil:
+		return &CommentStatement{comment, parseLineNumber}
+	case *LabeledStatement:
+		withComment(t.Stmt, comment)
+	case *Instruction:
+		t.Comment = comment
+	case *DataStatement:
+		t.Comment = comment
+	case *LabelStatement:
+		t.Comment = comment
+	case *OrgPseudoOp:
+		t.Comment = comment
+	case *AssignStatement:
+		t.Comment = comment
+	}
+	return node
+}
 %}
 
 %union {
@@ -98,6 +138,7 @@ var programAst ProgramAst
 %type <list> statementList
 %type <assignStatement> assignStatement
 %type <node> statement
+%type <node> commentedStatement
 %type <node> instructionStatement
 %type <node> dataStatement
 %type <list> dataList
@@ -115,6 +156,7 @@ var programAst ProgramAst
 %token <integer> tokInteger
 %token <str> tokQuotedString
 %token <str> tokInstruction
+%token <str> tokComment
 %token tokEqual
 %token tokPound
 %token tokDot
@@ -136,14 +178,14 @@ programAst : statementList {
 	programAst = ProgramAst{$1}
 }
 
-statementList : statementList tokNewline statement {
+statementList : statementList tokNewline commentedStatement {
 	if $3 == nil {
 		$$ = $1
 	} else {
 		$$ = $1
 		$$.PushBack($3)
 	}
-} | statement {
+} | commentedStatement {
 	if $1 == nil {
 		$$ = list.New()
 	} else {
@@ -152,14 +194,20 @@ statementList : statementList tokNewline statement {
 	}
 }
 
+commentedStatement : statement {
+	$$ = $1
+} | statement tokComment {
+	$$ = withComment($1, $2)
+}
+
 statement : tokDot tokIdentifier instructionStatement {
 	$$ = &LabeledStatement{
-		&LabelStatement{"." + $2, parseLineNumber},
+		&LabelStatement{LabelName: "." + $2, Line: parseLineNumber},
 		$3,
 	}
 } | tokIdentifier tokColon instructionStatement {
 	$$ = &LabeledStatement{
-		&LabelStatement{$1, parseLineNumber},
+		&LabelStatement{LabelName: $1, Line: parseLineNumber},
 		$3,
 	}
 } | orgPsuedoOp {
@@ -170,12 +218,12 @@ statement : tokDot tokIdentifier instructionStatement {
 	$$ = $1
 } | tokDot tokIdentifier dataStatement {
 	$$ = &LabeledStatement{
-		&LabelStatement{"." + $2, parseLineNumber},
+		&LabelStatement{LabelName: "." + $2, Line: parseLineNumber},
 		 $3,
 	 }
 } | tokIdentifier tokColon dataStatement {
 	$$ = &LabeledStatement{
-		&LabelStatement{$1, parseLineNumber},
+		&LabelStatement{LabelName: $1, Line: parseLineNumber},
 		$3,
 	}
 } | dataStatement {
@@ -183,9 +231,9 @@ statement : tokDot tokIdentifier instructionStatement {
 } | assignStatement {
 	$$ = $1
 } | tokIdentifier {
-	$$ = &LabelStatement{$1, parseLineNumber}
+	$$ = &LabelStatement{LabelName: $1, Line: parseLineNumber}
 } | tokIdentifier tokColon {
-	$$ = &LabelStatement{$1, parseLineNumber}
+	$$ = &LabelStatement{LabelName: $1, Line: parseLineNumber}
 } | processorDecl {
 	if $1 != "6502" {
 		yylex.Error("Unsupported processor: " + $1 + " - Only 6502 is supported.")
@@ -255,20 +303,20 @@ dataItem : tokQuotedString {
 }
 
 assignStatement : tokIdentifier tokEqual tokInteger {
-	$$ = &AssignStatement{$1, $3}
+	$$ = &AssignStatement{VarName: $1, Value: $3}
 }
 
 orgPsuedoOp : tokOrg tokInteger {
-	$$ = &OrgPseudoOp{$2, 0xff, parseLineNumber}
+	$$ = &OrgPseudoOp{Value: $2, Fill: 0xff, Line: parseLineNumber}
 } | tokOrg tokInteger tokComma tokInteger {
 	if $4 > 0xff {
 		yylex.Error("ORG directive fill parameter must be a single byte.")
 	}
-	$$ = &OrgPseudoOp{$2, byte($4), parseLineNumber}
+	$$ = &OrgPseudoOp{Value: $2, Fill: byte($4), Line: parseLineNumber}
 }
 
 subroutineDecl : tokIdentifier tokSubroutine {
-	$$ = &LabelStatement{$1, parseLineNumber}
+	$$ = &LabelStatement{LabelName: $1, Line: parseLineNumber}
 }
 
 instructionStatement : tokInstruction tokPound tokInteger {
@@ -2,9 +2,19 @@ package jamulator
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
+	"image"
+	"image/draw"
 	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 type testAsm struct {
@@ -25,12 +35,27 @@ var testAsmList = []testAsm{
 		"test/hello.asm",
 		"test/hello.bin.ref",
 	},
+	{
+		"test/dispatch.asm",
+		"test/dispatch.bin.ref",
+	},
+	{
+		"test/diff6502.asm",
+		"test/diff6502.bin.ref",
+	},
+	{
+		"test/indexed.asm",
+		"test/indexed.bin.ref",
+	},
 }
 
 var testDisAsmList = []string{
 	"test/suite6502.bin.ref",
 	"test/zelda.bin.ref",
 	"test/hello.bin.ref",
+	"test/dispatch.bin.ref",
+	"test/diff6502.bin.ref",
+	"test/indexed.bin.ref",
 }
 
 func TestAsm(t *testing.T) {
@@ -101,3 +126,1335 @@ func TestDisassembly(t *testing.T) {
 		}
 	}
 }
+
+func TestJumpTables(t *testing.T) {
+	program, err := DisassembleFile("test/dispatch.bin.ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	labeled := make(map[int]bool)
+	for _, addr := range program.Labels {
+		labeled[addr] = true
+	}
+	// every target of every kind of table should be found
+	targets := []int{0xc100, 0xc108, 0xc110, 0xc118, 0xc120, 0xc128, 0xc130, 0xc138,
+		0xc140, 0xc148, 0xc150, 0xc158}
+	for _, addr := range targets {
+		if !labeled[addr] {
+			t.Errorf("$%04x: expected jump table target to be labeled", addr)
+		}
+		_, ok := program.elemAtAddr(addr).Value.(*Instruction)
+		if !ok {
+			t.Errorf("$%04x: expected jump table target to be code", addr)
+		}
+	}
+	for _, addr := range []int{0xc210, 0xc212, 0xc230, 0xc232, 0xc240, 0xc242} {
+		stmt, ok := program.elemAtAddr(addr).Value.(*DataStatement)
+		if !ok || stmt.Type != WordDataStmt {
+			t.Errorf("$%04x: expected jump table entry to be a word", addr)
+		}
+	}
+}
+
+func TestJumpTableBounds(t *testing.T) {
+	program := parseTestProgram(t, ".org $c000\n"+
+		"Reset_Routine:\n"+
+		"    lda $00\n"+
+		"    jsr Bounded\n"+
+		"    ldx $01\n"+
+		"    jsr Unbounded\n"+
+		"    jmp Reset_Routine\n"+
+		"Bounded:\n"+
+		"    cmp #$02\n"+
+		"    bcs Bounded_done\n"+
+		"    asl\n"+
+		"    tax\n"+
+		"    lda $c200, x\n"+
+		"    sta $02\n"+
+		"    lda $c201, x\n"+
+		"    sta $03\n"+
+		"    jmp ($0002)\n"+
+		"Bounded_done:\n"+
+		"    rts\n"+
+		"Unbounded:\n"+
+		"    lda $c300, x\n"+
+		"    sta $04\n"+
+		"    lda $c301, x\n"+
+		"    sta $05\n"+
+		"    jmp ($0004)\n"+
+		"TargetA:\n"+
+		"    rts\n"+
+		"TargetB:\n"+
+		"    rts\n"+
+		"TargetC:\n"+
+		"    rts\n"+
+		"TargetD:\n"+
+		"    rts\n"+
+		"IRQ_Routine:\n"+
+		"NMI_Routine:\n"+
+		"    rti\n"+
+		"; data which looks like code\n"+
+		".org $c180\n"+
+		"    .db $a9, $ff, $85, $10, $60\n"+
+		".org $c200\n"+
+		"    .dw TargetA, TargetB\n"+
+		"    .dw $c180, $c180\n"+
+		".org $c300\n"+
+		"    .dw TargetA, TargetB, TargetC, TargetD\n"+
+		"    .dw $c180, $c180\n"+
+		".org $fffa\n"+
+		"    .dw NMI_Routine\n"+
+		"    .dw Reset_Routine\n"+
+		"    .dw IRQ_Routine\n")
+	buf := new(bytes.Buffer)
+	err := program.Assemble(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rom := &Rom{PrgRom: [][]byte{buf.Bytes()}}
+
+	isWord := func(p *Program, addr int) bool {
+		stmt, ok := p.elemAtAddr(addr).Value.(*DataStatement)
+		return ok && stmt.Type == WordDataStmt
+	}
+	dis, err := rom.Disassemble(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []int{0xc200, 0xc202, 0xc300, 0xc302, 0xc304, 0xc306} {
+		if !isWord(dis, addr) {
+			t.Errorf("$%04x: expected jump table entry to be a word", addr)
+		}
+	}
+	// the cmp #$02 limits the first table to two entries, and the second
+	// is only trusted for its first few
+	for _, addr := range []int{0xc204, 0xc308} {
+		if isWord(dis, addr) {
+			t.Errorf("$%04x: expected the data after the table not to be an entry", addr)
+		}
+	}
+	if _, ok := dis.elemAtAddr(0xc180).Value.(*Instruction); ok {
+		t.Error("expected the data at $c180 not to be disassembled")
+	}
+
+	// the code/data log can confirm more entries
+	log := make([]byte, 0x4000)
+	log[0xc180-0xc000] = cdlCode
+	dis, err = rom.Disassemble(&DisassembleOptions{Cdl: &CodeDataLog{Prg: log}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isWord(dis, 0xc308) {
+		t.Error("$c308: expected an entry confirmed by the code/data log to be a word")
+	}
+	if isWord(dis, 0xc204) {
+		t.Error("$c204: expected the compare to limit the table even with the log")
+	}
+}
+
+func TestLabelNames(t *testing.T) {
+	var sources [2]string
+	for n := range sources {
+		program, err := DisassembleFile("test/dispatch.bin.ref")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"sub_C02C", "loc_C100", "tbl_C200", "ptr_C210"} {
+			if _, ok := program.Labels[name]; !ok {
+				t.Errorf("expected label %s", name)
+			}
+		}
+		if program.Variables["zp_00"] != 0x00 || program.Variables["zp_08"] != 0x08 {
+			t.Error("expected zero page equates")
+		}
+		a := program.ramAccesses()[0x08]
+		if a == nil || a.writes == 0 {
+			t.Error("expected writes to zp_08 to be counted")
+		}
+		buf := new(bytes.Buffer)
+		err = program.WriteSource(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources[n] = buf.String()
+	}
+	if sources[0] != sources[1] {
+		t.Error("expected disassembly to be the same every time")
+	}
+}
+
+func TestZeroPageRoundTrip(t *testing.T) {
+	prg := make([]byte, 0x4000)
+	copy(prg, []byte{
+		0xa5, 0x10, // $c000 lda $10
+		0x95, 0x20, // $c002 sta $20, x
+		0xb6, 0x30, // $c004 ldx $30, y
+		0x8d, 0x00, 0x03, // $c006 sta $0300
+		0x9d, 0x00, 0x04, // $c009 sta $0400, x
+		0x4c, 0x00, 0xc0, // $c00c jmp $c000
+	})
+	copy(prg[0x3ffa:], []byte{0x00, 0xc0, 0x00, 0xc0, 0x00, 0xc0})
+	rom := &Rom{PrgRom: [][]byte{prg}}
+	program, err := rom.Disassemble(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	err = program.WriteSource(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := buf.String()
+	for _, expected := range []string{"lda zp_10\n", "sta zp_20, X\n", "ldx zp_30, Y\n",
+		"sta var_0300\n", "sta var_0400, X\n"} {
+		if !strings.Contains(source, expected) {
+			t.Errorf("expected the source to contain %q:\n%s", expected, source)
+		}
+	}
+
+	// names of zero page variables assemble to the short forms, and the
+	// rest to absolute
+	program = parseTestProgram(t, source)
+	buf = new(bytes.Buffer)
+	err = program.Assemble(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(buf.Bytes(), prg) != 0 {
+		t.Errorf("expected the source to assemble to the same bytes, got % x", buf.Bytes()[:0x0f])
+	}
+}
+
+func TestDisassemblyReport(t *testing.T) {
+	program, err := DisassembleFile("test/dispatch.bin.ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := program.Report
+	if r.Total.total() != 0x4000 {
+		t.Errorf("expected every byte to be classified, got %d", r.Total.total())
+	}
+	if r.Total.Code == 0 || r.Total.Data == 0 {
+		t.Error("expected code and data")
+	}
+	if len(r.UnresolvedJumps) != 0 {
+		t.Errorf("unexpected unresolved jumps: %s", addrListStr(r.UnresolvedJumps))
+	}
+
+	// an address pushed from RAM could be anything
+	source := ".org $c000\n" +
+		"Reset_Routine:\n" +
+		"    jsr Pushed\n" +
+		"    jsr Indirect\n" +
+		"    jmp Reset_Routine\n" +
+		"Pushed:\n" +
+		"    lda $01\n" +
+		"    pha\n" +
+		"    lda $00\n" +
+		"    pha\n" +
+		"    rts\n" +
+		"Indirect:\n" +
+		"    jmp ($0002)\n" +
+		"IRQ_Routine:\n" +
+		"NMI_Routine:\n" +
+		"    pha\n" +
+		"    pla\n" +
+		"    rti\n" +
+		".org $fffa\n" +
+		"    .dw NMI_Routine\n" +
+		"    .dw Reset_Routine\n" +
+		"    .dw IRQ_Routine\n"
+	asm := parseTestProgram(t, source)
+	buf := new(bytes.Buffer)
+	err = asm.Assemble(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rom := &Rom{PrgRom: [][]byte{buf.Bytes()}}
+	program, err = rom.Disassemble(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int{asm.Labels["Pushed"] + 6, asm.Labels["Indirect"]}
+	if !reflect.DeepEqual(program.Report.UnresolvedJumps, expected) {
+		t.Errorf("expected unresolved jumps %s, got %s", addrListStr(expected), addrListStr(program.Report.UnresolvedJumps))
+	}
+}
+
+func TestCommentRoundTrip(t *testing.T) {
+	source := "; header comment\n" +
+		".org $c000\n" +
+		"Start: ; entry point\n" +
+		"    lda #$01 ; load one\n" +
+		"; line comment\n" +
+		"    sta $2000\n" +
+		"    .db $01, $02 ; some data\n"
+	programAst, err := Parse(bytes.NewBufferString(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		t.Fatal(program.Errors)
+	}
+	buf := new(bytes.Buffer)
+	err = program.WriteSource(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != source {
+		t.Errorf("comments not preserved. got:\n%s", buf.String())
+	}
+}
+
+func TestTextTable(t *testing.T) {
+	table, err := ReadTextTable(bytes.NewBufferString("; test table\n" +
+		"01=H\n02=E\n03=L\n04=O\n05= \n06=W\n07=R\n08=D\n09=!\n0A=\"\n0B=\\\n" +
+		"8081=the\n" +
+		"*FE\n" +
+		"/FD=[end]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := ".org $c000\n" +
+		"Reset_Routine:\n" +
+		"    jmp Reset_Routine ; a comment with \"quotes\\\" in it\n" +
+		"    .db \"HELLO the WORLD!\\n\\\"\\\\\\\"[end]\"\n" +
+		".org $fffa\n" +
+		"    .dw Reset_Routine\n" +
+		"    .dw Reset_Routine\n" +
+		"    .dw Reset_Routine\n"
+	assemble := func(source string) []byte {
+		programAst, err := ParseWithTextTable(bytes.NewBufferString(source), table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		program := programAst.ToProgramWithTextTable(table)
+		if len(program.Errors) > 0 {
+			t.Fatal(program.Errors)
+		}
+		buf := new(bytes.Buffer)
+		err = program.Assemble(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	bank := assemble(source)
+	expected := []byte{0x01, 0x02, 0x03, 0x03, 0x04, 0x05, 0x80, 0x81, 0x05,
+		0x06, 0x04, 0x07, 0x03, 0x08, 0x09, 0xfe, 0x0a, 0x0b, 0x0a, 0xfd}
+	if !bytes.Equal(bank[3:3+len(expected)], expected) {
+		t.Fatalf("wrong encoding: % x", bank[3:3+len(expected)])
+	}
+
+	rom := &Rom{PrgRom: [][]byte{bank}}
+	program, err := rom.Disassemble(&DisassembleOptions{TextTable: table})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	err = program.WriteSource(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("\"HELLO the WORLD!\\n\\\"\\\\\\\"[end]\"")) {
+		t.Errorf("expected string in disassembly. got:\n%s", buf.String())
+	}
+	if !bytes.Equal(assemble(buf.String()), bank) {
+		t.Error("reassembled rom does not match")
+	}
+
+	// without a text table, backslashes are ordinary characters, even
+	// before a quote
+	program = parseTestProgram(t, ".org $c000\n"+
+		"    .db \"C:\\\", \"x\"\n"+
+		"    .db \"\\n\\\\\", $00 ; \"quoted\\\"\n")
+	buf = new(bytes.Buffer)
+	err = program.Assemble(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte("C:\\x\\n\\\\\x00")) {
+		t.Errorf("expected backslashes to be kept, got %q", buf.Bytes())
+	}
+	buf = new(bytes.Buffer)
+	err = program.WriteSource(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), ".db \"C:\\\", \"x\"\n    .db \"\\n\\\\\", $00") {
+		t.Errorf("expected the strings to be written as they were, got:\n%s", buf.String())
+	}
+}
+
+func TestChrImage(t *testing.T) {
+	bank := make([]byte, 0x2000)
+	for n := range bank {
+		bank[n] = byte(n*7 + n/16)
+	}
+	img := ChrToImage(bank, DefaultChrPalette)
+	if img.Bounds().Dx() != 256 || img.Bounds().Dy() != 128 {
+		t.Fatalf("expected a 256x128 tile sheet, got %v", img.Bounds())
+	}
+	// the first row of the first tile is bytes 0 and 8
+	lo, hi := bank[0], bank[8]
+	for x := 0; x < 8; x++ {
+		expected := (lo>>uint(7-x))&1 | ((hi>>uint(7-x))&1)<<1
+		if img.ColorIndexAt(x, 0) != expected {
+			t.Errorf("pixel %d: expected color %d, got %d", x, expected, img.ColorIndexAt(x, 0))
+		}
+	}
+	out, err := ImageToChr(img, DefaultChrPalette)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, bank) {
+		t.Error("paletted image did not encode back to the same CHR")
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, image.ZP, draw.Src)
+	out, err = ImageToChr(rgba, DefaultChrPalette)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, bank) {
+		t.Error("RGBA image did not encode back to the same CHR")
+	}
+}
+
+func TestScreenRender(t *testing.T) {
+	chr := make([]byte, 0x2000)
+	// tile 1 is solid color 3, tile 2 is solid color 1
+	for n := 0; n < 16; n++ {
+		chr[16+n] = 0xff
+	}
+	for n := 0; n < 8; n++ {
+		chr[32+n] = 0xff
+	}
+	nametable := make([]byte, NametableSize)
+	nametable[0] = 1
+	nametable[2] = 2
+	// bottom right quadrant of the first attribute uses palette 2
+	nametable[0x3c0] = 2 << 6
+	nametable[2*32+2] = 1
+	palette := []byte{0x0f, 0x01, 0x02, 0x30, 0x0f, 0x11, 0x12, 0x13, 0x0f, 0x21, 0x22, 0x16, 0x0f, 0x31, 0x32, 0x33}
+	screen := &Screen{Chr: chr, Nametable: nametable, Palette: palette}
+	img, err := screen.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		x, y  int
+		entry byte
+	}{
+		{0, 0, 0x30},
+		{8, 0, 0x0f},
+		{16, 0, 0x01},
+		{16, 16, 0x16},
+	}
+	for _, e := range expected {
+		if img.RGBAAt(e.x, e.y) != ppuColor(e.entry) {
+			t.Errorf("pixel %d,%d: expected color $%02x", e.x, e.y, e.entry)
+		}
+	}
+
+	for _, patternTable := range []int{-1, 2} {
+		screen.PatternTable = patternTable
+		_, err = screen.Render()
+		if err == nil {
+			t.Errorf("expected pattern table %d to be an error", patternTable)
+		}
+	}
+}
+
+func parseTestProgram(t *testing.T, source string) *Program {
+	programAst, err := Parse(bytes.NewBufferString(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := programAst.ToProgram()
+	if len(program.Errors) > 0 {
+		t.Fatal(program.Errors)
+	}
+	return program
+}
+
+func TestTiming(t *testing.T) {
+	source := ".org $c000\n" +
+		"Straight:\n" +
+		"    lda #$01\n" + // 2
+		"    sta $00\n" + // 3
+		"    rts\n" + // 6
+		"Branch:\n" +
+		"    lda $00\n" + // 3
+		"    beq Branch_done\n" + // 2, or 3 taken
+		"    lda #$01\n" + // 2
+		"Branch_done:\n" +
+		"    rts\n" + // 6
+		"Calls:\n" +
+		"    jsr Straight\n" + // 6
+		"    rts\n" + // 6
+		// the first walk enters the loop at Loop_test, through
+		// Loop_pad, and the second at Loop_body
+		"Loop:\n" +
+		"    lda $00\n" + // 3
+		"    beq Loop_pad\n" + // 2, or 3 taken
+		"Loop_body:\n" +
+		"    iny\n" + // 2
+		"Loop_test:\n" +
+		"    dex\n" + // 2
+		"    bne Loop_body\n" + // 2, or 3 taken
+		"    rts\n" + // 6
+		"Loop_pad:\n" +
+		"    nop\n" +
+		"    nop\n" +
+		"    nop\n" +
+		"    nop\n" +
+		"    nop\n" + // 10
+		"    jmp Loop_test\n" + // 3
+		".org $fffa\n" +
+		"    .dw Calls\n" +
+		"    .dw Calls\n" +
+		"    .dw Calls\n"
+	program := parseTestProgram(t, source)
+	report, err := program.AnalyzeTiming([]string{"Branch", "Loop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subs := make(map[string]*SubroutineTiming)
+	for _, sub := range report.Subroutines {
+		subs[sub.Name] = sub
+	}
+	expected := map[string]CycleCount{
+		"Straight": {11, 11, true},
+		"Branch":   {12, 13, true},
+		"Calls":    {23, 23, true},
+		// through Loop_body and Loop_test, however the loop was walked
+		"Loop": {17, 17, false},
+	}
+	for name, cycles := range expected {
+		sub, ok := subs[name]
+		if !ok {
+			t.Errorf("%s: not analyzed", name)
+			continue
+		}
+		if sub.Cycles.Min != cycles.Min || sub.Cycles.Bounded != cycles.Bounded ||
+			(cycles.Bounded && sub.Cycles.Max != cycles.Max) {
+			t.Errorf("%s: expected %s cycles, got %s", name, cycles.String(), sub.Cycles.String())
+		}
+		if !sub.Returns {
+			t.Errorf("%s: expected it to return", name)
+		}
+	}
+	if len(subs["Loop"].Loops) == 0 {
+		t.Errorf("expected Loop to have a loop")
+	}
+	if report.Nmi != subs["Calls"] {
+		t.Errorf("expected the NMI handler to be Calls")
+	}
+	if len(subs["Calls"].Calls) != 1 || subs["Calls"].Calls[0] != "Straight" {
+		t.Errorf("expected Calls to call Straight, got %v", subs["Calls"].Calls)
+	}
+}
+
+// every branch in the loop rejoins the next one, which doubles the paths
+// through it each time
+func TestTimingManyBranches(t *testing.T) {
+	source := ".org $c000\n" +
+		"Reset_Routine:\n" +
+		"    ldx #$10\n" + // 2
+		"Main:\n"
+	for n := 0; n < 30; n++ {
+		source += "    lda $00\n" + // 3
+			"    beq " + fmt.Sprintf("Skip%d", n) + "\n" + // 3 taken, or 2
+			"    inx\n" + // 2
+			fmt.Sprintf("Skip%d:\n", n)
+	}
+	source += "    dex\n" + // 2
+		"    bne Main\n" + // 2, or 3 taken
+		"    rts\n" + // 6
+		"Forever:\n" +
+		"    lda $00\n" +
+		"    beq Forever_skip\n" +
+		"    inx\n" +
+		"Forever_skip:\n" +
+		"    jmp Forever\n" +
+		".org $fffa\n" +
+		"    .dw Forever\n" +
+		"    .dw Reset_Routine\n" +
+		"    .dw Forever\n"
+	program := parseTestProgram(t, source)
+	start := time.Now()
+	report, err := program.AnalyzeTiming([]string{"Reset_Routine"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the analysis took %s", elapsed)
+	}
+	var sub *SubroutineTiming
+	for _, s := range report.Subroutines {
+		if s.Name == "Reset_Routine" {
+			sub = s
+		}
+	}
+	if sub == nil {
+		t.Fatal("Reset_Routine not analyzed")
+	}
+	expected := CycleCount{2 + 30*6 + 2 + 2 + 6, 0, false}
+	if sub.Cycles.Min != expected.Min || sub.Cycles.Bounded {
+		t.Errorf("expected %s cycles, got %s", expected.String(), sub.Cycles.String())
+	}
+	if len(sub.Loops) != 1 || sub.Loops[0] != program.Labels["Main"] {
+		t.Errorf("expected a loop at Main, got %v", sub.Loops)
+	}
+	if report.Nmi == nil || report.Nmi.Returns || len(report.Nmi.Loops) != 1 {
+		t.Errorf("expected the NMI handler to loop forever")
+	}
+}
+
+func TestControlFlowGraph(t *testing.T) {
+	source := ".org $c000\n" +
+		"Reset_Routine:\n" +
+		"    ldx #$03\n" + // $c000
+		"Loop:\n" +
+		"    jsr Sub\n" + // $c002
+		"    dex\n" + // $c005
+		"    bne Loop\n" + // $c006
+		"    jmp Reset_Routine\n" + // $c008
+		"Sub:\n" +
+		"    lda $00\n" + // $c00b
+		"    beq Sub_done\n" + // $c00d
+		"    lda #$01\n" + // $c00f
+		"Sub_done:\n" +
+		"    rts\n" + // $c011
+		"Nmi_Routine:\n" +
+		"    rti\n" + // $c012
+		".org $fffa\n" +
+		"    .dw Nmi_Routine\n" +
+		"    .dw Reset_Routine\n" +
+		"    .dw Nmi_Routine\n"
+	g := parseTestProgram(t, source).ControlFlowGraph()
+
+	blocks := [][2]int{
+		{0xc000, 0xc002},
+		{0xc002, 0xc005},
+		{0xc005, 0xc008},
+		{0xc008, 0xc00b},
+		{0xc00b, 0xc00f},
+		{0xc00f, 0xc011},
+		{0xc011, 0xc012},
+		{0xc012, 0xc013},
+	}
+	if len(g.Blocks) != len(blocks) {
+		t.Errorf("expected %d blocks, got %d", len(blocks), len(g.Blocks))
+	}
+	for _, b := range blocks {
+		block := g.BlockAt(b[0])
+		if block == nil || block.End != b[1] {
+			t.Errorf("expected a block from $%04x to $%04x", b[0], b[1])
+		}
+	}
+
+	edges := []CfgEdge{
+		{0xc000, 0xc002, FallthroughEdge},
+		{0xc002, 0xc00b, CallEdge},
+		{0xc002, 0xc005, FallthroughEdge},
+		{0xc005, 0xc002, BranchEdge},
+		{0xc005, 0xc008, FallthroughEdge},
+		{0xc008, 0xc000, JumpEdge},
+		{0xc00b, 0xc011, BranchEdge},
+		{0xc00b, 0xc00f, FallthroughEdge},
+		{0xc00f, 0xc011, FallthroughEdge},
+		{0xc011, 0xc005, ReturnEdge},
+		{0xc012, -1, ReturnEdge},
+	}
+	if len(g.Edges) != len(edges) {
+		t.Errorf("expected %d edges, got %d", len(edges), len(g.Edges))
+	}
+	for _, expected := range edges {
+		found := false
+		for _, edge := range g.Edges {
+			if *edge == expected {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected a %s edge from $%04x to $%04x", expected.Kind.String(), expected.From, expected.To)
+		}
+	}
+
+	subs := []CfgSubroutine{
+		{"Reset_Routine", 0xc000, []int{0xc000, 0xc002, 0xc005, 0xc008}, []int{0xc00b}},
+		{"Sub", 0xc00b, []int{0xc00b, 0xc00f, 0xc011}, nil},
+		{"Nmi_Routine", 0xc012, []int{0xc012}, nil},
+	}
+	if len(g.Subroutines) != len(subs) {
+		t.Fatalf("expected %d subroutines, got %d", len(subs), len(g.Subroutines))
+	}
+	for n, expected := range subs {
+		sub := g.Subroutines[n]
+		if sub.Name != expected.Name || sub.Entry != expected.Entry ||
+			fmt.Sprint(sub.Blocks) != fmt.Sprint(expected.Blocks) ||
+			fmt.Sprint(sub.Calls) != fmt.Sprint(expected.Calls) {
+			t.Errorf("expected subroutine %v, got %v", expected, *sub)
+		}
+	}
+
+	// nodes outside of the code are declared once however many edges go
+	// to them
+	g = parseTestProgram(t, ".org $c000\n"+
+		"Reset_Routine:\n"+
+		"    jsr $8000\n"+
+		"    jsr $8000\n"+
+		"    jmp ($0000)\n"+
+		"Nmi_Routine:\n"+
+		"    rti\n"+
+		".org $fffa\n"+
+		"    .dw Nmi_Routine\n"+
+		"    .dw Reset_Routine\n"+
+		"    .dw Nmi_Routine\n").ControlFlowGraph()
+	buf := new(bytes.Buffer)
+	err := g.WriteDot(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot := buf.String()
+	for _, node := range []string{"[label=\"$8000\" style=\"dashed\"]", "dynamic [label=\"?\""} {
+		if n := strings.Count(dot, node); n != 1 {
+			t.Errorf("expected %s to be declared once, got %d times:\n%s", node, n, dot)
+		}
+	}
+}
+
+func TestCodeDataLog(t *testing.T) {
+	prg := make([]byte, 0x4000)
+	copy(prg, []byte{
+		0xa9, 0x00, // $c000 lda #$00
+		0xf0, 0x04, // $c002 beq $c008
+		0x4c, 0x00, 0xc0, // $c004 jmp $c000
+		0xea,
+		0xa9, 0x01, // $c008 logged as data
+		0xea, 0xea, 0xea, 0xea, 0xea, 0xea,
+		0xa9, 0x05, // $c010 only reached indirectly
+		0x60,
+	})
+	copy(prg[0x3ffa:], []byte{0x00, 0xc0, 0x00, 0xc0, 0x00, 0xc0})
+	log := make([]byte, 0x4000+0x2000)
+	for _, addr := range []int{0xc000, 0xc002, 0xc004, 0xc010, 0xc012} {
+		log[addr-0xc000] = cdlCode
+	}
+	log[0xc008-0xc000] = cdlData
+	log[0xc009-0xc000] = cdlData
+
+	_, err := ReadCdl(bytes.NewReader(log[:0x3fff]), len(prg))
+	if err == nil {
+		t.Error("expected a log shorter than PRG ROM to be an error")
+	}
+	cdl, err := ReadCdl(bytes.NewReader(log), len(prg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cdl.Prg) != 0x4000 || len(cdl.Chr) != 0x2000 {
+		t.Fatalf("expected 16KB of PRG and 8KB of CHR flags, got %d and %d", len(cdl.Prg), len(cdl.Chr))
+	}
+
+	rom := &Rom{PrgRom: [][]byte{prg}}
+	program, err := rom.Disassemble(&DisassembleOptions{Cdl: cdl})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := program.Offsets[0xc010].Value.(*Instruction); !ok {
+		t.Error("expected code logged at $c010 to be disassembled")
+	}
+	if elem := program.Offsets[0xc008]; elem == nil {
+		t.Error("expected data logged at $c008 to be kept")
+	} else if _, ok := elem.Value.(*Instruction); ok {
+		t.Error("expected data logged at $c008 not to be disassembled")
+	}
+	if !strings.Contains(strings.Join(program.Warnings, "\n"), "$c008: reached as code but logged as data") {
+		t.Errorf("expected a warning about $c008, got %v", program.Warnings)
+	}
+
+	// a log recorded with a different ROM is ignored
+	cdl, err = ReadCdl(bytes.NewReader(log), 0x2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, err = rom.Disassemble(&DisassembleOptions{Cdl: cdl})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.Join(program.Warnings, "\n"), "ignoring it") {
+		t.Errorf("expected a warning that the log is ignored, got %v", program.Warnings)
+	}
+	if _, ok := program.Offsets[0xc010].Value.(*Instruction); ok {
+		t.Error("expected $c010 not to be disassembled without the log")
+	}
+}
+
+func TestDisassemblyHints(t *testing.T) {
+	hints, err := ReadDisassemblyHints(strings.NewReader("# hints for a test\n" +
+		"label=$c000,Start\n" +
+		"label=$0300,Missing\n" +
+		"label=$0100,AlsoMissing\n" +
+		"entry=$c010\n" +
+		"code=$c010-$c012\n" +
+		"bytes=$c020-$c02f\n" +
+		"words=$c030-$c033\n" +
+		"pointers=$c040-$c041\n" +
+		"rtstable=0xc050-0xc053\n" +
+		"jumptable=49248\n" +
+		"comment=$c000,starts here\n" +
+		"comment=$c003, the operand of sta\n" +
+		"comment=$c00e,second word\n" +
+		"comment=$0400,not in the ROM\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hints.Labels[0xc000] != "Start" || hints.Labels[0x0300] != "Missing" {
+		t.Errorf("unexpected labels %v", hints.Labels)
+	}
+	if len(hints.Entries) != 1 || hints.Entries[0] != 0xc010 {
+		t.Errorf("unexpected entries %v", hints.Entries)
+	}
+	if len(hints.Code) != 1 || hints.Code[0] != (AddrRange{0xc010, 0xc012}) {
+		t.Errorf("unexpected code ranges %v", hints.Code)
+	}
+	if len(hints.Bytes) != 1 || len(hints.Words) != 1 || len(hints.Pointers) != 1 {
+		t.Errorf("unexpected data ranges %v %v %v", hints.Bytes, hints.Words, hints.Pointers)
+	}
+	if len(hints.RtsTables) != 1 || hints.RtsTables[0] != (AddrRange{0xc050, 0xc053}) {
+		t.Errorf("unexpected rts tables %v", hints.RtsTables)
+	}
+	if len(hints.JumpTables) != 1 || hints.JumpTables[0] != 0xc060 {
+		t.Errorf("unexpected jump tables %v", hints.JumpTables)
+	}
+	if len(hints.Comments[0xc003]) != 1 || hints.Comments[0xc003][0] != "the operand of sta" {
+		t.Errorf("unexpected comments %v", hints.Comments)
+	}
+
+	bad := []string{
+		"label=$c000\n",
+		"entry=$10000\n",
+		"code=$c0ff-$c000\n",
+		"words=$c000-$c002\n",
+		"colour=$c000\n",
+		"entry\n",
+	}
+	for _, line := range bad {
+		_, err := ReadDisassemblyHints(strings.NewReader("entry=$c000\n" + line))
+		if err == nil {
+			t.Errorf("expected an error for %q", line)
+		} else if !strings.HasPrefix(err.Error(), "Line 2: ") {
+			t.Errorf("expected the error for %q to be on line 2, got %s", line, err.Error())
+		}
+	}
+
+	prg := make([]byte, 0x4000)
+	copy(prg, []byte{
+		0xa9, 0x00, // $c000 lda #$00
+		0x8d, 0x00, 0x02, // $c002 sta $0200
+		0x4c, 0x00, 0xc0, // $c005 jmp $c000
+	})
+	copy(prg[0x08:], []byte("HELLO WORLD"))
+	copy(prg[0x3ffa:], []byte{0x00, 0xc0, 0x00, 0xc0, 0x00, 0xc0})
+	hints, err = ReadDisassemblyHints(strings.NewReader("label=$c000,Start\n" +
+		"label=$0200,Counter\n" +
+		"label=$0300,Unused\n" +
+		"label=$5000,Missing\n" +
+		"comment=$c000,starts here\n" +
+		"comment=$c003,the operand of sta\n" +
+		"comment=$c00e,second word\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rom := &Rom{PrgRom: [][]byte{prg}}
+	program, err := rom.Disassemble(&DisassembleOptions{Hints: hints})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i, ok := program.Offsets[0xc002].Value.(*Instruction); !ok || i.OpName != "sta" || i.Value != 0x0200 {
+		t.Errorf("expected a comment on an operand not to change the instruction, got %#v", program.Offsets[0xc002].Value)
+	}
+	buf := new(bytes.Buffer)
+	err = program.WriteSource(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := buf.String()
+	for _, expected := range []string{
+		"; starts here\n; jumped to from $c005\nStart:\n",
+		"; the operand of sta\n    sta Counter\n",
+		"; second word\n    .db \"WORLD\"\n",
+		"Counter = $0200 ; 0 reads, 1 write\n",
+		"Unused = $0300\n",
+	} {
+		if !strings.Contains(source, expected) {
+			t.Errorf("expected the source to contain %q:\n%s", expected, source)
+		}
+	}
+
+	warnings := strings.Join(program.Warnings, "\n")
+	expected := "$5000: unable to name Missing: not in PRG ROM or RAM\n" +
+		"$c003: comment moved to $c002, the start of the statement containing it"
+	if warnings != expected {
+		t.Errorf("expected the warnings\n%s\ngot\n%s", expected, warnings)
+	}
+}
+
+func TestCompilableSubroutines(t *testing.T) {
+	source := ".org $c000\n" +
+		"Reset_Routine:\n" +
+		"    jsr Balanced\n" +
+		"    jsr Unbalanced\n" +
+		"    jsr CallsUnbalanced\n" +
+		"    jsr CallsBalanced\n" +
+		"    jmp Reset_Routine\n" +
+		"Balanced:\n" +
+		"    pha\n" +
+		"    lda #$01\n" +
+		"    beq Balanced_done\n" +
+		"    lda #$02\n" +
+		"Balanced_done:\n" +
+		"    pla\n" +
+		"    rts\n" +
+		"Unbalanced:\n" +
+		"    pla\n" +
+		"    pla\n" +
+		"    rts\n" +
+		"CallsUnbalanced:\n" +
+		"    jsr Unbalanced\n" +
+		"    rts\n" +
+		"CallsBalanced:\n" +
+		"    jsr Balanced\n" +
+		"    rts\n" +
+		"IRQ_Routine:\n" +
+		"NMI_Routine:\n" +
+		"    rti\n" +
+		".org $fffa\n" +
+		"    .dw NMI_Routine\n" +
+		"    .dw Reset_Routine\n" +
+		"    .dw IRQ_Routine\n"
+	program := parseTestProgram(t, source)
+	subs := program.compilableSubroutines(program.ControlFlowGraph(), nil)
+	expected := map[string]bool{
+		"Reset_Routine":   false,
+		"Balanced":        true,
+		"Unbalanced":      false,
+		"CallsUnbalanced": false,
+		"CallsBalanced":   true,
+	}
+	for name, ok := range expected {
+		if (subs[program.Labels[name]] != nil) != ok {
+			t.Errorf("%s: expected compilable to be %v", name, ok)
+		}
+	}
+
+	// ruling out a subroutine rules out its callers too
+	subs = program.compilableSubroutines(program.ControlFlowGraph(), func(sub *CfgSubroutine) bool {
+		return sub.Name != "Balanced"
+	})
+	if len(subs) != 0 {
+		t.Errorf("expected no compilable subroutines, got %d", len(subs))
+	}
+
+	// the module which the subroutines are compiled into verifies
+	buf := new(bytes.Buffer)
+	err := program.Assemble(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	program.PrgRom = [][]byte{buf.Bytes()}
+	fd, err := ioutil.TempFile("", "jamulator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+	c, err := program.CompileToFile(fd, &CompileOptions{Output: IrOutput})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Errors) > 0 {
+		t.Errorf("unexpected errors compiling: %v", c.Errors)
+	}
+	if len(c.subroutines) != 2 {
+		t.Errorf("expected 2 subroutines to be compiled as functions, got %d", len(c.subroutines))
+	}
+}
+
+func TestIndexValues(t *testing.T) {
+	source := ".org $c000\n" +
+		"Reset_Routine:\n" +
+		"    ldx #$05\n" +
+		"    sta $0300, x\n" + // X is 5
+		"    inx\n" +
+		"    sta $f8, x\n" + // 6
+		"    lda #$07\n" +
+		"    sta $00\n" +
+		"    ldx $00\n" +
+		"    sta $0300, x\n" + // unknown, RAM could change at any time
+		"    sta $f8, x\n" + // unknown
+		"    sta $ff80, x\n" + // unknown, and could wrap around
+		"    ldx #$01\n" +
+		"    jsr Sub\n" +
+		"    sta $0300, x\n" + // unknown after a subroutine
+		"    ldx #$02\n" +
+		"Next:\n" +
+		"    sta $0300, x\n" + // unknown after a label
+		"    ldx #$10\n" +
+		"    sta $fff8, x\n" + // 16, wraps around to $0008
+		"    sta $f8, x\n" + // 16, wraps around to $08
+		"    jmp Reset_Routine\n" +
+		"Sub:\n" +
+		"    rts\n" +
+		"IRQ_Routine:\n" +
+		"NMI_Routine:\n" +
+		"    rti\n" +
+		".org $fffa\n" +
+		"    .dw NMI_Routine\n" +
+		"    .dw Reset_Routine\n" +
+		"    .dw IRQ_Routine\n"
+	program := parseTestProgram(t, source)
+	buf := new(bytes.Buffer)
+	err := program.Assemble(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	program.PrgRom = [][]byte{buf.Bytes()}
+
+	var indexed []*Instruction
+	for e := program.List.Front(); e != nil; e = e.Next() {
+		i, ok := e.Value.(*Instruction)
+		if ok && (i.OpCode == 0x9d || i.OpCode == 0x95) { // sta abs,x and zp,x
+			indexed = append(indexed, i)
+		}
+	}
+	expected := [][]int{{5}, {6}, nil, nil, nil, nil, nil, {16}, {16}}
+	if len(indexed) != len(expected) {
+		t.Fatalf("expected %d indexed stores, got %d", len(expected), len(indexed))
+	}
+	values := program.indexValues()
+	for n, i := range indexed {
+		x := values[i.Offset].x
+		if !reflect.DeepEqual(x, expected[n]) {
+			t.Errorf("$%04x %s: expected X to be %v, got %v", i.Offset, i.Render(), expected[n], x)
+		}
+	}
+
+	// the range of addresses which each store can write to
+	fd, err := ioutil.TempFile("", "jamulator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+	c, err := program.CompileToFile(fd, &CompileOptions{Output: IrOutput})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges := [][2]int{
+		{0x0305, 0x0305},
+		{0xfe, 0xfe},
+		{0x0300, 0x03ff},
+		{0x00, 0xff},
+		// past $ffff could be anywhere once it wraps
+		{0x0000, 0xffff},
+		{0x0300, 0x03ff},
+		{0x0300, 0x03ff},
+		{0x0008, 0x0008},
+		{0x08, 0x08},
+	}
+	for n, i := range indexed {
+		c.currentInstr = i
+		minAddr, maxAddr := wrapAddrRange(c.indexedRange(i.Value, c.rX, i.OpCode == 0x95))
+		if minAddr != ranges[n][0] || maxAddr != ranges[n][1] {
+			t.Errorf("$%04x %s: expected $%04x-$%04x, got $%04x-$%04x",
+				i.Offset, i.Render(), ranges[n][0], ranges[n][1], minAddr, maxAddr)
+		}
+	}
+}
+
+func TestCompileOptions(t *testing.T) {
+	var opts *CompileOptions
+	if o := opts.normalize(); o.OptLevel != 2 {
+		t.Errorf("nil options: expected OptLevel 2, got %d", o.OptLevel)
+	}
+	opts = &CompileOptions{Flags: DisableOptFlag, OptLevel: 3}
+	if o := opts.normalize(); o.OptLevel != 0 {
+		t.Errorf("DisableOptFlag: expected OptLevel 0, got %d", o.OptLevel)
+	}
+	if opts.OptLevel != 3 {
+		t.Error("normalize changed the options it was given")
+	}
+	if DisableOptFlag != 1 || DumpModuleFlag != 2 {
+		t.Error("the values of CompileFlags changed")
+	}
+	rom := &Rom{PrgRom: [][]byte{make([]byte, 0x4000)}}
+	err := rom.RecompileToBinary("out", &CompileOptions{Target: "wasm32-unknown-unknown"}, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "wasm32-unknown-unknown") {
+		t.Errorf("expected recompiling for another target to fail, got %v", err)
+	}
+}
+
+func TestRuntimeLibs(t *testing.T) {
+	old := os.Getenv("JAMULATOR_LIBS")
+	defer os.Setenv("JAMULATOR_LIBS", old)
+	os.Setenv("JAMULATOR_LIBS", "-lfoo -lbar")
+	if libs := runtimes["sdl"].linkLibs(); strings.Join(libs, " ") != "-lfoo -lbar" {
+		t.Errorf("sdl: expected the libraries from JAMULATOR_LIBS, got %v", libs)
+	}
+	if libs := runtimes["headless"].linkLibs(); len(libs) != 0 {
+		t.Errorf("headless: expected no libraries, got %v", libs)
+	}
+	toolchain := &Toolchain{Runtime: "vga"}
+	if _, err := toolchain.runtime(); err == nil {
+		t.Error("expected an unknown runtime to fail")
+	}
+}
+
+// the regression test recompiles every ROM in -roms with the headless
+// runtime and compares what it does with golden files next to the ROM:
+//
+//	name.nes     the ROM
+//	name.movie   button presses to play back. optional.
+//	name.hashes  the -hash-frames output of the runtime, one frame a line
+//	name.ram     RAM when the last frame is done. only compared if it
+//	             exists.
+//
+// -update runs each ROM for -frames frames and writes the goldens.
+var (
+	regressionRoms   = flag.String("roms", "test/roms", "directory of ROMs for the regression test")
+	regressionUpdate = flag.Bool("update", false, "write the golden files of the regression test instead of comparing with them")
+	regressionFrames = flag.Int("frames", 300, "how many frames to write golden files for with -update")
+)
+
+func regressionToolchain(t *testing.T) *Toolchain {
+	toolchain := DefaultToolchain()
+	toolchain.Runtime = "headless"
+	toolchain.RuntimeArchive = os.Getenv("JAMULATOR_HEADLESS_RUNTIME")
+	if toolchain.RuntimeArchive == "" {
+		// runtime/ is next to this package, wherever the test runs from
+		_, file, _, ok := runtime.Caller(0)
+		if !ok {
+			t.Skip("cannot find the source of the test")
+		}
+		toolchain.RuntimeArchive = filepath.Join(filepath.Dir(file), "..", "runtime", "headless.a")
+	}
+	_, err := os.Stat(toolchain.RuntimeArchive)
+	if err != nil {
+		t.Skipf("headless runtime not built: %s", err.Error())
+	}
+	_, err = exec.LookPath(toolchain.Llc)
+	if err != nil {
+		t.Skipf("%s not found", toolchain.Llc)
+	}
+	return toolchain
+}
+
+func TestRecompiledRoms(t *testing.T) {
+	if testing.Short() {
+		t.Skip("recompiling ROMs takes a while")
+	}
+	roms, err := filepath.Glob(filepath.Join(*regressionRoms, "*.nes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roms) == 0 {
+		t.Skipf("no ROMs in %s", *regressionRoms)
+	}
+	toolchain := regressionToolchain(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	for _, romFile := range roms {
+		name := removeExt(romFile)
+		base := filepath.Base(name)
+		t.Run(base, func(t *testing.T) {
+			testRecompiledRom(t, toolchain, name, filepath.Join(tmpDir, base), 0)
+		})
+		if *regressionUpdate {
+			continue
+		}
+		// batching cycles must not change what the PPU sees
+		t.Run(base+"-batch-cycles", func(t *testing.T) {
+			testRecompiledRom(t, toolchain, name, filepath.Join(tmpDir, base+"-batch-cycles"), BatchCyclesFlag)
+		})
+	}
+}
+
+func removeExt(filename string) string {
+	return filename[:len(filename)-len(filepath.Ext(filename))]
+}
+
+func testRecompiledRom(t *testing.T, toolchain *Toolchain, name string, binFile string, flags CompileFlags) {
+	frames := *regressionFrames
+	expectedHashes, err := ioutil.ReadFile(name + ".hashes")
+	if err == nil && !*regressionUpdate {
+		frames = len(strings.Split(strings.TrimSpace(string(expectedHashes)), "\n"))
+	} else if !*regressionUpdate {
+		t.Fatalf("%s.hashes: %s. run with -update to create it", name, err.Error())
+	}
+
+	rom, err := LoadFile(name + ".nes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rom.RecompileToBinary(binFile, &CompileOptions{Flags: flags, OptLevel: 2}, &DisassembleOptions{}, toolchain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ramFile := binFile + ".ram"
+	args := []string{"-frames", fmt.Sprintf("%d", frames), "-hash-frames", "-dump-ram", ramFile}
+	if _, err := os.Stat(name + ".movie"); err == nil {
+		args = append(args, "-movie", name+".movie")
+	}
+	out, err := exec.Command(binFile, args...).Output()
+	if err != nil {
+		t.Fatalf("%s: %s", binFile, err.Error())
+	}
+	ram, err := ioutil.ReadFile(ramFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *regressionUpdate {
+		err = ioutil.WriteFile(name+".hashes", out, 0644)
+		if err == nil {
+			err = ioutil.WriteFile(name+".ram", ram, 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	actual := strings.Split(strings.TrimSpace(string(out)), "\n")
+	expected := strings.Split(strings.TrimSpace(string(expectedHashes)), "\n")
+	for n := range expected {
+		if n >= len(actual) {
+			t.Fatalf("expected %d frames, got %d", len(expected), len(actual))
+		}
+		if actual[n] != expected[n] {
+			t.Fatalf("frame %d differs: expected %q, got %q", n+1, expected[n], actual[n])
+		}
+	}
+	expectedRam, err := ioutil.ReadFile(name + ".ram")
+	if err == nil && !bytes.Equal(ram, expectedRam) {
+		for a := range ram {
+			if a < len(expectedRam) && ram[a] != expectedRam[a] {
+				t.Fatalf("RAM differs at $%04x: expected $%02x, got $%02x", a, expectedRam[a], ram[a])
+			}
+		}
+		t.Fatalf("RAM is %d bytes, expected %d", len(ram), len(expectedRam))
+	}
+}
+
+func TestReferenceCpu(t *testing.T) {
+	bin, err := ioutil.ReadFile("test/hello.bin.ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	_, err = RunReference([][]byte{bin}, 1000, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "Hello, world!\n" {
+		t.Errorf("hello printed %q", out.String())
+	}
+
+	bin, err = ioutil.ReadFile("test/diff6502.bin.ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := NewNesMemory([][]byte{bin})
+	cpu := NewCpu(mem)
+	for !mem.Exited {
+		err = cpu.Step()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for x := 0; x < 0x100; x++ {
+		if mem.Ram[0x200+x] != byte(x+0x7f) || mem.Ram[0x300+x] != byte(x-0x80) {
+			t.Fatalf("adc and sbc of $%02x: $%02x and $%02x", x, mem.Ram[0x200+x], mem.Ram[0x300+x])
+		}
+	}
+	// stack pointer after jsr, jsr, jsr
+	if mem.Ram[0x0a] != 0xf7 {
+		t.Errorf("expected the stack pointer to be $f7 in Leaf, got $%02x", mem.Ram[0x0a])
+	}
+	// zero page indexing wraps around
+	if mem.Ram[0x10] != 0x44 || mem.Ram[0x11] != 0x44 {
+		t.Errorf("expected $44 in $10 and $11, got $%02x and $%02x", mem.Ram[0x10], mem.Ram[0x11])
+	}
+}
+
+// the flags TestDifferential compiles each program with, on top of
+// TraceFlag
+var differentialFlags = []struct {
+	name  string
+	flags CompileFlags
+}{
+	{"lazy-flags", 0},
+	{"eager-flags", EagerFlagsFlag},
+	{"batch-cycles", BatchCyclesFlag},
+}
+
+// recompiles the programs in test with TraceFlag, and checks that they
+// do the same as on the reference interpreter
+func TestDifferential(t *testing.T) {
+	if testing.Short() {
+		t.Skip("recompiling takes a while")
+	}
+	toolchain := regressionToolchain(t)
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	for _, binFile := range []string{"test/hello.bin.ref", "test/dispatch.bin.ref", "test/diff6502.bin.ref", "test/indexed.bin.ref"} {
+		for _, variant := range differentialFlags {
+			name := removeExt(removeExt(filepath.Base(binFile))) + "-" + variant.name
+			flags := TraceFlag | variant.flags
+			t.Run(name, func(t *testing.T) {
+				testDifferential(t, toolchain, binFile, filepath.Join(tmpDir, name), flags)
+			})
+		}
+	}
+}
+
+func testDifferential(t *testing.T, toolchain *Toolchain, binFile string, exeFile string, flags CompileFlags) {
+	bin, err := ioutil.ReadFile(binFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reference, err := RunReference([][]byte{bin}, 1000000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rom := &Rom{PrgRom: [][]byte{bin}, ChrRom: [][]byte{make([]byte, 0x2000)}}
+	err = rom.RecompileToBinary(exeFile, &CompileOptions{Flags: flags, OptLevel: 2}, &DisassembleOptions{}, toolchain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(exeFile).Output()
+	if err != nil {
+		t.Fatalf("%s: %s", exeFile, err.Error())
+	}
+	actual, err := ParseTrace(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, err := rom.Disassemble(&DisassembleOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CompareTraces(program, reference, actual)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
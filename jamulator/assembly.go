@@ -15,12 +15,24 @@ type Program struct {
 	List      *list.List
 	Labels    map[string]int
 	Errors    []string
+	Warnings  []string
 	ChrRom    [][]byte
 	PrgRom    [][]byte
 	Mirroring Mirroring
 	// maps memory offset to element in Ast
 	Offsets    map[int]*list.Element
 	Variables map[string]int
+	// how much of the ROM the disassembler identified. nil for programs
+	// which were not disassembled.
+	Report *DisassemblyReport
+	// addresses in PRG ROM which could not be labeled because they are
+	// in the middle of an instruction
+	refusedLabels []int
+	// encoding of the strings in data statements, or nil for ASCII
+	TextTable *TextTable
+	// line comments to render above the statement at each address and
+	// its labels
+	Comments map[int][]string
 }
 
 type Assembler interface {
@@ -132,6 +144,15 @@ func (i *Instruction) Resolve() error {
 		}
 		return errors.New(fmt.Sprintf("Line %d: Unrecognized direct instruction: %s", i.Line, i.OpName))
 	case DirectWithLabelInstruction:
+		if i.zeroPage {
+			i.OpCode, ok = opNameToOpCode[zeroPageAddr][lowerOpName]
+			if ok {
+				// 0 is placeholder for when we resolve the label
+				i.Payload = []byte{i.OpCode, 0}
+				return nil
+			}
+			i.zeroPage = false
+		}
 		i.OpCode, ok = opNameToOpCode[absAddr][lowerOpName]
 		if ok {
 			// 0s are placeholder for when we resolve the label
@@ -185,6 +206,19 @@ func (i *Instruction) Resolve() error {
 		return errors.New(fmt.Sprintf("Line %d: Register argument must be X or Y", i.Line))
 	case DirectWithLabelIndexedInstruction:
 		lowerRegName := strings.ToLower(i.RegisterName)
+		if i.zeroPage {
+			addrMode := zeroXIndexAddr
+			if lowerRegName == "y" {
+				addrMode = zeroYIndexAddr
+			}
+			i.OpCode, ok = opNameToOpCode[addrMode][lowerOpName]
+			if ok {
+				// 0 is placeholder until we resolve labels
+				i.Payload = []byte{i.OpCode, 0}
+				return nil
+			}
+			i.zeroPage = false
+		}
 		if lowerRegName == "x" {
 			i.OpCode, ok = opNameToOpCode[absXAddr][lowerOpName]
 			if ok {
@@ -251,6 +285,10 @@ func (i *Instruction) Assemble(sg symbolGetter) error {
 		if i.Value > 0xffff {
 			return errors.New(fmt.Sprintf("Line %d: Symbol must fit into 2 bytes: %s", i.Line, i.LabelName))
 		}
+		if i.zeroPage {
+			i.Payload[1] = byte(i.Value)
+			return nil
+		}
 		if len(i.Payload) == 2 {
 			// relative address
 			delta := i.Value - (i.Offset + len(i.Payload))
@@ -270,6 +308,10 @@ func (i *Instruction) Assemble(sg symbolGetter) error {
 		if i.Value > 0xffff {
 			return errors.New(fmt.Sprintf("Line %d: Symbol must fit into 2 bytes: %s", i.Line, i.LabelName))
 		}
+		if i.zeroPage {
+			i.Payload[1] = byte(i.Value)
+			return nil
+		}
 		binary.LittleEndian.PutUint16(i.Payload[1:], uint16(i.Value))
 	}
 	return nil
@@ -283,7 +325,15 @@ func (s *DataStatement) Resolve() error {
 			switch s.Type {
 			default: panic("unknown DataStatement Type")
 			case ByteDataStmt:
-				size += len(*t)
+				if s.table == nil {
+					size += len(*t)
+					break
+				}
+				encoded, err := s.table.Encode(string(*t))
+				if err != nil {
+					return errors.New(fmt.Sprintf("Line %d: %s", s.Line, err.Error()))
+				}
+				size += len(encoded)
 			case WordDataStmt:
 				return errors.New(fmt.Sprintf("Line %d: string invalid in data word statement.", s.Line))
 			}
@@ -325,6 +375,14 @@ func (s *DataStatement) Assemble(sg symbolGetter) error {
 			if s.Type != ByteDataStmt {
 				panic("expected ByteDataStmt")
 			}
+			if s.table != nil {
+				encoded, err := s.table.Encode(string(*t))
+				if err != nil {
+					return errors.New(fmt.Sprintf("Line %d: %s", s.Line, err.Error()))
+				}
+				offset += copy(s.Payload[offset:], encoded)
+				break
+			}
 			for _, c := range string(*t) {
 				s.Payload[offset] = byte(c)
 				offset += 1
@@ -372,6 +430,10 @@ func (p *Program) Assemble(w io.Writer) error {
 		default: panic("unexpected node")
 		case *LabelStatement:
 			// nothing to do
+		case *CommentStatement:
+			// nothing to do
+		case *AssignStatement:
+			// nothing to do
 		case *OrgPseudoOp:
 			offset = t.Value
 			orgFillValue = t.Fill
@@ -440,6 +502,8 @@ func (p *Program) Resolve() {
 	for e := p.List.Front(); e != nil; e = e.Next() {
 		switch t := e.Value.(type) {
 		default: panic("unexpected node")
+		case *CommentStatement:
+			// nothing to do
 		case *AssignStatement:
 			p.Variables[t.VarName] = t.Value
 		case *OrgPseudoOp:
@@ -465,6 +529,22 @@ func (p *Program) Resolve() {
 			}
 			p.Offsets[offset] = e
 			t.SetOffset(offset)
+			if s, ok := t.(*DataStatement); ok && p.TextTable != nil {
+				// backslash escapes only mean something in strings which
+				// are encoded with a text table
+				s.table = p.TextTable
+				for de := s.dataList.Front(); de != nil; de = de.Next() {
+					if str, ok := de.Value.(*StringDataItem); ok {
+						*str = StringDataItem(unescapeString(string(*str)))
+					}
+				}
+			}
+			if i, ok := t.(*Instruction); ok && len(i.LabelName) > 0 {
+				// symbols assigned earlier in zero page get the shorter
+				// addressing modes
+				value, isVar := p.Variables[i.LabelName]
+				i.zeroPage = isVar && value <= 0xff
+			}
 			err := t.Resolve()
 			if err != nil {
 				p.Errors = append(p.Errors, err.Error())
@@ -476,12 +556,19 @@ func (p *Program) Resolve() {
 }
 
 func (ast ProgramAst) ToProgram() (p *Program) {
+	return ast.ToProgramWithTextTable(nil)
+}
+
+// ToProgramWithTextTable is like ToProgram, but encodes the strings in
+// data statements with table.
+func (ast ProgramAst) ToProgramWithTextTable(table *TextTable) (p *Program) {
 	ast.ExpandLabeledStatements()
 	p = &Program{
 		List: ast.List,
 		Labels: make(map[string]int),
 		Offsets: make(map[int]*list.Element),
 		Variables: make(map[string]int),
+		TextTable: table,
 	}
 	p.Resolve()
 	return
@@ -0,0 +1,139 @@
+package jamulator
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// flags of each byte in a code/data log, as written by FCEUX and Mesen.
+// see http://www.fceux.com/web/help/fceux.html?CodeDataLogger.html
+const (
+	cdlCode         = 0x01
+	cdlData         = 0x02
+	cdlIndirectCode = 0x10
+	cdlIndirectData = 0x20
+	cdlPcmData      = 0x40
+)
+
+// CodeDataLog records which bytes of a ROM an emulator saw executed
+// and which it saw read as data.
+type CodeDataLog struct {
+	// one byte of flags for each byte of PRG ROM
+	Prg []byte
+	// one byte of flags for each byte of CHR ROM
+	Chr []byte
+}
+
+func (r *Rom) prgSize() int {
+	size := 0
+	for _, bank := range r.PrgRom {
+		size += len(bank)
+	}
+	return size
+}
+
+func ReadCdl(reader io.Reader, prgSize int) (*CodeDataLog, error) {
+	buf, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < prgSize {
+		return nil, errors.New(fmt.Sprintf("code/data log is %d bytes; expected at least %d", len(buf), prgSize))
+	}
+	cdl := &CodeDataLog{
+		Prg: buf[:prgSize],
+		Chr: buf[prgSize:],
+	}
+	return cdl, nil
+}
+
+// LoadCdlFile reads a code/data log which was recorded while playing r.
+func (r *Rom) LoadCdlFile(filename string) (*CodeDataLog, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	cdl, err := ReadCdl(fd, r.prgSize())
+	err2 := fd.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err2 != nil {
+		return nil, err2
+	}
+	return cdl, nil
+}
+
+func (d *Disassembly) cdlFlags(addr int) byte {
+	if d.cdl == nil {
+		return 0
+	}
+	// if there is only 1 prg rom bank, it is mirrored at 0x8000
+	if len(d.prog.PrgRom) == 1 && addr < 0xc000 {
+		addr += 0x4000
+	}
+	index := addr - d.offset
+	if index < 0 || index >= len(d.cdl.Prg) {
+		return 0
+	}
+	return d.cdl.Prg[index]
+}
+
+// whether the emulator only ever saw addr read as data
+func (d *Disassembly) cdlIsData(addr int) bool {
+	flags := d.cdlFlags(addr)
+	return flags&cdlCode == 0 && flags&(cdlData|cdlIndirectData|cdlPcmData) != 0
+}
+
+func (d *Disassembly) warn(format string, args ...interface{}) {
+	d.prog.Warnings = append(d.prog.Warnings, fmt.Sprintf(format, args...))
+}
+
+// use every byte that the code/data log says was executed as a
+// starting point for disassembly, and put labels where code was jumped
+// to indirectly and where data was read through a pointer.
+func (d *Disassembly) markCdlCode() {
+	if d.cdl == nil {
+		return
+	}
+	if len(d.cdl.Prg) != len(d.prog.PrgRom)*0x4000 {
+		d.warn("code/data log is for %d bytes of PRG ROM; ignoring it", len(d.cdl.Prg))
+		d.cdl = nil
+		return
+	}
+	addr := d.offset
+	for addr < 0x10000 {
+		flags := d.cdlFlags(addr)
+		if flags&cdlIndirectData != 0 && flags&cdlCode == 0 && d.cdlFlags(addr-1)&cdlIndirectData == 0 {
+			d.prog.getLabelAt(addr, "")
+		}
+		if flags&cdlCode == 0 {
+			addr += 1
+			continue
+		}
+		elem := d.prog.elemAtAddr(addr)
+		if elem == nil {
+			// part of an instruction which has already been disassembled
+			addr += 1
+			continue
+		}
+		if flags&cdlIndirectCode != 0 {
+			d.prog.getLabelAt(addr, "")
+		}
+		err := d.markAsInstruction(addr)
+		if err != nil {
+			d.warn("$%04x: logged as code but could not disassemble: %s", addr, err.Error())
+			addr += 1
+			continue
+		}
+		i, ok := elem.Value.(*Instruction)
+		if !ok {
+			addr += 1
+			continue
+		}
+		addr += len(i.Payload)
+	}
+}
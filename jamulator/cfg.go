@@ -0,0 +1,380 @@
+package jamulator
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+type EdgeKind int
+
+const (
+	FallthroughEdge EdgeKind = iota
+	BranchEdge
+	JumpEdge
+	CallEdge
+	ReturnEdge
+	// the destination is only known at runtime, e.g. jmp ($xxxx)
+	DynamicEdge
+)
+
+var edgeKindNames = []string{
+	"fallthrough",
+	"branch",
+	"jump",
+	"call",
+	"return",
+	"dynamic",
+}
+
+func (k EdgeKind) String() string {
+	return edgeKindNames[k]
+}
+
+func (k EdgeKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+type CfgEdge struct {
+	From int `json:"from"`
+	// -1 when the destination is not known statically
+	To   int      `json:"to"`
+	Kind EdgeKind `json:"kind"`
+}
+
+type CfgBlock struct {
+	Name string `json:"name,omitempty"`
+	// address of the first instruction
+	Start int `json:"start"`
+	// address after the last instruction
+	End          int            `json:"end"`
+	Instructions []*Instruction `json:"-"`
+	Succs        []*CfgEdge     `json:"-"`
+	Preds        []*CfgEdge     `json:"-"`
+}
+
+type CfgSubroutine struct {
+	Name  string `json:"name"`
+	Entry int    `json:"entry"`
+	// start addresses of the blocks reachable from Entry without
+	// following calls or returns
+	Blocks []int `json:"blocks"`
+	// entry addresses of the subroutines called with jsr
+	Calls []int `json:"calls"`
+}
+
+type ControlFlowGraph struct {
+	Blocks      []*CfgBlock
+	Edges       []*CfgEdge
+	Subroutines []*CfgSubroutine
+	blockAt     map[int]*CfgBlock
+}
+
+func (p *Program) labelNamesByAddr() map[int]string {
+	names := make(map[int]string)
+	for name, addr := range p.Labels {
+		existing, ok := names[addr]
+		if !ok || name < existing {
+			names[addr] = name
+		}
+	}
+	return names
+}
+
+// whether control flow ends at this instruction, as far as the
+// current basic block is concerned
+func endsBlock(i *Instruction) bool {
+	info := opCodeDataMap[i.OpCode]
+	switch info.opName {
+	case "jmp", "jsr", "rts", "rti", "brk":
+		return true
+	}
+	return info.addrMode == relativeAddr
+}
+
+func (g *ControlFlowGraph) addEdge(from *CfgBlock, to int, kind EdgeKind) {
+	edge := &CfgEdge{from.Start, to, kind}
+	g.Edges = append(g.Edges, edge)
+	from.Succs = append(from.Succs, edge)
+	toBlock, ok := g.blockAt[to]
+	if ok {
+		toBlock.Preds = append(toBlock.Preds, edge)
+	}
+}
+
+// BlockAt returns the basic block starting at addr, or nil.
+func (g *ControlFlowGraph) BlockAt(addr int) *CfgBlock {
+	return g.blockAt[addr]
+}
+
+// ControlFlowGraph splits the instructions of the program into basic
+// blocks and connects them. Subroutines start at each jsr destination
+// and at the interrupt vectors.
+func (p *Program) ControlFlowGraph() *ControlFlowGraph {
+	g := &ControlFlowGraph{
+		blockAt: make(map[int]*CfgBlock),
+	}
+	labelNames := p.labelNamesByAddr()
+
+	// find block leaders
+	leaders := make(map[int]bool)
+	for _, addr := range p.Labels {
+		leaders[addr] = true
+	}
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		i, ok := e.Value.(*Instruction)
+		if !ok || !endsBlock(i) {
+			continue
+		}
+		leaders[i.Offset+len(i.Payload)] = true
+		if opCodeDataMap[i.OpCode].addrMode == indirectAddr {
+			continue
+		}
+		target, ok := p.instructionTarget(i)
+		if ok {
+			leaders[target] = true
+		}
+	}
+
+	// group instructions into blocks
+	var block *CfgBlock
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		i, ok := e.Value.(*Instruction)
+		if !ok {
+			block = nil
+			continue
+		}
+		if block == nil || leaders[i.Offset] || block.End != i.Offset {
+			block = &CfgBlock{
+				Name:  labelNames[i.Offset],
+				Start: i.Offset,
+				End:   i.Offset,
+			}
+			g.Blocks = append(g.Blocks, block)
+			g.blockAt[block.Start] = block
+		}
+		block.Instructions = append(block.Instructions, i)
+		block.End += len(i.Payload)
+	}
+
+	// connect blocks
+	callSites := make(map[int][]int)
+	for _, block := range g.Blocks {
+		last := block.Instructions[len(block.Instructions)-1]
+		info := opCodeDataMap[last.OpCode]
+		target, targetOk := p.instructionTarget(last)
+		switch {
+		case info.opName == "jmp" && info.addrMode == indirectAddr:
+			g.addEdge(block, -1, DynamicEdge)
+		case info.opName == "jmp":
+			if targetOk {
+				g.addEdge(block, target, JumpEdge)
+			} else {
+				g.addEdge(block, -1, DynamicEdge)
+			}
+		case info.opName == "jsr":
+			if targetOk {
+				g.addEdge(block, target, CallEdge)
+				callSites[target] = append(callSites[target], block.End)
+			} else {
+				g.addEdge(block, -1, DynamicEdge)
+			}
+			g.addEdge(block, block.End, FallthroughEdge)
+		case info.opName == "rts" || info.opName == "rti":
+			// return edges are added once subroutines are known
+		case info.opName == "brk":
+			g.addEdge(block, -1, DynamicEdge)
+		case info.addrMode == relativeAddr:
+			if targetOk {
+				g.addEdge(block, target, BranchEdge)
+			}
+			g.addEdge(block, block.End, FallthroughEdge)
+		default:
+			if g.blockAt[block.End] != nil {
+				g.addEdge(block, block.End, FallthroughEdge)
+			}
+		}
+	}
+
+	// subroutines
+	entries := make(map[int]bool)
+	for target := range callSites {
+		entries[target] = true
+	}
+	for _, vector := range []int{0xfffa, 0xfffc, 0xfffe} {
+		addr, ok := p.vectorTarget(vector)
+		if ok {
+			entries[addr] = true
+		}
+	}
+	returnSites := make(map[*CfgBlock][]int)
+	for entry := range entries {
+		entryBlock := g.blockAt[entry]
+		if entryBlock == nil {
+			continue
+		}
+		name, ok := labelNames[entry]
+		if !ok {
+			name = fmt.Sprintf("$%04x", entry)
+		}
+		sub := &CfgSubroutine{
+			Name:  name,
+			Entry: entry,
+		}
+		g.Subroutines = append(g.Subroutines, sub)
+		seen := make(map[*CfgBlock]bool)
+		calls := make(map[int]bool)
+		work := list.New()
+		work.PushBack(entryBlock)
+		seen[entryBlock] = true
+		for work.Len() > 0 {
+			b := work.Remove(work.Front()).(*CfgBlock)
+			sub.Blocks = append(sub.Blocks, b.Start)
+			last := b.Instructions[len(b.Instructions)-1]
+			if opCodeDataMap[last.OpCode].opName == "rts" {
+				returnSites[b] = append(returnSites[b], callSites[entry]...)
+			}
+			for _, edge := range b.Succs {
+				if edge.Kind == CallEdge {
+					calls[edge.To] = true
+					continue
+				}
+				next := g.blockAt[edge.To]
+				if next == nil || seen[next] {
+					continue
+				}
+				seen[next] = true
+				work.PushBack(next)
+			}
+		}
+		sort.Ints(sub.Blocks)
+		for addr := range calls {
+			sub.Calls = append(sub.Calls, addr)
+		}
+		sort.Ints(sub.Calls)
+	}
+	sort.Sort(cfgSubroutinesByEntry(g.Subroutines))
+
+	// returns go back to every call site of the subroutines which
+	// contain the rts
+	for _, block := range g.Blocks {
+		last := block.Instructions[len(block.Instructions)-1]
+		opName := opCodeDataMap[last.OpCode].opName
+		if opName != "rts" && opName != "rti" {
+			continue
+		}
+		sites := returnSites[block]
+		sort.Ints(sites)
+		added := make(map[int]bool)
+		for _, site := range sites {
+			if added[site] {
+				continue
+			}
+			added[site] = true
+			g.addEdge(block, site, ReturnEdge)
+		}
+		if len(added) == 0 {
+			g.addEdge(block, -1, ReturnEdge)
+		}
+	}
+	return g
+}
+
+type cfgSubroutinesByEntry []*CfgSubroutine
+
+func (s cfgSubroutinesByEntry) Len() int           { return len(s) }
+func (s cfgSubroutinesByEntry) Less(i, j int) bool { return s[i].Entry < s[j].Entry }
+func (s cfgSubroutinesByEntry) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func dotBlockId(addr int) string {
+	if addr < 0 {
+		return "dynamic"
+	}
+	return fmt.Sprintf("b%04x", addr)
+}
+
+func dotEscape(s string) string {
+	return strings.Replace(strings.Replace(s, "\\", "\\\\", -1), "\"", "\\\"", -1)
+}
+
+var dotEdgeStyles = []string{
+	"",
+	" [color=\"darkgreen\"]",
+	" [color=\"blue\"]",
+	" [style=\"dashed\"]",
+	" [style=\"dotted\"]",
+	" [color=\"red\"]",
+}
+
+// WriteDot writes the graph in Graphviz format.
+func (g *ControlFlowGraph) WriteDot(writer io.Writer) error {
+	w := bufio.NewWriter(writer)
+	w.WriteString("digraph cfg {\n")
+	w.WriteString("    node [shape=box fontname=\"monospace\"];\n")
+	hasDynamic := false
+	external := make(map[int]bool)
+	for _, block := range g.Blocks {
+		label := fmt.Sprintf("$%04x", block.Start)
+		if len(block.Name) > 0 {
+			label = fmt.Sprintf("%s ($%04x)", block.Name, block.Start)
+		}
+		label += "\\l"
+		for _, i := range block.Instructions {
+			label += "    " + dotEscape(i.Render()) + "\\l"
+		}
+		fmt.Fprintf(w, "    %s [label=\"%s\"];\n", dotBlockId(block.Start), label)
+	}
+	for _, edge := range g.Edges {
+		if edge.To >= 0 && g.blockAt[edge.To] == nil && !external[edge.To] {
+			// destination outside of the program's code
+			external[edge.To] = true
+			fmt.Fprintf(w, "    %s [label=\"$%04x\" style=\"dashed\"];\n", dotBlockId(edge.To), edge.To)
+		}
+		if edge.To < 0 {
+			hasDynamic = true
+		}
+		fmt.Fprintf(w, "    %s -> %s%s;\n", dotBlockId(edge.From), dotBlockId(edge.To), dotEdgeStyles[edge.Kind])
+	}
+	if hasDynamic {
+		w.WriteString("    dynamic [label=\"?\" shape=\"circle\"];\n")
+	}
+	w.WriteString("}\n")
+	return w.Flush()
+}
+
+type jsonCfgBlock struct {
+	*CfgBlock
+	Instructions []string `json:"instructions"`
+}
+
+type jsonCfg struct {
+	Blocks      []jsonCfgBlock   `json:"blocks"`
+	Edges       []*CfgEdge       `json:"edges"`
+	Subroutines []*CfgSubroutine `json:"subroutines"`
+}
+
+// WriteJson writes the graph as a JSON object with the keys "blocks",
+// "edges" and "subroutines".
+func (g *ControlFlowGraph) WriteJson(writer io.Writer) error {
+	out := jsonCfg{
+		Blocks:      make([]jsonCfgBlock, len(g.Blocks)),
+		Edges:       g.Edges,
+		Subroutines: g.Subroutines,
+	}
+	for n, block := range g.Blocks {
+		out.Blocks[n].CfgBlock = block
+		for _, i := range block.Instructions {
+			out.Blocks[n].Instructions = append(out.Blocks[n].Instructions, i.Render())
+		}
+	}
+	buf, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(buf)
+	return err
+}
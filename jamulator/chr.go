@@ -0,0 +1,169 @@
+package jamulator
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	chrTileSize = 16
+	// a pattern table of 256 tiles, drawn as 16x16 tiles
+	chrPageSize  = 0x1000
+	chrPageTiles = 16
+)
+
+// DefaultChrPalette shows the four colors of a tile as shades of gray,
+// darkest first.
+var DefaultChrPalette = color.Palette{
+	color.RGBA{0x00, 0x00, 0x00, 0xff},
+	color.RGBA{0x55, 0x55, 0x55, 0xff},
+	color.RGBA{0xaa, 0xaa, 0xaa, 0xff},
+	color.RGBA{0xff, 0xff, 0xff, 0xff},
+}
+
+// ParseChrPalette reads four colors written as hex RGB and separated by
+// commas, such as "000000,555555,aaaaaa,ffffff".
+func ParseChrPalette(s string) (color.Palette, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, errors.New(fmt.Sprintf("CHR palette needs 4 colors, got %d", len(parts)))
+	}
+	palette := make(color.Palette, 4)
+	for n, part := range parts {
+		part = strings.TrimPrefix(strings.TrimSpace(part), "#")
+		rgb, err := strconv.ParseUint(part, 16, 32)
+		if err != nil || len(part) != 6 {
+			return nil, errors.New(fmt.Sprintf("invalid color: %s", part))
+		}
+		palette[n] = color.RGBA{byte(rgb >> 16), byte(rgb >> 8), byte(rgb), 0xff}
+	}
+	return palette, nil
+}
+
+func chrPaletteString(palette color.Palette) string {
+	parts := make([]string, len(palette))
+	for n, c := range palette {
+		r, g, b, _ := c.RGBA()
+		parts[n] = fmt.Sprintf("%02x%02x%02x", r>>8, g>>8, b>>8)
+	}
+	return strings.Join(parts, ",")
+}
+
+// ChrToImage draws a bank of CHR ROM as a sheet of tiles, with each 4KB
+// pattern table as 16x16 tiles side by side. Pixels are indexes into
+// palette, which is usually DefaultChrPalette.
+func ChrToImage(bank []byte, palette color.Palette) *image.Paletted {
+	pages := (len(bank) + chrPageSize - 1) / chrPageSize
+	img := image.NewPaletted(image.Rect(0, 0, pages*chrPageTiles*8, chrPageTiles*8), palette)
+	for tile := 0; tile*chrTileSize < len(bank); tile++ {
+		page := tile / (chrPageTiles * chrPageTiles)
+		n := tile % (chrPageTiles * chrPageTiles)
+		left := page*chrPageTiles*8 + n%chrPageTiles*8
+		top := n / chrPageTiles * 8
+		data := bank[tile*chrTileSize:]
+		for y := 0; y < 8 && y+8 < len(data); y++ {
+			// the low bits of a row are in the first 8 bytes and the
+			// high bits in the next 8
+			lo := data[y]
+			hi := data[y+8]
+			for x := 0; x < 8; x++ {
+				shift := uint(7 - x)
+				index := (lo>>shift)&1 | ((hi>>shift)&1)<<1
+				img.SetColorIndex(left+x, top+y, index)
+			}
+		}
+	}
+	return img
+}
+
+// ImageToChr encodes a sheet of tiles laid out like ChrToImage draws them
+// back into CHR ROM. Paletted images use their color indexes; other
+// images must only use the colors in palette.
+func ImageToChr(img image.Image, palette color.Palette) ([]byte, error) {
+	bounds := img.Bounds()
+	if bounds.Dx()%(chrPageTiles*8) != 0 || bounds.Dy() != chrPageTiles*8 {
+		return nil, errors.New(fmt.Sprintf("CHR image should be %d pixels high and a multiple of %d wide; instead it is %dx%d",
+			chrPageTiles*8, chrPageTiles*8, bounds.Dx(), bounds.Dy()))
+	}
+	colorIndex := func(x, y int) (byte, error) {
+		if p, ok := img.(*image.Paletted); ok {
+			index := p.ColorIndexAt(x, y)
+			if index > 3 {
+				return 0, errors.New(fmt.Sprintf("pixel %d,%d uses color index %d; CHR only has 4 colors", x, y, index))
+			}
+			return index, nil
+		}
+		c := img.At(x, y)
+		r, g, b, a := c.RGBA()
+		for n, pc := range palette {
+			pr, pg, pb, pa := pc.RGBA()
+			if r == pr && g == pg && b == pb && a == pa {
+				return byte(n), nil
+			}
+		}
+		return 0, errors.New(fmt.Sprintf("pixel %d,%d has color %02x%02x%02x which is not in the CHR palette %s",
+			x, y, r>>8, g>>8, b>>8, chrPaletteString(palette)))
+	}
+	pages := bounds.Dx() / (chrPageTiles * 8)
+	bank := make([]byte, pages*chrPageSize)
+	for tile := 0; tile*chrTileSize < len(bank); tile++ {
+		page := tile / (chrPageTiles * chrPageTiles)
+		n := tile % (chrPageTiles * chrPageTiles)
+		left := bounds.Min.X + page*chrPageTiles*8 + n%chrPageTiles*8
+		top := bounds.Min.Y + n/chrPageTiles*8
+		data := bank[tile*chrTileSize:]
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				index, err := colorIndex(left+x, top+y)
+				if err != nil {
+					return nil, err
+				}
+				shift := uint(7 - x)
+				data[y] |= (index & 1) << shift
+				data[y+8] |= (index >> 1) << shift
+			}
+		}
+	}
+	return bank, nil
+}
+
+// SaveChrPng writes a bank of CHR ROM to filename as an indexed PNG.
+func SaveChrPng(filename string, bank []byte, palette color.Palette) error {
+	fd, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(fd, ChrToImage(bank, palette))
+	err2 := fd.Close()
+	if err != nil {
+		return err
+	}
+	return err2
+}
+
+// LoadChrPng reads a bank of CHR ROM from a PNG made by SaveChrPng.
+func LoadChrPng(filename string, palette color.Palette) ([]byte, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	img, err := png.Decode(fd)
+	err2 := fd.Close()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", filename, err.Error()))
+	}
+	if err2 != nil {
+		return nil, err2
+	}
+	bank, err := ImageToChr(img, palette)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", filename, err.Error()))
+	}
+	return bank, nil
+}
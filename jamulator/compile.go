@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/axw/gollvm/llvm"
 	"os"
+	"sort"
 )
 
 type Compilation struct {
@@ -23,13 +24,31 @@ type Compilation struct {
 	rA              llvm.Value // accumulator
 	rSP             llvm.Value // stack pointer
 	rPC             llvm.Value // program counter
-	rSNeg           llvm.Value // whether the last arithmetic result is negative
-	rSOver          llvm.Value // whether the last arithmetic result overflowed
 	rSBrk           llvm.Value // break
 	rSDec           llvm.Value // decimal
 	rSInt           llvm.Value // irq interrupt disable
-	rSZero          llvm.Value // whether the last arithmetic result is zero
-	rSCarry         llvm.Value // carry
+	// what the N, Z, C and V flags are worked out from. see flags.go.
+	rNZ    llvm.Value
+	rCarry llvm.Value
+	rOver  llvm.Value
+	// the N, Z, C and V flags, when EagerFlagsFlag is set
+	rSNeg   llvm.Value // whether the last arithmetic result is negative
+	rSOver  llvm.Value // whether the last arithmetic result overflowed
+	rSZero  llvm.Value // whether the last arithmetic result is zero
+	rSCarry llvm.Value // carry
+	// the globals that back the registers above, by name
+	registerGlobals map[string]llvm.Value
+	// with BatchCyclesFlag, the most cycles there can be in cycleCount
+	// at this point in the code
+	pendingCycles int
+
+	// the function being compiled into
+	currentFn *codeFunction
+	main      *codeFunction
+	// subroutines compiled as functions, by entry address, and the
+	// function which each label in them is compiled into
+	subroutines    map[int]*codeFunction
+	labelFunctions map[string]*codeFunction
 
 	// controllers. see http://wiki.nesdev.com/w/index.php/Standard_controller
 	btnReportIndex  llvm.Value // index of the button to report next
@@ -47,6 +66,8 @@ type Compilation struct {
 
 	currentBlock *llvm.BasicBlock
 	currentInstr *Instruction
+	// known values of the index registers, by instruction address
+	indexValues map[int]indexValues
 	// label names to look for
 	nmiLabelName   string
 	resetLabelName string
@@ -105,10 +126,19 @@ type Compilation struct {
 type CompileFlags int
 
 const (
+	// the same as OptLevel 0
 	DisableOptFlag CompileFlags = 1 << iota
 	DumpModuleFlag
 	DumpModulePreFlag
 	IncludeDebugFlag
+	// compute every flag as soon as it is set, instead of lazily
+	EagerFlagsFlag
+	// report cycles to rom_cycle once per basic block instead of after
+	// every instruction. see flushCycles.
+	BatchCyclesFlag
+	// print the registers after every instruction, and every write to
+	// memory, for CompareTraces. see ParseTrace.
+	TraceFlag
 )
 
 const (
@@ -127,6 +157,10 @@ func (c *Compilation) visitForControlFlow() {
 			panic(fmt.Sprintf("unrecognized node: %T", e.Value))
 		case *OrgPseudoOp:
 			// do nothing
+		case *CommentStatement:
+			// do nothing
+		case *AssignStatement:
+			// do nothing
 		case *LabelStatement:
 			currentLabel = t.LabelName
 			currentExpecting = cfExpectNone
@@ -162,6 +196,7 @@ func (c *Compilation) visitForBasicBlocks() {
 
 func (c *Compilation) visitForCompile() {
 	c.currentBlock = nil
+	c.useFunction(c.main)
 	for e := c.program.List.Front(); e != nil; e = e.Next() {
 		switch t := e.Value.(type) {
 		default: panic("unrecognized node")
@@ -174,30 +209,17 @@ func (c *Compilation) visitForCompile() {
 			if c.currentBlock != nil {
 				// we expected an instruction but we got data.
 				// interpreter to the rescue!
+				c.flushCycles()
 				c.builder.CreateBr(c.interpretBlock)
 				c.currentBlock = nil
 			}
 		case *OrgPseudoOp:
+		case *CommentStatement:
+		case *AssignStatement:
 		}
 	}
 }
 
-func (c *Compilation) testAndSetZero(v int) {
-	if v == 0 {
-		c.setZero()
-		return
-	}
-	c.clearZero()
-}
-
-func (c *Compilation) setZero() {
-	c.builder.CreateStore(llvm.ConstInt(llvm.Int1Type(), 1, false), c.rSZero)
-}
-
-func (c *Compilation) clearZero() {
-	c.builder.CreateStore(llvm.ConstInt(llvm.Int1Type(), 0, false), c.rSZero)
-}
-
 func (c *Compilation) setDec() {
 	c.builder.CreateStore(llvm.ConstInt(llvm.Int1Type(), 1, false), c.rSDec)
 }
@@ -215,31 +237,15 @@ func (c *Compilation) clearInt() {
 }
 
 func (c *Compilation) setCarry() {
-	c.builder.CreateStore(llvm.ConstInt(llvm.Int1Type(), 1, false), c.rSCarry)
+	c.setCarryBit(llvm.ConstInt(llvm.Int1Type(), 1, false))
 }
 
 func (c *Compilation) clearCarry() {
-	c.builder.CreateStore(llvm.ConstInt(llvm.Int1Type(), 0, false), c.rSCarry)
+	c.setCarryBit(llvm.ConstInt(llvm.Int1Type(), 0, false))
 }
 
 func (c *Compilation) clearOverflow() {
-	c.builder.CreateStore(llvm.ConstInt(llvm.Int1Type(), 0, false), c.rSOver)
-}
-
-func (c *Compilation) testAndSetNeg(v int) {
-	if v&0x80 == 0x80 {
-		c.setNeg()
-		return
-	}
-	c.clearNeg()
-}
-
-func (c *Compilation) setNeg() {
-	c.builder.CreateStore(llvm.ConstInt(llvm.Int1Type(), 1, false), c.rSNeg)
-}
-
-func (c *Compilation) clearNeg() {
-	c.builder.CreateStore(llvm.ConstInt(llvm.Int1Type(), 0, false), c.rSNeg)
+	c.setOverflowBit(llvm.ConstInt(llvm.Int1Type(), 0, false))
 }
 
 func (c *Compilation) dynTestAndSetNeg(v llvm.Value) {
@@ -295,16 +301,14 @@ func (c *Compilation) dynTestAndSetCarrySubtraction3(a llvm.Value, v llvm.Value,
 
 func (c *Compilation) performLdy(v llvm.Value) {
 	c.builder.CreateStore(v, c.rY)
-	c.dynTestAndSetZero(v)
-	c.dynTestAndSetNeg(v)
+	c.setNZ(v)
 }
 
 func (c *Compilation) performLsr(v llvm.Value) llvm.Value {
 	c1 := llvm.ConstInt(llvm.Int8Type(), 1, false)
 	newValue := c.builder.CreateLShr(v, c1, "")
-	c.dynTestAndSetZero(newValue)
-	c.dynTestAndSetNeg(newValue)
-	c.dynTestAndSetCarryLShr(v)
+	c.setNZ(newValue)
+	c.setCarryLShr(v)
 	return newValue
 }
 
@@ -312,84 +316,72 @@ func (c *Compilation) performOra(v llvm.Value) {
 	a := c.builder.CreateLoad(c.rA, "")
 	newA := c.builder.CreateOr(a, v, "")
 	c.builder.CreateStore(newA, c.rA)
-	c.dynTestAndSetZero(newA)
-	c.dynTestAndSetNeg(newA)
+	c.setNZ(newA)
 }
 
 func (c *Compilation) performLda(v llvm.Value) {
 	c.builder.CreateStore(v, c.rA)
-	c.dynTestAndSetZero(v)
-	c.dynTestAndSetNeg(v)
+	c.setNZ(v)
 }
 
 func (c *Compilation) performLdx(v llvm.Value) {
 	c.builder.CreateStore(v, c.rX)
-	c.dynTestAndSetZero(v)
-	c.dynTestAndSetNeg(v)
+	c.setNZ(v)
 }
 
 func (c *Compilation) performCmp(lval llvm.Value, rval llvm.Value) {
 	diff := c.builder.CreateSub(lval, rval, "")
-	c.dynTestAndSetZero(diff)
-	c.dynTestAndSetNeg(diff)
-	c.dynTestAndSetCarrySubtraction(lval, rval)
+	c.setNZ(diff)
+	c.setCarryCompare(lval, rval)
 }
 
 func (c *Compilation) performRor(val llvm.Value) llvm.Value {
 	c1 := llvm.ConstInt(llvm.Int8Type(), 1, false)
 	c7 := llvm.ConstInt(llvm.Int8Type(), 7, false)
 	shifted := c.builder.CreateLShr(val, c1, "")
-	carryBit := c.builder.CreateLoad(c.rSCarry, "")
-	carry := c.builder.CreateZExt(carryBit, llvm.Int8Type(), "")
+	carry := c.builder.CreateZExt(c.getCarry(), llvm.Int8Type(), "")
 	carryShifted := c.builder.CreateShl(carry, c7, "")
 	newValue := c.builder.CreateOr(shifted, carryShifted, "")
-	c.dynTestAndSetZero(newValue)
-	c.dynTestAndSetNeg(newValue)
-	c.dynTestAndSetCarryLShr(val)
+	c.setNZ(newValue)
+	c.setCarryLShr(val)
 	return newValue
 }
 
 func (c *Compilation) performRol(val llvm.Value) llvm.Value {
 	c1 := llvm.ConstInt(val.Type(), 1, false)
 	shifted := c.builder.CreateShl(val, c1, "")
-	carryBit := c.builder.CreateLoad(c.rSCarry, "")
-	carry := c.builder.CreateZExt(carryBit, val.Type(), "")
+	carry := c.builder.CreateZExt(c.getCarry(), val.Type(), "")
 	newValue := c.builder.CreateOr(shifted, carry, "")
 
-	c.dynTestAndSetZero(newValue)
-	c.dynTestAndSetNeg(newValue)
-	c.dynTestAndSetCarryShl(val)
+	c.setNZ(newValue)
+	c.setCarryShl(val)
 	return newValue
 }
 
 func (c *Compilation) performAsl(val llvm.Value) llvm.Value {
 	c1 := llvm.ConstInt(llvm.Int8Type(), 1, false)
 	newValue := c.builder.CreateShl(val, c1, "")
-	c.dynTestAndSetZero(newValue)
-	c.dynTestAndSetNeg(newValue)
-	c.dynTestAndSetCarryShl(val)
+	c.setNZ(newValue)
+	c.setCarryShl(val)
 	return newValue
 }
 
 func (c *Compilation) performAdc(val llvm.Value) {
 	a := c.builder.CreateLoad(c.rA, "")
 	aPlusV := c.builder.CreateAdd(a, val, "")
-	carryBit := c.builder.CreateLoad(c.rSCarry, "")
-	carry := c.builder.CreateZExt(carryBit, llvm.Int8Type(), "")
+	carry := c.builder.CreateZExt(c.getCarry(), llvm.Int8Type(), "")
 	newA := c.builder.CreateAdd(aPlusV, carry, "")
 	c.builder.CreateStore(newA, c.rA)
-	c.dynTestAndSetNeg(newA)
-	c.dynTestAndSetZero(newA)
-	c.dynTestAndSetOverflowAddition(a, val, newA)
-	c.dynTestAndSetCarryAddition(a, val, carry)
+	c.setNZ(newA)
+	c.setOverflowAddition(a, val, newA)
+	c.setCarryAddition(a, val, carry)
 }
 
 func (c *Compilation) performSbc(val llvm.Value) {
 	a := c.builder.CreateLoad(c.rA, "")
 	// subtract val
 	newA := c.builder.CreateSub(a, val, "")
-	carryBit := c.builder.CreateLoad(c.rSCarry, "")
-	carry := c.builder.CreateZExt(carryBit, llvm.Int8Type(), "")
+	carry := c.builder.CreateZExt(c.getCarry(), llvm.Int8Type(), "")
 	c1 := llvm.ConstInt(newA.Type(), 1, false)
 	// add the carry
 	newA = c.builder.CreateAdd(newA, carry, "")
@@ -401,10 +393,9 @@ func (c *Compilation) performSbc(val llvm.Value) {
 	})
 
 	c.builder.CreateStore(newA, c.rA)
-	c.dynTestAndSetNeg(newA)
-	c.dynTestAndSetZero(newA)
-	c.dynTestAndSetOverflowSubtraction(a, val, carry)
-	c.dynTestAndSetCarrySubtraction3(a, val, carry)
+	c.setNZ(newA)
+	c.setOverflowSubtraction(a, val, carry, newA)
+	c.setCarrySubtraction(a, val, carry)
 }
 
 func (c *Compilation) performBit(val llvm.Value) {
@@ -415,303 +406,256 @@ func (c *Compilation) performBit(val llvm.Value) {
 
 	anded := c.builder.CreateAnd(val, a, "")
 	isZero := c.builder.CreateICmp(llvm.IntEQ, anded, c0, "")
-	c.builder.CreateStore(isZero, c.rSZero)
 
 	maskedX80 := c.builder.CreateAnd(val, x80, "")
 	isNeg := c.builder.CreateICmp(llvm.IntNE, maskedX80, c0, "")
-	c.builder.CreateStore(isNeg, c.rSNeg)
+	c.setNegZero(isNeg, isZero)
 
 	maskedX40 := c.builder.CreateAnd(val, x40, "")
 	isOver := c.builder.CreateICmp(llvm.IntNE, maskedX40, c0, "")
-	c.builder.CreateStore(isOver, c.rSOver)
+	c.setOverflowBit(isOver)
 }
 
 func (c *Compilation) performAnd(v llvm.Value) {
 	a := c.builder.CreateLoad(c.rA, "")
 	newA := c.builder.CreateAnd(a, v, "")
 	c.builder.CreateStore(newA, c.rA)
-	c.dynTestAndSetZero(newA)
-	c.dynTestAndSetNeg(newA)
+	c.setNZ(newA)
 }
 
 func (c *Compilation) performEor(v llvm.Value) {
 	a := c.builder.CreateLoad(c.rA, "")
 	newA := c.builder.CreateXor(a, v, "")
 	c.builder.CreateStore(newA, c.rA)
-	c.dynTestAndSetZero(newA)
-	c.dynTestAndSetNeg(newA)
-}
+	c.setNZ(newA)
+}
+
+// a range of the address space which dynLoad and dynStore treat alike
+type memRegion struct {
+	start int
+	end   int
+	// generates the access for an address known to be in the region.
+	// returns the byte loaded, or nothing for a store.
+	access func(addr llvm.Value) llvm.Value
+}
+
+// the registers which can be read and written, by their address
+var (
+	ppuReadRegs  = []int{2, 4, 7}
+	ppuWriteRegs = []int{0, 1, 3, 4, 5, 6, 7}
+	ioReadRegs   = []int{0x4015, 0x4016, 0x4017}
+	ioWriteRegs  = []int{
+		0x4000, 0x4001, 0x4002, 0x4003, 0x4004, 0x4005, 0x4006, 0x4007,
+		0x4008, 0x400a, 0x400b, 0x400c, 0x400e, 0x400f, 0x4010, 0x4011,
+		0x4012, 0x4013, 0x4014, 0x4015, 0x4016, 0x4017,
+	}
+)
 
-func (c *Compilation) dynStore(addr llvm.Value, minAddr int, maxAddr int, val llvm.Value) {
-	c.debugPrintf("store $%02x in $%04x\n", []llvm.Value{val, addr})
-	if maxAddr < 0x800 {
-		// wram. we don't even have to mask it
-		indexes := []llvm.Value{
-			llvm.ConstInt(llvm.Int16Type(), 0, false),
-			addr,
+// generates code for an access to addr, which is somewhere from minAddr to
+// maxAddr. only the regions which that range overlaps are checked for at
+// runtime, and when there is only one, it is accessed without any checks.
+func (c *Compilation) dynAccess(addr llvm.Value, minAddr int, maxAddr int, regions []memRegion, load bool) llvm.Value {
+	possible := make([]memRegion, 0, len(regions))
+	covered := 0
+	for _, r := range regions {
+		if r.start <= maxAddr && minAddr <= r.end {
+			possible = append(possible, r)
+			covered += minInt(r.end, maxAddr) - maxInt(r.start, minAddr) + 1
 		}
-		ptr := c.builder.CreateGEP(c.wram, indexes, "")
-		c.builder.CreateStore(val, ptr)
-		return
+	}
+	// whether some address in the range is not in any region
+	gaps := covered < maxAddr-minAddr+1
+	if len(possible) == 1 && !gaps {
+		return possible[0].access(addr)
 	}
 
-	if minAddr != 0 || maxAddr != 0xffff {
-		c.Warnings = append(c.Warnings, fmt.Sprintf("TODO: dynStore is unoptimized for min $%04x max $%04x", minAddr, maxAddr))
+	doneBlock := c.createBlock("AccessDone")
+	values := make([]llvm.Value, 0, len(possible))
+	blocks := make([]llvm.BasicBlock, 0, len(possible))
+	finish := func(v llvm.Value) {
+		if load {
+			values = append(values, v)
+			blocks = append(blocks, c.builder.GetInsertBlock())
+		}
+		c.builder.CreateBr(doneBlock)
+	}
+	badAddr := func() {
+		if load {
+			c.createPanic("invalid load address: $%04x\n", []llvm.Value{addr})
+		} else {
+			c.createPanic("invalid store address: $%04x\n", []llvm.Value{addr})
+		}
+	}
+	if len(possible) == 0 {
+		badAddr()
+	}
+	for n, r := range possible {
+		if r.start > minAddr && (n == 0 || possible[n-1].end+1 < r.start) {
+			// the address could be in the gap before this region
+			start := llvm.ConstInt(llvm.Int16Type(), uint64(r.start), false)
+			inGap := c.builder.CreateICmp(llvm.IntULT, addr, start, "")
+			notInGapBlock := c.createIf(inGap)
+			badAddr()
+			c.selectBlock(notInGapBlock)
+		}
+		if n == len(possible)-1 && r.end >= maxAddr {
+			finish(r.access(addr))
+			break
+		}
+		end := llvm.ConstInt(llvm.Int16Type(), uint64(r.end), false)
+		inRegion := c.builder.CreateICmp(llvm.IntULE, addr, end, "")
+		notInRegionBlock := c.createIf(inRegion)
+		finish(r.access(addr))
+		c.selectBlock(notInRegionBlock)
+		if n == len(possible)-1 {
+			badAddr()
+		}
 	}
 
+	c.selectBlock(doneBlock)
+	if !load {
+		return llvm.Value{}
+	}
+	if len(values) == 0 {
+		return llvm.ConstNull(llvm.Int8Type())
+	}
+	phi := c.builder.CreatePHI(llvm.Int8Type(), "")
+	phi.AddIncoming(values, blocks)
+	return phi
+}
+
+// generates a switch over the registers which key can select, out of
+// those that are mapped from minKey to maxKey. keys which are not in regs
+// panic.
+func (c *Compilation) dynRegisterAccess(key llvm.Value, minKey int, maxKey int, regs []int, addr llvm.Value, load bool, access func(int) llvm.Value) llvm.Value {
+	cases := make([]int, 0, len(regs))
+	for _, reg := range regs {
+		if minKey <= reg && reg <= maxKey {
+			cases = append(cases, reg)
+		}
+	}
+	if len(cases) == 1 && minKey == maxKey {
+		return access(cases[0])
+	}
+	doneBlock := c.createBlock("RegisterDone")
+	badBlock := c.createBlock("BadRegister")
+	sw := c.builder.CreateSwitch(key, badBlock, len(cases))
+	c.selectBlock(badBlock)
+	if load {
+		c.createPanic("invalid load address: $%04x\n", []llvm.Value{addr})
+	} else {
+		c.createPanic("invalid store address: $%04x\n", []llvm.Value{addr})
+	}
+	values := make([]llvm.Value, 0, len(cases))
+	blocks := make([]llvm.BasicBlock, 0, len(cases))
+	for _, reg := range cases {
+		block := c.createBlock(fmt.Sprintf("reg_%04x", reg))
+		sw.AddCase(llvm.ConstInt(key.Type(), uint64(reg), false), block)
+		c.selectBlock(block)
+		v := access(reg)
+		if load {
+			values = append(values, v)
+			blocks = append(blocks, c.builder.GetInsertBlock())
+		}
+		c.builder.CreateBr(doneBlock)
+	}
+	c.selectBlock(doneBlock)
+	if !load || len(values) == 0 {
+		return llvm.ConstNull(llvm.Int8Type())
+	}
+	phi := c.builder.CreatePHI(llvm.Int8Type(), "")
+	phi.AddIncoming(values, blocks)
+	return phi
+}
+
+// the range of PPU register numbers, which are mirrored every 8 bytes,
+// that addresses from minAddr to maxAddr can select
+func ppuRegisterRange(minAddr, maxAddr int) (int, int) {
+	minAddr = maxInt(minAddr, 0x2000)
+	maxAddr = minInt(maxAddr, 0x3fff)
+	if maxAddr-minAddr >= 7 || minAddr&7 > maxAddr&7 {
+		return 0, 7
+	}
+	return minAddr & 7, maxAddr & 7
+}
 
-	// runtime memory check
-	storeDoneBlock := c.createBlock("StoreDone")
-	x2000 := llvm.ConstInt(llvm.Int16Type(), 0x2000, false)
-	inWRam := c.builder.CreateICmp(llvm.IntULT, addr, x2000, "")
-	notInWRamBlock := c.createIf(inWRam)
-	// this generated code runs if the write is happening in the WRAM range
-	maskedAddr := c.builder.CreateAnd(addr, llvm.ConstInt(llvm.Int16Type(), 0x800-1, false), "")
+// points to the byte at addr in WRAM. addresses which can be past $0800
+// are masked because WRAM is mirrored.
+func (c *Compilation) dynWramPtr(addr llvm.Value, maxAddr int) llvm.Value {
+	if maxAddr >= 0x800 {
+		addr = c.builder.CreateAnd(addr, llvm.ConstInt(llvm.Int16Type(), 0x800-1, false), "")
+	}
 	indexes := []llvm.Value{
 		llvm.ConstInt(llvm.Int16Type(), 0, false),
-		maskedAddr,
-	}
-	ptr := c.builder.CreateGEP(c.wram, indexes, "")
-	c.builder.CreateStore(val, ptr)
-	c.builder.CreateBr(storeDoneBlock)
-	// this generated code runs if the write is > WRAM range
-	c.selectBlock(notInWRamBlock)
-	x4000 := llvm.ConstInt(llvm.Int16Type(), 0x4000, false)
-	inPpuRam := c.builder.CreateICmp(llvm.IntULT, addr, x4000, "")
-	notInPpuRamBlock := c.createIf(inPpuRam)
-	// this generated code runs if the write is in the PPU RAM range
-	maskedAddr = c.builder.CreateAnd(addr, llvm.ConstInt(llvm.Int16Type(), 0x8-1, false), "")
-	badPpuAddrBlock := c.createBlock("BadPPUAddr")
-	sw := c.builder.CreateSwitch(maskedAddr, badPpuAddrBlock, 7)
-	// this generated code runs if the write is in a bad PPU RAM addr
-	c.selectBlock(badPpuAddrBlock)
-	c.createPanic("invalid store address: $%04x\n", []llvm.Value{addr})
-
-	ppuCtrlBlock := c.createBlock("ppuctrl")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0, false), ppuCtrlBlock)
-	c.selectBlock(ppuCtrlBlock)
-	c.debugPrint("ppu_write_control\n")
-	c.builder.CreateCall(c.ppuCtrlFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	ppuMaskBlock := c.createBlock("ppumask")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 1, false), ppuMaskBlock)
-	c.selectBlock(ppuMaskBlock)
-	c.debugPrint("ppu_write_mask\n")
-	c.builder.CreateCall(c.ppuMaskFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	oamAddrBlock := c.createBlock("oamaddr")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 3, false), oamAddrBlock)
-	c.selectBlock(oamAddrBlock)
-	c.debugPrint("ppu_write_oamaddr\n")
-	c.builder.CreateCall(c.oamAddrFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	oamDataBlock := c.createBlock("oamdata")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 4, false), oamDataBlock)
-	c.selectBlock(oamDataBlock)
-	c.debugPrint("ppu_write_oamdata\n")
-	c.builder.CreateCall(c.setOamDataFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	ppuScrollBlock := c.createBlock("ppuscroll")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 5, false), ppuScrollBlock)
-	c.selectBlock(ppuScrollBlock)
-	c.debugPrint("ppu_write_scroll\n")
-	c.builder.CreateCall(c.setPpuScrollFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	ppuAddrBlock := c.createBlock("ppuaddr")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 6, false), ppuAddrBlock)
-	c.selectBlock(ppuAddrBlock)
-	c.debugPrint("ppu_write_address\n")
-	c.builder.CreateCall(c.ppuAddrFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	ppuDataBlock := c.createBlock("ppudata")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 7, false), ppuDataBlock)
-	c.selectBlock(ppuDataBlock)
-	c.debugPrint("ppu_write_data\n")
-	c.builder.CreateCall(c.setPpuDataFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	// this generated code runs if the write is >= 0x4000
-	c.selectBlock(notInPpuRamBlock)
-	x4017 := llvm.ConstInt(llvm.Int16Type(), 0x4017, false)
-	inApuRam := c.builder.CreateICmp(llvm.IntULE, addr, x4017, "")
-	notInApuRamBlock := c.createIf(inApuRam)
-	// if the write is in the APU RAM range
-	badApuRamBlock := c.createBlock("BadAPUAddr")
-	sw = c.builder.CreateSwitch(addr, badApuRamBlock, 22)
-	c.selectBlock(badApuRamBlock)
-	c.createPanic("invalid store address: $%04x\n", []llvm.Value{addr})
-
-	apuSqr1CtrlBlock := c.createBlock("rom_apu_write_square1control")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x4000, false), apuSqr1CtrlBlock)
-	c.selectBlock(apuSqr1CtrlBlock)
-	c.debugPrint("rom_apu_write_square1control\n")
-	c.builder.CreateCall(c.apuWriteSquare1CtrlFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	apuSqr1SweepsBlock := c.createBlock("rom_apu_write_square1sweeps")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x4001, false), apuSqr1SweepsBlock)
-	c.selectBlock(apuSqr1SweepsBlock)
-	c.debugPrint("rom_apu_write_square1sweeps\n")
-	c.builder.CreateCall(c.apuWriteSquare1SweepsFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	apuSqr1LowBlock := c.createBlock("rom_apu_write_square1low")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x4002, false), apuSqr1LowBlock)
-	c.selectBlock(apuSqr1LowBlock)
-	c.debugPrint("rom_apu_write_square1low\n")
-	c.builder.CreateCall(c.apuWriteSquare1LowFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	apuSqr1HighBlock := c.createBlock("rom_apu_write_square1high")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x4003, false), apuSqr1HighBlock)
-	c.selectBlock(apuSqr1HighBlock)
-	c.debugPrint("rom_apu_write_square1high\n")
-	c.builder.CreateCall(c.apuWriteSquare1HighFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	apuSqr2CtrlBlock := c.createBlock("rom_apu_write_square2control")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x4004, false), apuSqr2CtrlBlock)
-	c.selectBlock(apuSqr2CtrlBlock)
-	c.debugPrint("rom_apu_write_square2control\n")
-	c.builder.CreateCall(c.apuWriteSquare2CtrlFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	apuSqr2SweepsBlock := c.createBlock("rom_apu_write_square2sweeps")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x4005, false), apuSqr2SweepsBlock)
-	c.selectBlock(apuSqr2SweepsBlock)
-	c.debugPrint("rom_apu_write_square2sweeps\n")
-	c.builder.CreateCall(c.apuWriteSquare2SweepsFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	apuSqr2LowBlock := c.createBlock("rom_apu_write_square2low")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x4006, false), apuSqr2LowBlock)
-	c.selectBlock(apuSqr2LowBlock)
-	c.debugPrint("rom_apu_write_square2low\n")
-	c.builder.CreateCall(c.apuWriteSquare2LowFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	apuSqr2HighBlock := c.createBlock("rom_apu_write_square2high")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x4007, false), apuSqr2HighBlock)
-	c.selectBlock(apuSqr2HighBlock)
-	c.debugPrint("rom_apu_write_square2high\n")
-	c.builder.CreateCall(c.apuWriteSquare2HighFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	apuTriCtrlBlock := c.createBlock("rom_apu_write_trianglecontrol")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x4008, false), apuTriCtrlBlock)
-	c.selectBlock(apuTriCtrlBlock)
-	c.debugPrint("rom_apu_write_trianglecontrol\n")
-	c.builder.CreateCall(c.apuWriteTriangleCtrlFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	apuTriLowBlock := c.createBlock("rom_apu_write_trianglelow")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x400a, false), apuTriLowBlock)
-	c.selectBlock(apuTriLowBlock)
-	c.debugPrint("rom_apu_write_trianglelow\n")
-	c.builder.CreateCall(c.apuWriteTriangleLowFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	apuTriHighBlock := c.createBlock("rom_apu_write_trianglehigh")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x400b, false), apuTriHighBlock)
-	c.selectBlock(apuTriHighBlock)
-	c.debugPrint("rom_apu_write_trianglehigh\n")
-	c.builder.CreateCall(c.apuWriteTriangleHighFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	apuNoiseBaseBlock := c.createBlock("rom_apu_write_noisebase")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x400c, false), apuNoiseBaseBlock)
-	c.selectBlock(apuNoiseBaseBlock)
-	c.debugPrint("rom_apu_write_noisebase\n")
-	c.builder.CreateCall(c.apuWriteNoiseBaseFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	apuNoisePeriodBlock := c.createBlock("rom_apu_write_noiseperiod")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x400e, false), apuNoisePeriodBlock)
-	c.selectBlock(apuNoisePeriodBlock)
-	c.debugPrint("rom_apu_write_noiseperiod\n")
-	c.builder.CreateCall(c.apuWriteNoisePeriodFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	apuNoiseLengthBlock := c.createBlock("rom_apu_write_noiselength")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x400f, false), apuNoiseLengthBlock)
-	c.selectBlock(apuNoiseLengthBlock)
-	c.debugPrint("rom_apu_write_noiselength\n")
-	c.builder.CreateCall(c.apuWriteNoiseLengthFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	apuDmcFlagsBlock := c.createBlock("rom_apu_write_dmcflags")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x4010, false), apuDmcFlagsBlock)
-	c.selectBlock(apuDmcFlagsBlock)
-	c.debugPrint("rom_apu_write_dmcflags\n")
-	c.builder.CreateCall(c.apuWriteDmcFlagsFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	apuDmcDirectLoadBlock := c.createBlock("rom_apu_write_dmcdirectload")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x4011, false), apuDmcDirectLoadBlock)
-	c.selectBlock(apuDmcDirectLoadBlock)
-	c.debugPrint("rom_apu_write_dmcdirectload\n")
-	c.builder.CreateCall(c.apuWriteDmcDirectLoadFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	apuDmcSampleAddrBlock := c.createBlock("rom_apu_write_dmcsampleaddress")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x4012, false), apuDmcSampleAddrBlock)
-	c.selectBlock(apuDmcSampleAddrBlock)
-	c.debugPrint("rom_apu_write_dmcsampleaddress\n")
-	c.builder.CreateCall(c.apuWriteDmcSampleAddressFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	apuDmcSampleLenBlock := c.createBlock("rom_apu_write_dmcsamplelength")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x4013, false), apuDmcSampleLenBlock)
-	c.selectBlock(apuDmcSampleLenBlock)
-	c.debugPrint("rom_apu_write_dmcsamplelength\n")
-	c.builder.CreateCall(c.apuWriteDmcSampleLengthFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	ppuDmaBlock := c.createBlock("rom_ppu_write_dma")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x4014, false), ppuDmaBlock)
-	c.selectBlock(ppuDmaBlock)
-	c.debugPrint("ppu_write_oamdata\n")
-	c.builder.CreateCall(c.setOamDataFn, []llvm.Value{val}, "")
-	c.debugPrint("rom_ppu_write_dma\n")
-	c.builder.CreateCall(c.ppuWriteDma, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	apuCtrlFlags1Block := c.createBlock("rom_apu_write_controlflags1")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x4015, false), apuCtrlFlags1Block)
-	c.selectBlock(apuCtrlFlags1Block)
-	c.debugPrint("rom_apu_write_controlflags1\n")
-	c.builder.CreateCall(c.apuWriteCtrlFlags1Fn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	padWriteBlock := c.createBlock("padWrite")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x4016, false), padWriteBlock)
-	c.selectBlock(padWriteBlock)
-	c.debugPrintf("pad_write $%02x\n", []llvm.Value{val})
-	c.builder.CreateCall(c.padWriteFn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	apuCtrlFlags2Block := c.createBlock("rom_apu_write_controlflags2")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x4017, false), apuCtrlFlags2Block)
-	c.selectBlock(apuCtrlFlags2Block)
-	c.debugPrint("rom_apu_write_controlflags2\n")
-	c.builder.CreateCall(c.apuWriteCtrlFlags2Fn, []llvm.Value{val}, "")
-	c.builder.CreateBr(storeDoneBlock)
-
-	// if not in any known writable range
-	c.selectBlock(notInApuRamBlock)
-	c.createPanic("invalid store address: $%04x\n", []llvm.Value{addr})
-
-	// done. X_X
-	c.selectBlock(storeDoneBlock)
+		addr,
+	}
+	return c.builder.CreateGEP(c.wram, indexes, "")
+}
+
+// an indexed address range which goes past $ffff wraps around to zero
+// page, so it could be anywhere
+func wrapAddrRange(minAddr int, maxAddr int) (int, int) {
+	if minAddr < 0 || maxAddr > 0xffff {
+		return 0, 0xffff
+	}
+	return minAddr, maxAddr
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (c *Compilation) dynStore(addr llvm.Value, minAddr int, maxAddr int, val llvm.Value) {
+	minAddr, maxAddr = wrapAddrRange(minAddr, maxAddr)
+	c.flushCyclesForAccess(minAddr, maxAddr)
+	c.debugPrintf("store $%02x in $%04x\n", []llvm.Value{val, addr})
+	regions := []memRegion{
+		{0x0000, 0x1fff, func(addr llvm.Value) llvm.Value {
+			c.traceWrite(addr, val)
+			c.builder.CreateStore(val, c.dynWramPtr(addr, maxAddr))
+			return llvm.Value{}
+		}},
+		{0x2000, 0x3fff, func(addr llvm.Value) llvm.Value {
+			minReg, maxReg := ppuRegisterRange(minAddr, maxAddr)
+			maskedAddr := c.builder.CreateAnd(addr, llvm.ConstInt(llvm.Int16Type(), 0x8-1, false), "")
+			c.traceWrite(addr, val)
+			c.dynRegisterAccess(maskedAddr, minReg, maxReg, ppuWriteRegs, addr, false, func(reg int) llvm.Value {
+				c.storeUntraced(0x2000+reg, val)
+				return llvm.Value{}
+			})
+			return llvm.Value{}
+		}},
+		{0x4000, 0x4017, func(addr llvm.Value) llvm.Value {
+			c.dynRegisterAccess(addr, maxInt(minAddr, 0x4000), minInt(maxAddr, 0x4017), ioWriteRegs, addr, false, func(reg int) llvm.Value {
+				c.store(reg, val)
+				return llvm.Value{}
+			})
+			return llvm.Value{}
+		}},
+	}
+	c.dynAccess(addr, minAddr, maxAddr, regions, false)
 }
 
 func (c *Compilation) store(addr int, i8 llvm.Value) {
+	c.flushCyclesForAccess(addr, addr)
+	c.traceWrite(llvm.ConstInt(llvm.Int16Type(), uint64(addr), false), i8)
+	c.storeUntraced(addr, i8)
+}
+
+// store without tracing it, for dynStore, which traces the address before
+// it is masked down to a PPU register
+func (c *Compilation) storeUntraced(addr int, i8 llvm.Value) {
+	c.flushCyclesForAccess(addr, addr)
 	c.debugPrintf("store $%02x in $%04x\n", []llvm.Value{i8, llvm.ConstInt(llvm.Int16Type(), uint64(addr), false)})
 
 	// homebrew ABI
@@ -835,146 +779,42 @@ func (c *Compilation) store(addr int, i8 llvm.Value) {
 
 }
 
+// returns the byte at addr, with runtime checks for only the regions
+// between minAddr and maxAddr
 func (c *Compilation) dynLoad(addr llvm.Value, minAddr int, maxAddr int) llvm.Value {
-	// returns the byte at addr, with runtime checks for the range between minAddr and maxAddr
-	// currently only can do WRAM stuff
-	if maxAddr < 0x0800 {
-		// no runtime checks needed.
-		indexes := []llvm.Value{
-			llvm.ConstInt(llvm.Int16Type(), 0, false),
-			addr,
-		}
-		ptr := c.builder.CreateGEP(c.wram, indexes, "")
-		v := c.builder.CreateLoad(ptr, "")
-		return v
-	}
-	if maxAddr < 0x2000 {
-		// address masking needed, but it's definitely in WRAM
-		maskedAddr := c.builder.CreateAnd(addr, llvm.ConstInt(llvm.Int16Type(), 0x800-1, false), "")
-		indexes := []llvm.Value{
-			llvm.ConstInt(llvm.Int16Type(), 0, false),
-			maskedAddr,
-		}
-		ptr := c.builder.CreateGEP(c.wram, indexes, "")
-		return c.builder.CreateLoad(ptr, "")
-	}
-	x8000 := llvm.ConstInt(addr.Type(), 0x8000, false)
-	if minAddr >= 0x8000 && maxAddr <= 0xffff {
-		// PRG ROM load
-		offsetAddr := c.builder.CreateSub(addr, x8000, "")
-		indexes := []llvm.Value{
-			llvm.ConstInt(llvm.Int16Type(), 0, false),
-			offsetAddr,
-		}
-		ptr := c.builder.CreateGEP(c.prgRom, indexes, "")
-		return c.builder.CreateLoad(ptr, "")
-	}
-	if minAddr != 0 || maxAddr != 0xffff {
-		c.Warnings = append(c.Warnings, fmt.Sprintf("TODO: dynLoad is unoptimized for min $%04x max $%04x", minAddr, maxAddr))
+	minAddr, maxAddr = wrapAddrRange(minAddr, maxAddr)
+	c.flushCyclesForAccess(minAddr, maxAddr)
+	regions := []memRegion{
+		{0x0000, 0x1fff, func(addr llvm.Value) llvm.Value {
+			return c.builder.CreateLoad(c.dynWramPtr(addr, maxAddr), "")
+		}},
+		{0x2000, 0x3fff, func(addr llvm.Value) llvm.Value {
+			minReg, maxReg := ppuRegisterRange(minAddr, maxAddr)
+			maskedAddr := c.builder.CreateAnd(addr, llvm.ConstInt(llvm.Int16Type(), 0x8-1, false), "")
+			return c.dynRegisterAccess(maskedAddr, minReg, maxReg, ppuReadRegs, addr, true, func(reg int) llvm.Value {
+				return c.load(0x2000 + reg)
+			})
+		}},
+		{0x4000, 0x4017, func(addr llvm.Value) llvm.Value {
+			return c.dynRegisterAccess(addr, maxInt(minAddr, 0x4000), minInt(maxAddr, 0x4017), ioReadRegs, addr, true, func(reg int) llvm.Value {
+				return c.load(reg)
+			})
+		}},
+		{0x8000, 0xffff, func(addr llvm.Value) llvm.Value {
+			x8000 := llvm.ConstInt(llvm.Int16Type(), 0x8000, false)
+			return c.builder.CreateLoad(c.prgRomPtr(c.builder.CreateSub(addr, x8000, "")), "")
+		}},
 	}
-	result := c.builder.CreateAlloca(llvm.Int8Type(), "load_result")
-	loadDoneBlock := c.createBlock("LoadDone")
-	x2000 := llvm.ConstInt(llvm.Int16Type(), 0x2000, false)
-	inWRam := c.builder.CreateICmp(llvm.IntULT, addr, x2000, "")
-	notInWRamBlock := c.createIf(inWRam)
-	// this generated code runs if the write is happening in the WRAM range
-	maskedAddr := c.builder.CreateAnd(addr, llvm.ConstInt(llvm.Int16Type(), 0x800-1, false), "")
-	indexes := []llvm.Value{
-		llvm.ConstInt(llvm.Int16Type(), 0, false),
-		maskedAddr,
-	}
-	ptr := c.builder.CreateGEP(c.wram, indexes, "")
-	v := c.builder.CreateLoad(ptr, "")
-	c.builder.CreateStore(v, result)
-	c.builder.CreateBr(loadDoneBlock)
-	// this generated code runs if the write is > WRAM range
-	c.selectBlock(notInWRamBlock)
-	x4000 := llvm.ConstInt(llvm.Int16Type(), 0x4000, false)
-	inPpuRam := c.builder.CreateICmp(llvm.IntULT, addr, x4000, "")
-	notInPpuRamBlock := c.createIf(inPpuRam)
-	// this generated code runs if the write is in the PPU RAM range
-	maskedAddr = c.builder.CreateAnd(addr, llvm.ConstInt(llvm.Int16Type(), 0x8-1, false), "")
-	badPpuAddrBlock := c.createBlock("BadPPUAddr")
-	sw := c.builder.CreateSwitch(maskedAddr, badPpuAddrBlock, 3)
-	// this generated code runs if the write is in a bad PPU RAM addr
-	c.selectBlock(badPpuAddrBlock)
-	c.createPanic("invalid load address: $%04x\n", []llvm.Value{addr})
-
-	ppuReadStatusBlock := c.createBlock("ppu_read_status")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 2, false), ppuReadStatusBlock)
-	c.selectBlock(ppuReadStatusBlock)
-	c.debugPrint("ppu_read_status\n")
-	v = c.builder.CreateCall(c.ppuReadStatusFn, []llvm.Value{}, "")
-	c.builder.CreateStore(v, result)
-	c.builder.CreateBr(loadDoneBlock)
-
-	ppuReadOamDataBlock := c.createBlock("ppu_read_oamdata")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 4, false), ppuReadOamDataBlock)
-	c.selectBlock(ppuReadOamDataBlock)
-	c.debugPrint("ppu_read_oamdata\n")
-	v = c.builder.CreateCall(c.ppuReadOamDataFn, []llvm.Value{}, "")
-	c.builder.CreateStore(v, result)
-	c.builder.CreateBr(loadDoneBlock)
-
-	ppuReadDataBlock := c.createBlock("ppu_read_data")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 7, false), ppuReadDataBlock)
-	c.selectBlock(ppuReadDataBlock)
-	c.debugPrint("ppu_read_data\n")
-	v = c.builder.CreateCall(c.ppuReadDataFn, []llvm.Value{}, "")
-	c.builder.CreateStore(v, result)
-	c.builder.CreateBr(loadDoneBlock)
+	return c.dynAccess(addr, minAddr, maxAddr, regions, true)
+}
 
-	// this generated code runs if the write is > PPU RAM range
-	c.selectBlock(notInPpuRamBlock)
-	inPrgRom := c.builder.CreateICmp(llvm.IntUGE, addr, x8000, "")
-	notInPrgRomBlock := c.createIf(inPrgRom)
-	// this generated code runs if the write is in the PRG ROM range
-	offsetAddr := c.builder.CreateSub(addr, x8000, "")
-	indexes = []llvm.Value{
+// points to the byte at offset into PRG ROM, which starts at $8000
+func (c *Compilation) prgRomPtr(offset llvm.Value) llvm.Value {
+	indexes := []llvm.Value{
 		llvm.ConstInt(llvm.Int16Type(), 0, false),
-		offsetAddr,
+		offset,
 	}
-	ptr = c.builder.CreateGEP(c.prgRom, indexes, "")
-	v = c.builder.CreateLoad(ptr, "")
-	c.builder.CreateStore(v, result)
-	c.builder.CreateBr(loadDoneBlock)
-	// this generated code runs if the write is not in the PRG ROM range
-	c.selectBlock(notInPrgRomBlock)
-	badAddrBlock := c.createBlock("BadAddr")
-	sw = c.builder.CreateSwitch(addr, badAddrBlock, 3)
-	// if bad load address
-	c.selectBlock(badAddrBlock)
-	c.createPanic("invalid load address: $%04x\n", []llvm.Value{addr})
-
-	apuReadStatusBlock := c.createBlock("rom_apu_read_status")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x4015, false), apuReadStatusBlock)
-	c.selectBlock(apuReadStatusBlock)
-	c.debugPrint("rom_apu_read_status\n")
-	v = c.builder.CreateCall(c.apuReadStatusFn, []llvm.Value{}, "")
-	c.builder.CreateStore(v, result)
-	c.builder.CreateBr(loadDoneBlock)
-
-	padRead1Block := c.createBlock("pad_read1")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x4016, false), padRead1Block)
-	c.selectBlock(padRead1Block)
-	c0 := llvm.ConstInt(llvm.Int8Type(), 0, false)
-	v = c.builder.CreateCall(c.padReadFn, []llvm.Value{c0}, "")
-	c.debugPrintf("pad_read1 $%02x\n", []llvm.Value{v})
-	c.builder.CreateStore(v, result)
-	c.builder.CreateBr(loadDoneBlock)
-
-	padRead2Block := c.createBlock("pad_read2")
-	sw.AddCase(llvm.ConstInt(llvm.Int16Type(), 0x4017, false), padRead2Block)
-	c.selectBlock(padRead2Block)
-	c1 := llvm.ConstInt(llvm.Int8Type(), 1, false)
-	c.debugPrint("pad_read2\n")
-	v = c.builder.CreateCall(c.padReadFn, []llvm.Value{c1}, "")
-	c.builder.CreateStore(v, result)
-	c.builder.CreateBr(loadDoneBlock)
-
-	// done. X_X
-	c.selectBlock(loadDoneBlock)
-	return c.builder.CreateLoad(result, "")
+	return c.builder.CreateGEP(c.prgRom, indexes, "")
 }
 
 func (c *Compilation) wramPtr(addr int) llvm.Value {
@@ -991,6 +831,7 @@ func (c *Compilation) wramPtr(addr int) llvm.Value {
 }
 
 func (c *Compilation) load(addr int) llvm.Value {
+	c.flushCyclesForAccess(addr, addr)
 	switch {
 	default:
 		c.Errors = append(c.Errors, fmt.Sprintf("reading from $%04x not implemented", addr))
@@ -1028,13 +869,8 @@ func (c *Compilation) load(addr int) llvm.Value {
 		c.debugPrint("pad_read2\n")
 		return c.builder.CreateCall(c.padReadFn, []llvm.Value{c1}, "")
 	case 0x8000 <= addr && addr <= 0xffff:
-		offsetAddr := addr - 0x8000
-		indexes := []llvm.Value{
-			llvm.ConstInt(llvm.Int16Type(), 0, false),
-			llvm.ConstInt(llvm.Int16Type(), uint64(offsetAddr), false),
-		}
-		ptr := c.builder.CreateGEP(c.prgRom, indexes, "")
-		return c.builder.CreateLoad(ptr, "")
+		offsetAddr := llvm.ConstInt(llvm.Int16Type(), uint64(addr-0x8000), false)
+		return c.builder.CreateLoad(c.prgRomPtr(offsetAddr), "")
 	}
 	panic("unreachable")
 }
@@ -1074,23 +910,20 @@ func (c *Compilation) incrementMem(addr int, delta int) {
 	oldValue := c.load(addr)
 	newValue := c.incrementVal(oldValue, delta)
 	c.store(addr, newValue)
-	c.dynTestAndSetZero(newValue)
-	c.dynTestAndSetNeg(newValue)
+	c.setNZ(newValue)
 }
 
 func (c *Compilation) increment(ptr llvm.Value, delta int) {
 	oldValue := c.builder.CreateLoad(ptr, "")
 	newValue := c.incrementVal(oldValue, delta)
 	c.builder.CreateStore(newValue, ptr)
-	c.dynTestAndSetNeg(newValue)
-	c.dynTestAndSetZero(newValue)
+	c.setNZ(newValue)
 }
 
 func (c *Compilation) transfer(source llvm.Value, dest llvm.Value) {
 	v := c.builder.CreateLoad(source, "")
 	c.builder.CreateStore(v, dest)
-	c.dynTestAndSetNeg(v)
-	c.dynTestAndSetZero(v)
+	c.setNZ(v)
 }
 
 func (c *Compilation) createBlock(name string) llvm.BasicBlock {
@@ -1105,25 +938,38 @@ func (c *Compilation) selectBlock(bb llvm.BasicBlock) {
 }
 
 func (c *Compilation) createPanic(msg string, args []llvm.Value) {
+	// the registers are printed from their globals, which works in
+	// any function. in compiled 6502 code, spill them first.
+	if c.currentFn != nil && c.builder.GetInsertBlock().Parent() == c.currentFn.fn {
+		c.syncRegistersOut()
+	}
+	global := func(local llvm.Value) llvm.Value {
+		for _, r := range c.currentFn.registers {
+			if r.local == local {
+				return c.builder.CreateLoad(r.global, "")
+			}
+		}
+		panic("not a register")
+	}
 	c.printf(msg, args)
 	if c.currentInstr != nil {
 		c.printf(fmt.Sprintf("current instruction: %s\n", c.currentInstr.Render()), []llvm.Value{})
 	}
 	c.printf("A: $%02x  X: $%02x  Y: $%02x  SP: $%02x  PC: $%04x\n", []llvm.Value{
-		c.builder.CreateLoad(c.rA, ""),
-		c.builder.CreateLoad(c.rX, ""),
-		c.builder.CreateLoad(c.rY, ""),
-		c.builder.CreateLoad(c.rSP, ""),
-		c.builder.CreateLoad(c.rPC, ""),
+		global(c.rA),
+		global(c.rX),
+		global(c.rY),
+		global(c.rSP),
+		global(c.rPC),
 	})
 	c.printf("N: %d  V: %d  -  B: %d  D: %d  I: %d  Z: %d  C: %d\n", []llvm.Value{
-		c.builder.CreateZExt(c.builder.CreateLoad(c.rSNeg, ""), llvm.Int8Type(), ""),
-		c.builder.CreateZExt(c.builder.CreateLoad(c.rSOver, ""), llvm.Int8Type(), ""),
-		c.builder.CreateZExt(c.builder.CreateLoad(c.rSBrk, ""), llvm.Int8Type(), ""),
-		c.builder.CreateZExt(c.builder.CreateLoad(c.rSDec, ""), llvm.Int8Type(), ""),
-		c.builder.CreateZExt(c.builder.CreateLoad(c.rSInt, ""), llvm.Int8Type(), ""),
-		c.builder.CreateZExt(c.builder.CreateLoad(c.rSZero, ""), llvm.Int8Type(), ""),
-		c.builder.CreateZExt(c.builder.CreateLoad(c.rSCarry, ""), llvm.Int8Type(), ""),
+		c.builder.CreateZExt(c.negFlag(global), llvm.Int8Type(), ""),
+		c.builder.CreateZExt(c.overflowFlag(global), llvm.Int8Type(), ""),
+		c.builder.CreateZExt(global(c.rSBrk), llvm.Int8Type(), ""),
+		c.builder.CreateZExt(global(c.rSDec), llvm.Int8Type(), ""),
+		c.builder.CreateZExt(global(c.rSInt), llvm.Int8Type(), ""),
+		c.builder.CreateZExt(c.zeroFlag(global), llvm.Int8Type(), ""),
+		c.builder.CreateZExt(c.carryFlag(global), llvm.Int8Type(), ""),
 	})
 	exitCode := llvm.ConstInt(llvm.Int32Type(), 1, false)
 	c.builder.CreateCall(c.exitFn, []llvm.Value{exitCode}, "")
@@ -1199,24 +1045,23 @@ func (c *Compilation) pullStatusReg() {
 	s1 = c.builder.CreateICmp(llvm.IntNE, s1, zero, "")
 	s0 = c.builder.CreateICmp(llvm.IntNE, s0, zero, "")
 	// store
-	c.builder.CreateStore(s7, c.rSNeg)
-	c.builder.CreateStore(s6, c.rSOver)
+	c.setNegZero(s7, s1)
+	c.setOverflowBit(s6)
 	c.builder.CreateStore(s4, c.rSBrk)
 	c.builder.CreateStore(s3, c.rSDec)
 	c.builder.CreateStore(s2, c.rSInt)
-	c.builder.CreateStore(s1, c.rSZero)
-	c.builder.CreateStore(s0, c.rSCarry)
+	c.setCarryBit(s0)
 }
 
 func (c *Compilation) getStatusByte() llvm.Value {
 	// zextend
-	s7z := c.builder.CreateZExt(c.builder.CreateLoad(c.rSNeg, ""), llvm.Int8Type(), "")
-	s6z := c.builder.CreateZExt(c.builder.CreateLoad(c.rSOver, ""), llvm.Int8Type(), "")
+	s7z := c.builder.CreateZExt(c.getNeg(), llvm.Int8Type(), "")
+	s6z := c.builder.CreateZExt(c.getOverflow(), llvm.Int8Type(), "")
 	s4z := c.builder.CreateZExt(c.builder.CreateLoad(c.rSBrk, ""), llvm.Int8Type(), "")
 	s3z := c.builder.CreateZExt(c.builder.CreateLoad(c.rSDec, ""), llvm.Int8Type(), "")
 	s2z := c.builder.CreateZExt(c.builder.CreateLoad(c.rSInt, ""), llvm.Int8Type(), "")
-	s1z := c.builder.CreateZExt(c.builder.CreateLoad(c.rSZero, ""), llvm.Int8Type(), "")
-	s0z := c.builder.CreateZExt(c.builder.CreateLoad(c.rSCarry, ""), llvm.Int8Type(), "")
+	s1z := c.builder.CreateZExt(c.getZero(), llvm.Int8Type(), "")
+	s0z := c.builder.CreateZExt(c.getCarry(), llvm.Int8Type(), "")
 	// shift
 	s7z = c.builder.CreateShl(s7z, llvm.ConstInt(llvm.Int8Type(), 7, false), "")
 	s6z = c.builder.CreateShl(s6z, llvm.ConstInt(llvm.Int8Type(), 6, false), "")
@@ -1241,9 +1086,61 @@ func (c *Compilation) cycle(count int, pc int) {
 	}
 	c.debugPrint(fmt.Sprintf("cycles %d\n", count))
 	c.debugPrintStatus()
+	c.tracePrintStatus()
 
 	v := llvm.ConstInt(llvm.Int8Type(), uint64(count), false)
-	c.builder.CreateCall(c.cycleFn, []llvm.Value{v}, "")
+	if c.Flags&BatchCyclesFlag != 0 {
+		// rom_cycle takes at most 255 cycles at a time
+		if c.pendingCycles+count > 0xff {
+			c.flushCycles()
+		}
+		cycleCount := c.currentFn.cycleCount
+		pending := c.builder.CreateLoad(cycleCount, "")
+		c.builder.CreateStore(c.builder.CreateAdd(pending, v, ""), cycleCount)
+		c.pendingCycles += count
+		return
+	}
+	c.callCycleFn(v)
+}
+
+func (c *Compilation) callCycleFn(count llvm.Value) {
+	// rom_cycle is where the runtime services interrupts, by calling
+	// rom_start again
+	c.syncRegistersOut()
+	c.builder.CreateCall(c.cycleFn, []llvm.Value{count}, "")
+	c.syncRegistersIn()
+}
+
+// with BatchCyclesFlag, cycle adds up cycles in the cycleCount of the
+// current function, and they are reported to rom_cycle here instead.
+// this happens at the end of every basic block which jumps somewhere, so
+// that a block starts with nothing pending, and before anything which
+// reads or writes the PPU, APU or controllers, so that they see the same
+// timing as they would otherwise.
+// cycles which come from instructions on both sides of an if count
+// towards pendingCycles twice, so it is only ever more than the real
+// count.
+func (c *Compilation) flushCycles() {
+	if c.Flags&BatchCyclesFlag == 0 || c.pendingCycles == 0 {
+		return
+	}
+	cycleCount := c.currentFn.cycleCount
+	c.callCycleFn(c.builder.CreateLoad(cycleCount, ""))
+	c.builder.CreateStore(llvm.ConstInt(llvm.Int8Type(), 0, false), cycleCount)
+	c.pendingCycles = 0
+}
+
+// flushes cycles before an access to an address from minAddr to maxAddr,
+// if it can be an I/O register
+func (c *Compilation) flushCyclesForAccess(minAddr int, maxAddr int) {
+	if minAddr <= 0x4017 && maxAddr >= 0x2000 {
+		c.flushCycles()
+	}
+}
+
+// cycle with the base cycle count of opCode, as found in the op code table
+func (c *Compilation) cycleOp(opCode byte, pc int) {
+	c.cycle(opCodeDataMap[opCode].cycles, pc)
 }
 
 func (c *Compilation) debugPrint(str string) {
@@ -1294,38 +1191,103 @@ func (c *Compilation) debugPrintStatus() {
 	}
 
 }
-func (c *Compilation) createBranch(cond llvm.Value, labelName string, instrAddr int) {
+
+func (c *Compilation) tracePrintStatus() {
+	if c.Flags&TraceFlag == 0 {
+		return
+	}
+	c.printf("trace %04x %02x %02x %02x %02x %02x\n", c.traceArgs(
+		c.builder.CreateLoad(c.rPC, ""),
+		c.builder.CreateLoad(c.rA, ""),
+		c.builder.CreateLoad(c.rX, ""),
+		c.builder.CreateLoad(c.rY, ""),
+		c.getStatusByte(),
+		c.builder.CreateLoad(c.rSP, ""),
+	))
+}
+
+func (c *Compilation) traceWrite(addr llvm.Value, val llvm.Value) {
+	if c.Flags&TraceFlag == 0 {
+		return
+	}
+	c.printf("write %04x %02x\n", c.traceArgs(addr, val))
+}
+
+// printf reads its arguments as ints, so bytes and words are zero
+// extended. otherwise whatever is in the rest of the register is printed.
+func (c *Compilation) traceArgs(values ...llvm.Value) []llvm.Value {
+	args := make([]llvm.Value, len(values))
+	for n, v := range values {
+		args[n] = c.builder.CreateZExt(v, llvm.Int32Type(), "")
+	}
+	return args
+}
+
+func (c *Compilation) createBranch(opCode byte, cond llvm.Value, labelName string, instrAddr int) {
+	info := opCodeDataMap[opCode]
 	branchBlock := c.labeledBlocks[labelName]
 	thenBlock := c.createBlock("then")
 	elseBlock := c.createBlock("else")
+	c.flushCycles()
 	c.builder.CreateCondBr(cond, thenBlock, elseBlock)
-	// if the condition is met, the cycle count is 3 or 4, depending
-	// on whether the page boundary is crossed.
+	// if the condition is met, the branch penalty is paid, plus another
+	// one if the page boundary is crossed.
 	c.selectBlock(thenBlock)
 	addr, ok := c.program.Labels[labelName]
 	if !ok {
 		panic(fmt.Sprintf("label %s not defined", labelName))
 	}
 	if instrAddr&0xff00 == addr&0xff00 {
-		c.cycle(3, addr)
+		c.cycle(info.cycles+info.branchTakenCycles, addr)
 	} else {
-		c.cycle(4, addr)
+		c.cycle(info.cycles+info.branchTakenCycles+info.pageCrossCycles, addr)
 	}
+	c.flushCycles()
 	c.builder.CreateBr(branchBlock)
 	// the else block is when the code does *not* branch.
-	// in this case, the cycle count is 2.
+	// in this case, only the base cycle count is paid.
 	c.selectBlock(elseBlock)
-	c.cycle(2, instrAddr+2) // branch instructions are 2 bytes
+	c.cycle(info.cycles, instrAddr+2) // branch instructions are 2 bytes
 }
 
-func (c *Compilation) absoluteIndexedStore(valPtr llvm.Value, baseAddr int, indexPtr llvm.Value, pc int) {
-	index := c.builder.CreateLoad(indexPtr, "")
-	index16 := c.builder.CreateZExt(index, llvm.Int16Type(), "")
-	base := llvm.ConstInt(llvm.Int16Type(), uint64(baseAddr), false)
-	addr := c.builder.CreateAdd(base, index16, "")
+func (c *Compilation) absoluteIndexedStore(opCode byte, valPtr llvm.Value, baseAddr int, indexPtr llvm.Value, pc int) {
 	val := c.builder.CreateLoad(valPtr, "")
-	c.dynStore(addr, baseAddr, baseAddr+0xff, val)
-	c.cycle(5, pc)
+	c.dynStoreIndexed(baseAddr, indexPtr, val)
+	c.cycleOp(opCode, pc)
+}
+
+// the lowest and highest address that baseAddr indexed by a register can
+// be, narrowed down by the values the register is known to have at the
+// current instruction
+func (c *Compilation) indexedRange(baseAddr int, indexPtr llvm.Value, zeroPage bool) (int, int) {
+	var values []int
+	if c.currentInstr != nil {
+		known := c.indexValues[c.currentInstr.Offset]
+		switch indexPtr {
+		case c.rX:
+			values = known.x
+		case c.rY:
+			values = known.y
+		}
+	}
+	if values == nil {
+		if zeroPage {
+			return 0, 0xff
+		}
+		return baseAddr, baseAddr + 0xff
+	}
+	// the address wraps around within zero page, or past $ffff
+	mask := 0xffff
+	if zeroPage {
+		mask = 0xff
+	}
+	minAddr, maxAddr := 0xffff, 0
+	for _, v := range values {
+		addr := (baseAddr + v) & mask
+		minAddr = minInt(minAddr, addr)
+		maxAddr = maxInt(maxAddr, addr)
+	}
+	return minAddr, maxAddr
 }
 
 func (c *Compilation) dynLoadZpgIndexed(baseAddr int, indexPtr llvm.Value) llvm.Value {
@@ -1333,15 +1295,23 @@ func (c *Compilation) dynLoadZpgIndexed(baseAddr int, indexPtr llvm.Value) llvm.
 	base := llvm.ConstInt(llvm.Int8Type(), uint64(baseAddr), false)
 	addr8 := c.builder.CreateAdd(base, index, "")
 	addr16 := c.builder.CreateZExt(addr8, llvm.Int16Type(), "")
-	return c.dynLoad(addr16, 0, 0xff)
+	minAddr, maxAddr := c.indexedRange(baseAddr, indexPtr, true)
+	return c.dynLoad(addr16, minAddr, maxAddr)
 }
 
 func (c *Compilation) dynLoadIndexed(baseAddr int, indexPtr llvm.Value) llvm.Value {
 	index := c.builder.CreateLoad(indexPtr, "")
 	index16 := c.builder.CreateZExt(index, llvm.Int16Type(), "")
+	minAddr, maxAddr := c.indexedRange(baseAddr, indexPtr, false)
+	if baseAddr >= 0x8000 && minAddr >= 0x8000 && maxAddr <= 0xffff {
+		// a table in PRG ROM. index it directly.
+		base := llvm.ConstInt(llvm.Int16Type(), uint64(baseAddr-0x8000), false)
+		offset := c.builder.CreateAdd(base, index16, "")
+		return c.builder.CreateLoad(c.prgRomPtr(offset), "")
+	}
 	base := llvm.ConstInt(llvm.Int16Type(), uint64(baseAddr), false)
 	addr := c.builder.CreateAdd(base, index16, "")
-	return c.dynLoad(addr, baseAddr, baseAddr+0xff)
+	return c.dynLoad(addr, minAddr, maxAddr)
 }
 
 func (c *Compilation) dynStoreZpgIndexed(baseAddr int, indexPtr llvm.Value, val llvm.Value) {
@@ -1349,7 +1319,8 @@ func (c *Compilation) dynStoreZpgIndexed(baseAddr int, indexPtr llvm.Value, val
 	base := llvm.ConstInt(llvm.Int8Type(), uint64(baseAddr), false)
 	addr8 := c.builder.CreateAdd(base, index, "")
 	addr16 := c.builder.CreateZExt(addr8, llvm.Int16Type(), "")
-	c.dynStore(addr16, 0, 0xff, val)
+	minAddr, maxAddr := c.indexedRange(baseAddr, indexPtr, true)
+	c.dynStore(addr16, minAddr, maxAddr, val)
 }
 
 func (c *Compilation) dynStoreIndexed(baseAddr int, indexPtr llvm.Value, val llvm.Value) {
@@ -1357,22 +1328,19 @@ func (c *Compilation) dynStoreIndexed(baseAddr int, indexPtr llvm.Value, val llv
 	index16 := c.builder.CreateZExt(index, llvm.Int16Type(), "")
 	base := llvm.ConstInt(llvm.Int16Type(), uint64(baseAddr), false)
 	addr := c.builder.CreateAdd(base, index16, "")
-	c.dynStore(addr, baseAddr, baseAddr+0xff, val)
+	minAddr, maxAddr := c.indexedRange(baseAddr, indexPtr, false)
+	c.dynStore(addr, minAddr, maxAddr, val)
 }
 
-func (c *Compilation) absoluteIndexedLoad(destPtr llvm.Value, baseAddr int, indexPtr llvm.Value, pc int) {
-	index := c.builder.CreateLoad(indexPtr, "")
-	index16 := c.builder.CreateZExt(index, llvm.Int16Type(), "")
-	base := llvm.ConstInt(llvm.Int16Type(), uint64(baseAddr), false)
-	addr := c.builder.CreateAdd(base, index16, "")
-	v := c.dynLoad(addr, baseAddr, baseAddr+0xff)
+func (c *Compilation) absoluteIndexedLoad(opCode byte, destPtr llvm.Value, baseAddr int, indexPtr llvm.Value, pc int) {
+	v := c.dynLoadIndexed(baseAddr, indexPtr)
 	c.builder.CreateStore(v, destPtr)
-	c.dynTestAndSetZero(v)
-	c.dynTestAndSetNeg(v)
-	c.cyclesForAbsoluteIndexed(baseAddr, index16, pc)
+	c.setNZ(v)
+	c.cyclesForAbsoluteIndexedPtr(opCode, baseAddr, indexPtr, pc)
 }
 
-func (c *Compilation) cyclesForIndirectY(baseAddr, addr llvm.Value, pc int) {
+func (c *Compilation) cyclesForIndirectY(opCode byte, baseAddr, addr llvm.Value, pc int) {
+	info := opCodeDataMap[opCode]
 	// if address & 0xff00 != (address + y) & 0xff00
 	xff00 := llvm.ConstInt(llvm.Int16Type(), uint64(0xff00), false)
 	baseAddrMasked := c.builder.CreateAnd(baseAddr, xff00, "")
@@ -1381,23 +1349,24 @@ func (c *Compilation) cyclesForIndirectY(baseAddr, addr llvm.Value, pc int) {
 	loadDoneBlock := c.createBlock("LoadDone")
 	pageBoundaryCrossedBlock := c.createIf(eq)
 	// executed if page boundary is not crossed
-	c.cycle(5, pc)
+	c.cycle(info.cycles, pc)
 	c.builder.CreateBr(loadDoneBlock)
 	// executed if page boundary crossed
 	c.selectBlock(pageBoundaryCrossedBlock)
-	c.cycle(6, pc)
+	c.cycle(info.cycles+info.pageCrossCycles, pc)
 	c.builder.CreateBr(loadDoneBlock)
 	// done
 	c.selectBlock(loadDoneBlock)
 }
 
-func (c *Compilation) cyclesForAbsoluteIndexedPtr(baseAddr int, indexPtr llvm.Value, pc int) {
+func (c *Compilation) cyclesForAbsoluteIndexedPtr(opCode byte, baseAddr int, indexPtr llvm.Value, pc int) {
 	index := c.builder.CreateLoad(indexPtr, "")
 	index16 := c.builder.CreateZExt(index, llvm.Int16Type(), "")
-	c.cyclesForAbsoluteIndexed(baseAddr, index16, pc)
+	c.cyclesForAbsoluteIndexed(opCode, baseAddr, index16, pc)
 }
 
-func (c *Compilation) cyclesForAbsoluteIndexed(baseAddr int, index16 llvm.Value, pc int) {
+func (c *Compilation) cyclesForAbsoluteIndexed(opCode byte, baseAddr int, index16 llvm.Value, pc int) {
+	info := opCodeDataMap[opCode]
 	// if address & 0xff00 != (address + x) & 0xff00
 	baseAddrMasked := baseAddr & 0xff00
 	baseAddrMaskedValue := llvm.ConstInt(llvm.Int16Type(), uint64(baseAddrMasked), false)
@@ -1411,11 +1380,11 @@ func (c *Compilation) cyclesForAbsoluteIndexed(baseAddr int, index16 llvm.Value,
 	loadDoneBlock := c.createBlock("LoadDone")
 	pageBoundaryCrossedBlock := c.createIf(eq)
 	// executed if page boundary is not crossed
-	c.cycle(4, pc)
+	c.cycle(info.cycles, pc)
 	c.builder.CreateBr(loadDoneBlock)
 	// executed if page boundary crossed
 	c.selectBlock(pageBoundaryCrossedBlock)
-	c.cycle(5, pc)
+	c.cycle(info.cycles+info.pageCrossCycles, pc)
 	c.builder.CreateBr(loadDoneBlock)
 	// done
 	c.selectBlock(loadDoneBlock)
@@ -1471,7 +1440,20 @@ func (s *LabelStatement) Compile(c *Compilation) {
 		// we're not doing codegen for this block. skip.
 		return
 	}
+	f := c.labelFunctions[s.LabelName]
+	if f == nil {
+		f = c.main
+	}
+	if f != c.currentFn {
+		if c.currentBlock != nil {
+			c.Errors = append(c.Errors, fmt.Sprintf("%s: code runs into another function", s.LabelName))
+			c.builder.CreateUnreachable()
+			c.currentBlock = nil
+		}
+		c.useFunction(f)
+	}
 	if c.currentBlock != nil {
+		c.flushCycles()
 		c.builder.CreateBr(bb)
 	}
 	c.currentBlock = &bb
@@ -1485,6 +1467,13 @@ func (c *Compilation) compileLabels(s *LabelStatement) {
 		return
 	}
 
+	f, ok := c.labelFunctions[s.LabelName]
+	if ok {
+		// the dynamic jump table is in rom_start, so it can only
+		// jump to the blocks of rom_start
+		c.labeledBlocks[s.LabelName] = llvm.AddBasicBlock(f.fn, s.LabelName)
+		return
+	}
 	bb := llvm.AddBasicBlock(c.mainFn, s.LabelName)
 	c.labeledBlocks[s.LabelName] = bb
 	c.dynJumpAddrs[c.program.Labels[s.LabelName]] = bb
@@ -1589,18 +1578,6 @@ func (c *Compilation) createNamedGlobal(intType llvm.Type, name string) llvm.Val
 	return glob
 }
 
-func (c *Compilation) createByteRegister(name string) llvm.Value {
-	return c.createNamedGlobal(llvm.Int8Type(), name)
-}
-
-func (c *Compilation) createWordRegister(name string) llvm.Value {
-	return c.createNamedGlobal(llvm.Int16Type(), name)
-}
-
-func (c *Compilation) createBitRegister(name string) llvm.Value {
-	return c.createNamedGlobal(llvm.Int1Type(), name)
-}
-
 func (c *Compilation) declareReadFn(name string) llvm.Value {
 	readByteType := llvm.FunctionType(llvm.Int8Type(), []llvm.Type{}, false)
 	fn := llvm.AddFunction(c.mod, name, readByteType)
@@ -1680,19 +1657,174 @@ func (c *Compilation) createFunctionDeclares() {
 	c.apuWriteCtrlFlags2Fn = c.declareWriteFn("rom_apu_write_controlflags2")
 }
 
-func (c *Compilation) createRegisters() {
-	c.rX = c.createByteRegister("X")
-	c.rY = c.createByteRegister("Y")
-	c.rA = c.createByteRegister("A")
-	c.rSP = c.createByteRegister("SP")
-	c.rPC = c.createWordRegister("PC")
-	c.rSNeg = c.createBitRegister("S_neg")
-	c.rSOver = c.createBitRegister("S_over")
-	c.rSBrk = c.createBitRegister("S_brk")
-	c.rSDec = c.createBitRegister("S_dec")
-	c.rSInt = c.createBitRegister("S_int")
-	c.rSZero = c.createBitRegister("S_zero")
-	c.rSCarry = c.createBitRegister("S_carry")
+// a 6502 register. compiled code works on local, an alloca which
+// mem2reg turns into SSA values, and global holds the register whenever
+// code outside of the current function can see it.
+//
+// the protocol is:
+//
+//	a function loads every global into its local on entry
+//	before calling rom_cycle, every local is stored to its global,
+//	and loaded back afterwards, since an interrupt may run in between
+//	before calling a subroutine function, the same
+//	before returning, every local is stored to its global
+//	createPanic stores the locals and prints the globals
+//
+// the interpreter and the dynamic jump table are blocks of rom_start,
+// so they use the locals like any other code.
+type cpuRegister struct {
+	// the field of Compilation that codegen uses for the register
+	field  *llvm.Value
+	local  llvm.Value
+	global llvm.Value
+}
+
+// an LLVM function which 6502 code is compiled into: rom_start, or a
+// subroutine (see functions.go)
+type codeFunction struct {
+	fn         llvm.Value
+	entry      llvm.BasicBlock
+	registers  []cpuRegister
+	cycleCount llvm.Value
+}
+
+// sets up the entry block of fn, with the locals for the registers
+func (c *Compilation) createCodeFunction(fn llvm.Value) *codeFunction {
+	f := &codeFunction{
+		fn:    fn,
+		entry: llvm.AddBasicBlock(fn, "Entry"),
+	}
+	c.builder.SetInsertPointAtEnd(f.entry)
+	create := func(field *llvm.Value, intType llvm.Type, name string) {
+		global, ok := c.registerGlobals[name]
+		if !ok {
+			global = c.createNamedGlobal(intType, name)
+			c.registerGlobals[name] = global
+		}
+		local := c.builder.CreateAlloca(intType, name)
+		f.registers = append(f.registers, cpuRegister{field, local, global})
+	}
+	create(&c.rX, llvm.Int8Type(), "X")
+	create(&c.rY, llvm.Int8Type(), "Y")
+	create(&c.rA, llvm.Int8Type(), "A")
+	create(&c.rSP, llvm.Int8Type(), "SP")
+	create(&c.rPC, llvm.Int16Type(), "PC")
+	create(&c.rSBrk, llvm.Int1Type(), "S_brk")
+	create(&c.rSDec, llvm.Int1Type(), "S_dec")
+	create(&c.rSInt, llvm.Int1Type(), "S_int")
+	c.createFlagRegisters(create)
+	if c.Flags&BatchCyclesFlag != 0 {
+		f.cycleCount = c.builder.CreateAlloca(llvm.Int8Type(), "CycleCount")
+		c.builder.CreateStore(llvm.ConstInt(llvm.Int8Type(), 0, false), f.cycleCount)
+	}
+	c.useFunction(f)
+	c.syncRegistersIn()
+	return f
+}
+
+// points codegen at the locals of f
+func (c *Compilation) useFunction(f *codeFunction) {
+	c.currentFn = f
+	for _, r := range f.registers {
+		*r.field = r.local
+	}
+}
+
+// stores the registers to their globals
+func (c *Compilation) syncRegistersOut() {
+	for _, r := range c.currentFn.registers {
+		c.builder.CreateStore(c.builder.CreateLoad(r.local, ""), r.global)
+	}
+}
+
+// loads the registers from their globals
+func (c *Compilation) syncRegistersIn() {
+	for _, r := range c.currentFn.registers {
+		c.builder.CreateStore(c.builder.CreateLoad(r.global, ""), r.local)
+	}
+}
+
+// returns from the current function. rom_start returns nothing, and a
+// subroutine returns the address that its rts went to.
+func (c *Compilation) createReturn() {
+	c.flushCycles()
+	c.syncRegistersOut()
+	if c.currentFn == c.main {
+		c.builder.CreateRetVoid()
+		return
+	}
+	c.builder.CreateRet(c.builder.CreateLoad(c.rPC, ""))
+}
+
+// creates a function for each subroutine which can be compiled as one
+func (c *Compilation) createSubroutineFunctions() {
+	namesByAddr := make(map[int][]string)
+	for name, addr := range c.program.Labels {
+		namesByAddr[addr] = append(namesByAddr[addr], name)
+	}
+	keep := func(sub *CfgSubroutine) bool {
+		if _, ok := c.program.Labels[sub.Name]; !ok {
+			return false
+		}
+		// all of it has to be compiled, since the interpreter is in
+		// rom_start
+		for _, addr := range sub.Blocks {
+			for _, name := range namesByAddr[addr] {
+				if c.labeledData[name] {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	subs := c.program.compilableSubroutines(c.program.ControlFlowGraph(), keep)
+	entries := make([]int, 0, len(subs))
+	for entry := range subs {
+		entries = append(entries, entry)
+	}
+	sort.Ints(entries)
+	fnType := llvm.FunctionType(llvm.Int16Type(), []llvm.Type{}, false)
+	for _, entry := range entries {
+		sub := subs[entry]
+		fn := llvm.AddFunction(c.mod, sub.Name, fnType)
+		fn.SetLinkage(llvm.PrivateLinkage)
+		f := c.createCodeFunction(fn)
+		c.subroutines[entry] = f
+		for _, addr := range sub.Blocks {
+			for _, name := range namesByAddr[addr] {
+				c.labelFunctions[name] = f
+			}
+		}
+	}
+	c.useFunction(c.main)
+}
+
+// jumps from the entry block of each subroutine function to its code
+func (c *Compilation) enterSubroutineFunctions() {
+	names := c.program.labelNamesByAddr()
+	for entry, f := range c.subroutines {
+		c.builder.SetInsertPointAtEnd(f.entry)
+		c.builder.CreateBr(c.labeledBlocks[names[entry]])
+	}
+}
+
+// calls a subroutine which is compiled as a function, after the jsr has
+// pushed the return address. when the rts goes somewhere other than
+// returnAddr, so does the caller.
+func (c *Compilation) createCall(f *codeFunction, returnAddr int) {
+	c.syncRegistersOut()
+	pc := c.builder.CreateCall(f.fn, []llvm.Value{}, "")
+	c.syncRegistersIn()
+	expected := llvm.ConstInt(llvm.Int16Type(), uint64(returnAddr), false)
+	isExpected := c.builder.CreateICmp(llvm.IntEQ, pc, expected, "")
+	returnedBlock := c.createIf(c.builder.CreateNot(isExpected, ""))
+	c.builder.CreateStore(pc, c.rPC)
+	if c.currentFn == c.main {
+		c.builder.CreateBr(c.dynJumpBlock)
+	} else {
+		c.createReturn()
+	}
+	c.selectBlock(returnedBlock)
 }
 
 func (c *Compilation) addNmiInterruptCode() {
@@ -1717,13 +1849,12 @@ func (c *Compilation) addResetInterruptCode() {
 	c.builder.CreateStore(c0, c.rA)
 	c.builder.CreateStore(xfd, c.rSP)
 
-	c.builder.CreateStore(bit0, c.rSNeg)
-	c.builder.CreateStore(bit0, c.rSOver)
+	c.setNegZero(bit0, bit0)
+	c.setOverflowBit(bit0)
 	c.builder.CreateStore(bit1, c.rSBrk)
 	c.builder.CreateStore(bit0, c.rSDec)
 	c.builder.CreateStore(bit1, c.rSInt)
-	c.builder.CreateStore(bit0, c.rSZero)
-	c.builder.CreateStore(bit0, c.rSCarry)
+	c.setCarryBit(bit0)
 }
 
 func (c *Compilation) addDynJumpTable() {
@@ -1906,8 +2037,28 @@ func (c *Compilation) addLabelsAfterJsrs() {
 	}
 }
 
-func (p *Program) CompileToFile(file *os.File, flags CompileFlags) (*Compilation, error) {
-	llvm.InitializeNativeTarget()
+// labels the places that each jmp (ind) can go, so that they become
+// cases of the dynamic jump table instead of going to the interpreter
+func (c *Compilation) addLabelsAtIndirectJumpTargets() {
+	for _, j := range c.program.IndirectJumps() {
+		for _, addr := range c.program.indirectJumpTargets(j) {
+			c.program.getLabelAt(addr, "")
+		}
+	}
+}
+
+func (p *Program) CompileToFile(file *os.File, opts *CompileOptions) (*Compilation, error) {
+	opts = opts.normalize()
+	err := opts.check()
+	if err != nil {
+		return nil, err
+	}
+	machine, err := opts.createTargetMachine()
+	if err != nil {
+		return nil, err
+	}
+	defer machine.Dispose()
+	flags := opts.Flags
 
 	c := new(Compilation)
 	c.Flags = flags
@@ -1919,8 +2070,13 @@ func (p *Program) CompileToFile(file *os.File, flags CompileFlags) (*Compilation
 	c.labeledBlocks = map[string]llvm.BasicBlock{}
 	c.stringTable = map[string]llvm.Value{}
 	c.dynJumpAddrs = map[int]llvm.BasicBlock{}
+	c.registerGlobals = map[string]llvm.Value{}
+	c.subroutines = map[int]*codeFunction{}
+	c.labelFunctions = map[string]*codeFunction{}
 
 	c.addLabelsAfterJsrs()
+	c.addLabelsAtIndirectJumpTargets()
+	c.indexValues = p.indexValues()
 
 	// 2KB memory
 	memType := llvm.ArrayType(llvm.Int8Type(), 0x800)
@@ -1945,13 +2101,14 @@ func (p *Program) CompileToFile(file *os.File, flags CompileFlags) (*Compilation
 	}
 
 	c.setupControllerFramework()
-	c.createRegisters()
 
 	// main function / entry point
 	mainType := llvm.FunctionType(llvm.VoidType(), []llvm.Type{llvm.Int8Type()}, false)
 	c.mainFn = llvm.AddFunction(c.mod, "rom_start", mainType)
 	c.mainFn.SetFunctionCallConv(llvm.CCallConv)
-	entry := llvm.AddBasicBlock(c.mainFn, "Entry")
+	c.main = c.createCodeFunction(c.mainFn)
+	entry := c.main.entry
+	c.createSubroutineFunctions()
 
 	// set up entry points
 	c.setUpEntryPoint(p, 0xfffa, &c.nmiLabelName)
@@ -1960,6 +2117,7 @@ func (p *Program) CompileToFile(file *os.File, flags CompileFlags) (*Compilation
 
 	// second pass to build basic blocks
 	c.visitForBasicBlocks()
+	c.enterSubroutineFunctions()
 
 	c.interpretBlock = llvm.AddBasicBlock(c.mainFn, "Interpret")
 	c.dynJumpBlock = llvm.AddBasicBlock(c.mainFn, "DynJumpTable")
@@ -1989,6 +2147,7 @@ func (p *Program) CompileToFile(file *os.File, flags CompileFlags) (*Compilation
 	}
 
 	// entry jump table
+	c.useFunction(c.main)
 	c.selectBlock(entry)
 	c.builder.SetInsertPointAtEnd(entry)
 	badInterruptBlock := c.createBlock("BadInterrupt")
@@ -2005,39 +2164,23 @@ func (p *Program) CompileToFile(file *os.File, flags CompileFlags) (*Compilation
 	if flags&DumpModulePreFlag != 0 {
 		c.mod.Dump()
 	}
-	err := llvm.VerifyModule(c.mod, llvm.ReturnStatusAction)
+	err = llvm.VerifyModule(c.mod, llvm.ReturnStatusAction)
 	if err != nil {
 		c.Errors = append(c.Errors, err.Error())
 		return c, nil
 	}
 
-	engine, err := llvm.NewJITCompiler(c.mod, 3)
-	if err != nil {
-		c.Errors = append(c.Errors, err.Error())
-		return c, nil
-	}
-	defer engine.Dispose()
-
-	if flags&DisableOptFlag == 0 {
-		pass := llvm.NewPassManager()
-		defer pass.Dispose()
+	td := machine.TargetData()
+	c.mod.SetTarget(opts.triple())
+	c.mod.SetDataLayout(td.String())
 
-		pass.Add(engine.TargetData())
-		pass.AddConstantPropagationPass()
-		pass.AddInstructionCombiningPass()
-		pass.AddPromoteMemoryToRegisterPass()
-		pass.AddGVNPass()
-		pass.AddCFGSimplificationPass()
-		pass.AddDeadStoreEliminationPass()
-		pass.AddGlobalDCEPass()
-		pass.Run(c.mod)
-	}
+	c.optimize(opts, td)
 
 	if flags&DumpModuleFlag != 0 {
 		c.mod.Dump()
 	}
 
-	err = llvm.WriteBitcodeToFile(c.mod, file)
+	err = c.writeOutput(file, opts, machine)
 
 	if err != nil {
 		return c, err
@@ -2046,13 +2189,17 @@ func (p *Program) CompileToFile(file *os.File, flags CompileFlags) (*Compilation
 	return c, nil
 }
 
-func (p *Program) CompileToFilename(filename string, flags CompileFlags) (*Compilation, error) {
+// CompileToFilename writes bitcode, IR or assembly, depending on the
+// extension of filename. see OutputTypeForFile.
+func (p *Program) CompileToFilename(filename string, opts *CompileOptions) (*Compilation, error) {
+	o := opts.normalize()
+	o.Output = OutputTypeForFile(filename)
 	fd, err := os.Create(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	c, err := p.CompileToFile(fd, flags)
+	c, err := p.CompileToFile(fd, o)
 	err2 := fd.Close()
 
 	if err != nil {
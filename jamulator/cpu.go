@@ -0,0 +1,402 @@
+package jamulator
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// a 6502 interpreter, written to be obviously correct rather than fast,
+// to check the recompiled code against. see CompareTraces.
+
+type CpuMemory interface {
+	Read(addr uint16) byte
+	Write(addr uint16, value byte)
+}
+
+type Cpu struct {
+	A  byte
+	X  byte
+	Y  byte
+	SP byte
+	PC uint16
+
+	Carry     bool
+	Zero      bool
+	Interrupt bool
+	Decimal   bool
+	Overflow  bool
+	Negative  bool
+
+	Mem CpuMemory
+}
+
+// NewCpu returns a Cpu which has been reset
+func NewCpu(mem CpuMemory) *Cpu {
+	cpu := &Cpu{Mem: mem}
+	cpu.Reset()
+	return cpu
+}
+
+// Reset sets the registers the same way as the reset code of a compiled
+// program, and jumps to the reset vector.
+func (cpu *Cpu) Reset() {
+	cpu.A = 0
+	cpu.X = 0
+	cpu.Y = 0
+	cpu.SP = 0xfd
+	cpu.Carry = false
+	cpu.Zero = false
+	cpu.Interrupt = true
+	cpu.Decimal = false
+	cpu.Overflow = false
+	cpu.Negative = false
+	cpu.PC = cpu.readWord(0xfffc)
+}
+
+// Status returns the processor status as php pushes it, with the break
+// and unused bits set.
+func (cpu *Cpu) Status() byte {
+	status := byte(0x30)
+	if cpu.Negative {
+		status |= 0x80
+	}
+	if cpu.Overflow {
+		status |= 0x40
+	}
+	if cpu.Decimal {
+		status |= 0x08
+	}
+	if cpu.Interrupt {
+		status |= 0x04
+	}
+	if cpu.Zero {
+		status |= 0x02
+	}
+	if cpu.Carry {
+		status |= 0x01
+	}
+	return status
+}
+
+func (cpu *Cpu) setStatus(status byte) {
+	cpu.Negative = status&0x80 != 0
+	cpu.Overflow = status&0x40 != 0
+	cpu.Decimal = status&0x08 != 0
+	cpu.Interrupt = status&0x04 != 0
+	cpu.Zero = status&0x02 != 0
+	cpu.Carry = status&0x01 != 0
+}
+
+func (cpu *Cpu) readWord(addr uint16) uint16 {
+	return uint16(cpu.Mem.Read(addr)) | uint16(cpu.Mem.Read(addr+1))<<8
+}
+
+// the high byte is read from the same page, like jmp indirect does on a
+// real 6502
+func (cpu *Cpu) readWordInPage(addr uint16) uint16 {
+	high := addr&0xff00 | uint16(byte(addr)+1)
+	return uint16(cpu.Mem.Read(addr)) | uint16(cpu.Mem.Read(high))<<8
+}
+
+func (cpu *Cpu) push(value byte) {
+	cpu.Mem.Write(0x100+uint16(cpu.SP), value)
+	cpu.SP -= 1
+}
+
+func (cpu *Cpu) pull() byte {
+	cpu.SP += 1
+	return cpu.Mem.Read(0x100 + uint16(cpu.SP))
+}
+
+func (cpu *Cpu) pushWord(word uint16) {
+	cpu.push(byte(word >> 8))
+	cpu.push(byte(word))
+}
+
+func (cpu *Cpu) pullWord() uint16 {
+	low := cpu.pull()
+	high := cpu.pull()
+	return uint16(low) | uint16(high)<<8
+}
+
+func (cpu *Cpu) setNZ(value byte) byte {
+	cpu.Negative = value&0x80 != 0
+	cpu.Zero = value == 0
+	return value
+}
+
+// the address which the operand of the instruction at PC refers to. for
+// immediate instructions, it is the address of the operand itself.
+func (cpu *Cpu) operandAddr(mode AddrMode) uint16 {
+	operand := cpu.PC + 1
+	switch mode {
+	case absAddr:
+		return cpu.readWord(operand)
+	case absXAddr:
+		return cpu.readWord(operand) + uint16(cpu.X)
+	case absYAddr:
+		return cpu.readWord(operand) + uint16(cpu.Y)
+	case immedAddr:
+		return operand
+	case indirectAddr:
+		return cpu.readWordInPage(cpu.readWord(operand))
+	case xIndexIndirectAddr:
+		zp := cpu.Mem.Read(operand) + cpu.X
+		return cpu.readWordInPage(uint16(zp))
+	case indirectYIndexAddr:
+		zp := cpu.Mem.Read(operand)
+		return cpu.readWordInPage(uint16(zp)) + uint16(cpu.Y)
+	case relativeAddr:
+		offset := int8(cpu.Mem.Read(operand))
+		return cpu.PC + 2 + uint16(offset)
+	case zeroPageAddr:
+		return uint16(cpu.Mem.Read(operand))
+	case zeroXIndexAddr:
+		return uint16(cpu.Mem.Read(operand) + cpu.X)
+	case zeroYIndexAddr:
+		return uint16(cpu.Mem.Read(operand) + cpu.Y)
+	}
+	return 0
+}
+
+// the NES has no decimal mode, so neither does adc or sbc
+func (cpu *Cpu) adc(value byte) {
+	sum := uint16(cpu.A) + uint16(value)
+	if cpu.Carry {
+		sum += 1
+	}
+	result := byte(sum)
+	cpu.Overflow = (cpu.A^result)&(value^result)&0x80 != 0
+	cpu.Carry = sum > 0xff
+	cpu.A = cpu.setNZ(result)
+}
+
+func (cpu *Cpu) compare(reg byte, value byte) {
+	cpu.Carry = reg >= value
+	cpu.setNZ(reg - value)
+}
+
+func (cpu *Cpu) branch(cond bool, addr uint16) {
+	if cond {
+		cpu.PC = addr
+	}
+}
+
+// Step executes the instruction at PC
+func (cpu *Cpu) Step() error {
+	opCode := cpu.Mem.Read(cpu.PC)
+	info := opCodeDataMap[opCode]
+	if info.opName == "" {
+		return errors.New(fmt.Sprintf("$%04x: unrecognized op code $%02x", cpu.PC, opCode))
+	}
+	addr := cpu.operandAddr(info.addrMode)
+	accumulator := info.addrMode == impliedAddr
+	// read-modify-write instructions work on A or on memory
+	modify := func(f func(byte) byte) {
+		if accumulator {
+			cpu.A = cpu.setNZ(f(cpu.A))
+		} else {
+			cpu.Mem.Write(addr, cpu.setNZ(f(cpu.Mem.Read(addr))))
+		}
+	}
+	// most instructions go on to the next one
+	pc := cpu.PC
+	cpu.PC += uint16(info.addrMode.size())
+	switch info.opName {
+	default:
+		panic(fmt.Sprintf("unhandled instruction %s", info.opName))
+	case "adc":
+		cpu.adc(cpu.Mem.Read(addr))
+	case "sbc":
+		cpu.adc(^cpu.Mem.Read(addr))
+	case "and":
+		cpu.A = cpu.setNZ(cpu.A & cpu.Mem.Read(addr))
+	case "ora":
+		cpu.A = cpu.setNZ(cpu.A | cpu.Mem.Read(addr))
+	case "eor":
+		cpu.A = cpu.setNZ(cpu.A ^ cpu.Mem.Read(addr))
+	case "asl":
+		modify(func(v byte) byte {
+			cpu.Carry = v&0x80 != 0
+			return v << 1
+		})
+	case "lsr":
+		modify(func(v byte) byte {
+			cpu.Carry = v&0x01 != 0
+			return v >> 1
+		})
+	case "rol":
+		modify(func(v byte) byte {
+			result := v << 1
+			if cpu.Carry {
+				result |= 0x01
+			}
+			cpu.Carry = v&0x80 != 0
+			return result
+		})
+	case "ror":
+		modify(func(v byte) byte {
+			result := v >> 1
+			if cpu.Carry {
+				result |= 0x80
+			}
+			cpu.Carry = v&0x01 != 0
+			return result
+		})
+	case "inc":
+		modify(func(v byte) byte { return v + 1 })
+	case "dec":
+		modify(func(v byte) byte { return v - 1 })
+	case "bit":
+		v := cpu.Mem.Read(addr)
+		cpu.Negative = v&0x80 != 0
+		cpu.Overflow = v&0x40 != 0
+		cpu.Zero = cpu.A&v == 0
+	case "cmp":
+		cpu.compare(cpu.A, cpu.Mem.Read(addr))
+	case "cpx":
+		cpu.compare(cpu.X, cpu.Mem.Read(addr))
+	case "cpy":
+		cpu.compare(cpu.Y, cpu.Mem.Read(addr))
+	case "lda":
+		cpu.A = cpu.setNZ(cpu.Mem.Read(addr))
+	case "ldx":
+		cpu.X = cpu.setNZ(cpu.Mem.Read(addr))
+	case "ldy":
+		cpu.Y = cpu.setNZ(cpu.Mem.Read(addr))
+	case "sta":
+		cpu.Mem.Write(addr, cpu.A)
+	case "stx":
+		cpu.Mem.Write(addr, cpu.X)
+	case "sty":
+		cpu.Mem.Write(addr, cpu.Y)
+	case "inx":
+		cpu.X = cpu.setNZ(cpu.X + 1)
+	case "iny":
+		cpu.Y = cpu.setNZ(cpu.Y + 1)
+	case "dex":
+		cpu.X = cpu.setNZ(cpu.X - 1)
+	case "dey":
+		cpu.Y = cpu.setNZ(cpu.Y - 1)
+	case "tax":
+		cpu.X = cpu.setNZ(cpu.A)
+	case "tay":
+		cpu.Y = cpu.setNZ(cpu.A)
+	case "txa":
+		cpu.A = cpu.setNZ(cpu.X)
+	case "tya":
+		cpu.A = cpu.setNZ(cpu.Y)
+	case "tsx":
+		cpu.X = cpu.setNZ(cpu.SP)
+	case "txs":
+		cpu.SP = cpu.X
+	case "pha":
+		cpu.push(cpu.A)
+	case "pla":
+		cpu.A = cpu.setNZ(cpu.pull())
+	case "php":
+		cpu.push(cpu.Status())
+	case "plp":
+		cpu.setStatus(cpu.pull())
+	case "clc":
+		cpu.Carry = false
+	case "sec":
+		cpu.Carry = true
+	case "cli":
+		cpu.Interrupt = false
+	case "sei":
+		cpu.Interrupt = true
+	case "cld":
+		cpu.Decimal = false
+	case "sed":
+		cpu.Decimal = true
+	case "clv":
+		cpu.Overflow = false
+	case "nop":
+	case "bcc":
+		cpu.branch(!cpu.Carry, addr)
+	case "bcs":
+		cpu.branch(cpu.Carry, addr)
+	case "bne":
+		cpu.branch(!cpu.Zero, addr)
+	case "beq":
+		cpu.branch(cpu.Zero, addr)
+	case "bpl":
+		cpu.branch(!cpu.Negative, addr)
+	case "bmi":
+		cpu.branch(cpu.Negative, addr)
+	case "bvc":
+		cpu.branch(!cpu.Overflow, addr)
+	case "bvs":
+		cpu.branch(cpu.Overflow, addr)
+	case "jmp":
+		cpu.PC = addr
+	case "jsr":
+		cpu.pushWord(pc + 2)
+		cpu.PC = addr
+	case "rts":
+		cpu.PC = cpu.pullWord() + 1
+	case "rti":
+		cpu.setStatus(cpu.pull())
+		cpu.PC = cpu.pullWord()
+	case "brk":
+		cpu.pushWord(pc + 2)
+		cpu.push(cpu.Status())
+		cpu.Interrupt = true
+		cpu.PC = cpu.readWord(0xfffe)
+	}
+	return nil
+}
+
+// NesMemory is the memory map of a compiled program, without the PPU
+// and APU: 2KB of RAM mirrored up to $1fff, and PRG ROM from $8000.
+// reading any other address returns 0, and writing to one does nothing,
+// except for the homebrew ABI: $2008 prints a character and $2009 exits.
+type NesMemory struct {
+	Ram    [0x800]byte
+	PrgRom []byte
+	// where $2008 prints to. may be nil
+	Out      io.Writer
+	Exited   bool
+	ExitCode byte
+}
+
+// NewNesMemory lays the banks of PRG ROM out the way a compiled program
+// does, repeating them to fill $8000-$ffff.
+func NewNesMemory(prgRom [][]byte) *NesMemory {
+	m := new(NesMemory)
+	for len(m.PrgRom) < 0x8000 {
+		for _, bank := range prgRom {
+			m.PrgRom = append(m.PrgRom, bank...)
+		}
+		if len(m.PrgRom) == 0 {
+			m.PrgRom = make([]byte, 0x8000)
+		}
+	}
+	return m
+}
+
+func (m *NesMemory) Read(addr uint16) byte {
+	switch {
+	case addr < 0x2000:
+		return m.Ram[addr&(0x800-1)]
+	case addr >= 0x8000:
+		return m.PrgRom[int(addr-0x8000)%len(m.PrgRom)]
+	}
+	return 0
+}
+
+func (m *NesMemory) Write(addr uint16, value byte) {
+	switch {
+	case addr < 0x2000:
+		m.Ram[addr&(0x800-1)] = value
+	case addr == 0x2008: // putchar
+		if m.Out != nil {
+			m.Out.Write([]byte{value})
+		}
+	case addr == 0x2009: // exit
+		m.Exited = true
+		m.ExitCode = value
+	}
+}
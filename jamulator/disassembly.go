@@ -7,9 +7,11 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"image/color"
 	"io"
 	"io/ioutil"
 	"os"
+	"sort"
 )
 
 type Renderer interface {
@@ -21,6 +23,39 @@ type Disassembly struct {
 	offset     int
 	dynJumps   []int
 	jumpTables map[int]bool
+	// addresses of tables of words which follow a jsr to a jump engine
+	inlineTables []int
+	// addresses of jmp (ind) and rts instructions already checked for
+	// jump tables
+	dispatches map[int]bool
+	tables     map[jumpTable]bool
+	// tables to be commented once labels have their final names
+	followedTables []followedTable
+	// addresses found to be reachable with jmp (ind)
+	indirectTargets map[int]bool
+	// addresses reached as code which are not valid op codes
+	badOpCodes []int
+	cdl        *CodeDataLog
+	hints      *DisassemblyHints
+	textTable  *TextTable
+}
+
+type DisassembleOptions struct {
+	// code/data log from an emulator used to tell code apart from data.
+	// may be nil.
+	Cdl *CodeDataLog
+	// names, comments, and code and data ranges which override what
+	// the disassembler would guess. may be nil.
+	Hints *DisassemblyHints
+	// annotate each instruction with its address and bytes
+	ShowBytes bool
+	// encoding of the game's text, used to find strings instead of
+	// ASCII. may be nil.
+	TextTable *TextTable
+	// save CHR ROM as PNG tile sheets drawn with ChrPalette, instead of
+	// raw .chr files
+	ChrPng     bool
+	ChrPalette color.Palette
 }
 
 func (d *Disassembly) elemAsByte(elem *list.Element) (byte, error) {
@@ -67,6 +102,9 @@ func (p *Program) getLabelAt(addr int, name string) (string, error) {
 	elem := p.elemAtAddr(addr)
 	if elem == nil {
 		// cannot get/make label; there is already code there
+		if _, inRom := p.romByte(addr); inRom {
+			p.refusedLabels = append(p.refusedLabels, addr)
+		}
 		return "", errors.New("cannot insert a label mid-instruction")
 	}
 	stmt := p.elemLabelStmt(elem)
@@ -87,179 +125,95 @@ func (p *Program) getLabelAt(addr int, name string) (string, error) {
 	return i.LabelName, nil
 }
 
-func (d *Disassembly) removeElemAt(addr int) {
-	elem := d.prog.elemAtAddr(addr)
-	d.prog.List.Remove(elem)
-	delete(d.prog.Offsets, addr)
-}
-
-func (d *Disassembly) isJumpTable(addr int) bool {
-	isJmpTable, ok := d.jumpTables[addr]
-	if ok {
-		return isJmpTable
-	}
-	isJmpTable = d.detectJumpTable(addr)
-	d.jumpTables[addr] = isJmpTable
-	return isJmpTable
-}
-
-func (d *Disassembly) detectJumpTable(addr int) bool {
-	const (
-		expectAsl = iota
-		expectTay
-		expectPlaA
-		expectStaA
-		expectPlaB
-		expectStaB
-		expectInyC
-		expectLdaC
-		expectStaC
-		expectInYD
-		expectLdaD
-		expectStaD
-		expectJmp
-	)
-	state := expectAsl
-	var memA, memC int
-	for elem := d.prog.elemAtAddr(addr); elem != nil; elem = elem.Next() {
-		switch state {
-		case expectAsl:
-			i, ok := elem.Value.(*Instruction)
-			if !ok {
-				return false
-			}
-			if i.OpCode != 0x0a {
-				return false
-			}
-			state = expectTay
-		case expectTay:
-			i, ok := elem.Value.(*Instruction)
-			if !ok {
-				return false
-			}
-			if i.OpCode != 0xa8 {
-				return false
-			}
-			state = expectPlaA
-		case expectPlaA:
-			i, ok := elem.Value.(*Instruction)
-			if !ok {
-				return false
-			}
-			if i.OpCode != 0x68 {
-				return false
-			}
-			state = expectStaA
-		case expectStaA:
-			i, ok := elem.Value.(*Instruction)
-			if !ok {
-				return false
-			}
-			if i.OpCode != 0x85 && i.OpCode != 0x8d {
-				return false
-			}
-			memA = i.Value
-			state = expectPlaB
-		case expectPlaB:
-			i, ok := elem.Value.(*Instruction)
-			if !ok {
-				return false
-			}
-			if i.OpCode != 0x68 {
-				return false
-			}
-			state = expectStaB
-		case expectStaB:
-			i, ok := elem.Value.(*Instruction)
-			if !ok {
-				return false
-			}
-			if i.OpCode != 0x85 && i.OpCode != 0x8d {
-				return false
-			}
-			if i.Value != memA+1 {
-				return false
-			}
-			state = expectInyC
-		case expectInyC:
-			i, ok := elem.Value.(*Instruction)
-			if !ok {
-				return false
-			}
-			if i.OpCode != 0xc8 {
-				return false
-			}
-			state = expectLdaC
-		case expectLdaC:
-			i, ok := elem.Value.(*Instruction)
-			if !ok {
-				return false
-			}
-			if i.OpCode != 0xb1 {
-				return false
-			}
-			if i.Value != memA {
-				return false
-			}
-			state = expectStaC
-		case expectStaC:
-			i, ok := elem.Value.(*Instruction)
-			if !ok {
-				return false
-			}
-			if i.OpCode != 0x85 && i.OpCode != 0x8d {
-				return false
-			}
-			memC = i.Value
-			state = expectInYD
-		case expectInYD:
-			i, ok := elem.Value.(*Instruction)
-			if !ok {
-				return false
-			}
-			if i.OpCode != 0xc8 {
-				return false
-			}
-			state = expectLdaD
-		case expectLdaD:
-			i, ok := elem.Value.(*Instruction)
-			if !ok {
-				return false
-			}
-			if i.OpCode != 0xb1 {
-				return false
-			}
-			if i.Value != memA {
-				return false
-			}
-			state = expectStaD
-		case expectStaD:
-			i, ok := elem.Value.(*Instruction)
-			if !ok {
-				return false
-			}
-			if i.OpCode != 0x85 && i.OpCode != 0x8d {
-				return false
-			}
-			if i.Value != memC+1 {
-				return false
-			}
-			state = expectJmp
-		case expectJmp:
-			i, ok := elem.Value.(*Instruction)
-			if !ok {
-				return false
+// removes the label at addr, and makes the instructions and data which
+// referred to it use the address instead. branches cannot do without
+// their label, so if there are any the label stays.
+func (p *Program) removeLabelAt(addr int) bool {
+	elem := p.elemAtAddr(addr)
+	if elem == nil || elem.Prev() == nil {
+		return false
+	}
+	stmt, ok := elem.Prev().Value.(*LabelStatement)
+	if !ok {
+		return false
+	}
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		i, ok := e.Value.(*Instruction)
+		if ok && i.LabelName == stmt.LabelName && opCodeDataMap[i.OpCode].addrMode == relativeAddr {
+			return false
+		}
+	}
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		switch t := e.Value.(type) {
+		case *Instruction:
+			if t.LabelName != stmt.LabelName {
+				continue
 			}
-			if i.OpCode != 0x6c {
-				return false
+			t.LabelName = ""
+			if t.Type == DirectWithLabelIndexedInstruction {
+				t.Type = DirectIndexedInstruction
+			} else {
+				t.Type = DirectInstruction
 			}
-			if i.Value != memC {
-				return false
+		case *DataStatement:
+			for de := t.dataList.Front(); de != nil; de = de.Next() {
+				call, ok := de.Value.(*LabelCall)
+				if ok && call.LabelName == stmt.LabelName {
+					tmp := IntegerDataItem(addr)
+					de.Value = &tmp
+				}
 			}
-			return true
 		}
 	}
-	return false
+	p.List.Remove(elem.Prev())
+	delete(p.Labels, stmt.LabelName)
+	return true
+}
+
+// puts a line comment above the statement at addr and its label
+func (p *Program) addComment(addr int, text string) {
+	p.Comments[addr] = append(p.Comments[addr], text)
+}
+
+// comments which landed inside a statement, such as on the operand of an
+// instruction, are moved up to the start of it
+func (d *Disassembly) placeComments() {
+	starts := make([]int, 0)
+	for e := d.prog.List.Front(); e != nil; e = e.Next() {
+		switch t := e.Value.(type) {
+		case *Instruction:
+			starts = append(starts, t.Offset)
+		case *DataStatement:
+			starts = append(starts, t.Offset)
+		}
+	}
+	sort.Ints(starts)
+	addrs := make([]int, 0, len(d.prog.Comments))
+	for addr := range d.prog.Comments {
+		addrs = append(addrs, addr)
+	}
+	sort.Ints(addrs)
+	for _, addr := range addrs {
+		n := sort.SearchInts(starts, addr)
+		if n < len(starts) && starts[n] == addr {
+			continue
+		}
+		if n == 0 {
+			d.warn("$%04x: unable to place comment", addr)
+			delete(d.prog.Comments, addr)
+			continue
+		}
+		start := starts[n-1]
+		d.warn("$%04x: comment moved to $%04x, the start of the statement containing it", addr, start)
+		d.prog.Comments[start] = append(d.prog.Comments[start], d.prog.Comments[addr]...)
+		delete(d.prog.Comments, addr)
+	}
+}
+
+func (d *Disassembly) removeElemAt(addr int) {
+	elem := d.prog.elemAtAddr(addr)
+	d.prog.List.Remove(elem)
+	delete(d.prog.Offsets, addr)
 }
 
 func (d *Disassembly) markAsInstruction(addr int) error {
@@ -273,6 +227,14 @@ func (d *Disassembly) markAsInstruction(addr int) error {
 		// already decoded as instruction
 		return nil
 	}
+	if d.cdlIsData(addr) {
+		d.warn("$%04x: reached as code but logged as data", addr)
+		return errors.New("code/data log says this is data")
+	}
+	if d.hintIsData(addr) {
+		d.warn("$%04x: reached as code but hints say it is data", addr)
+		return errors.New("hints say this is data")
+	}
 	i := new(Instruction)
 	opCodeInfo := opCodeDataMap[opCode]
 	i.OpName = opCodeInfo.opName
@@ -280,6 +242,7 @@ func (d *Disassembly) markAsInstruction(addr int) error {
 	i.Offset = addr
 	switch opCodeInfo.addrMode {
 	case nilAddr:
+		d.badOpCodes = append(d.badOpCodes, addr)
 		return errors.New("cannot disassemble as instruction: bad op code")
 	case absAddr:
 		// convert data statements into instruction statement
@@ -309,6 +272,7 @@ func (d *Disassembly) markAsInstruction(addr int) error {
 			if d.isJumpTable(i.Value) {
 				// mark this and remember to come back later
 				d.dynJumps = append(d.dynJumps, addr+3)
+				d.inlineTables = append(d.inlineTables, addr+3)
 			} else {
 				d.markAsInstruction(addr + 3)
 			}
@@ -480,6 +444,8 @@ func (d *Disassembly) ToProgram() *Program {
 	orgStatement.Fill = 0xff // this is the default; causes it to be left off when rendered
 	orgStatement.Value = d.offset
 	d.prog.List.PushFront(orgStatement)
+	d.insertRamEquates()
+	d.insertRegisterEquates()
 
 	return d.prog
 }
@@ -514,31 +480,48 @@ func (p *Program) elemAtAddr(addr int) *list.Element {
 	return nil
 }
 
-func (d *Disassembly) markAsDataWordLabel(addr int, suggestedName string) error {
+// converts the two bytes at addr into a word data statement
+// containing an integer
+func (d *Disassembly) markAsDataWord(addr int) (*DataStatement, error) {
 	elem1 := d.prog.elemAtAddr(addr)
-	elem2 := elem1.Next()
-	s1 := elem1.Value.(*DataStatement)
-	s2 := elem2.Value.(*DataStatement)
-	if s1.dataList.Len() != 1 {
-		return errors.New("expected DataList len 1")
+	if elem1 == nil {
+		return nil, errors.New("not enough bytes for word")
 	}
-	if s2.dataList.Len() != 1 {
-		return errors.New("expected DataList len 1")
+	stmt, ok := elem1.Value.(*DataStatement)
+	if ok && stmt.Type == WordDataStmt {
+		// already a word
+		return stmt, nil
+	}
+	w, err := d.elemAsWord(elem1)
+	if err != nil {
+		return nil, err
 	}
-	n1 := s1.dataList.Front().Value.(*IntegerDataItem)
-	n2 := s2.dataList.Front().Value.(*IntegerDataItem)
-
 	newStmt := &DataStatement{
 		Type: WordDataStmt,
 		Offset: addr,
-		Payload: []byte{byte(*n1), byte(*n2)},
+		Payload: []byte{0, 0},
 		dataList: list.New(),
 	}
-	targetAddr := int(binary.LittleEndian.Uint16(newStmt.Payload))
-
+	binary.LittleEndian.PutUint16(newStmt.Payload, w)
+	tmp := IntegerDataItem(w)
+	newStmt.dataList.PushBack(&tmp)
 
 	elem1.Value = newStmt
 	d.removeElemAt(addr + 1)
+	return newStmt, nil
+}
+
+func (d *Disassembly) markAsDataWordLabel(addr int, suggestedName string) error {
+	newStmt, err := d.markAsDataWord(addr)
+	if err != nil {
+		return err
+	}
+	targetAddr := int(binary.LittleEndian.Uint16(newStmt.Payload))
+	if _, ok := newStmt.dataList.Front().Value.(*LabelCall); ok {
+		// already resolved
+		return nil
+	}
+	newStmt.dataList.Init()
 
 	if targetAddr < 0x8000 {
 		// target not in PRG ROM
@@ -549,7 +532,7 @@ func (d *Disassembly) markAsDataWordLabel(addr int, suggestedName string) error
 
 	// target in PRG ROM
 
-	err := d.markAsInstruction(targetAddr)
+	err = d.markAsInstruction(targetAddr)
 	if err != nil {
 		tmp := IntegerDataItem(targetAddr)
 		newStmt.dataList.PushBack(&tmp)
@@ -578,7 +561,10 @@ func (d *Disassembly) collapseDataStatements() {
 			continue
 		}
 		prev, ok := e.Prev().Value.(*DataStatement)
-		if !ok {
+		if !ok || prev.Type != ByteDataStmt {
+			continue
+		}
+		if _, ok := d.prog.Comments[dataStmt.Offset]; ok {
 			continue
 		}
 		if prev.dataList.Len()+dataStmt.dataList.Len() > MAX_DATA_LIST_LEN {
@@ -699,7 +685,12 @@ func (d *Disassembly) groupAsciiStrings() {
 	buf := new(bytes.Buffer)
 	for e != nil {
 		dataStmt, ok := e.Value.(*DataStatement)
-		if !ok || dataStmt.Type != ByteDataStmt || !allAscii(dataStmt.dataList) {
+		hasComment := false
+		if ok && e != first {
+			// a comment in the middle would be lost
+			_, hasComment = d.prog.Comments[dataStmt.Offset]
+		}
+		if !ok || dataStmt.Type != ByteDataStmt || !allAscii(dataStmt.dataList) || hasComment {
 			if buf.Len() >= threshold {
 				firstStmt := first.Value.(*DataStatement)
 				firstStmt.dataList = list.New()
@@ -714,7 +705,9 @@ func (d *Disassembly) groupAsciiStrings() {
 				}
 			}
 			buf = new(bytes.Buffer)
-			e = e.Next()
+			if !hasComment {
+				e = e.Next()
+			}
 			first = e
 			continue
 		}
@@ -770,38 +763,67 @@ func (d *Disassembly) resolveDynJumpCases() {
 	d.resolveDynJumpCases()
 }
 
-func (r *Rom) Disassemble() (*Program, error) {
+// Disassemble converts the PRG ROM into a Program. opts may be nil.
+func (r *Rom) Disassemble(opts *DisassembleOptions) (*Program, error) {
 	if len(r.PrgRom) != 1 && len(r.PrgRom) != 2 {
 		return nil, errors.New("only 1 or 2 prg rom banks supported")
 	}
+	if opts == nil {
+		opts = new(DisassembleOptions)
+	}
 
 	dis := new(Disassembly)
+	dis.cdl = opts.Cdl
+	dis.hints = opts.Hints
+	dis.textTable = opts.TextTable
 	dis.jumpTables = make(map[int]bool)
+	dis.dispatches = make(map[int]bool)
+	dis.tables = make(map[jumpTable]bool)
+	dis.indirectTargets = make(map[int]bool)
 	dis.prog = new(Program)
 	dis.prog.List = list.New()
 	dis.prog.Offsets = make(map[int]*list.Element)
 	dis.prog.Labels = make(map[string]int)
+	dis.prog.Variables = make(map[string]int)
+	dis.prog.Comments = make(map[int][]string)
 	dis.prog.ChrRom = r.ChrRom
 	dis.prog.PrgRom = r.PrgRom
 
 	dis.readAllAsData()
+	dis.applyHintsBefore()
 
 	// use the known entry points to recursively disassemble data statements
 	dis.markAsDataWordLabel(0xfffa, "NMI_Routine")
 	dis.markAsDataWordLabel(0xfffc, "Reset_Routine")
 	dis.markAsDataWordLabel(0xfffe, "IRQ_Routine")
 
-	// go over the dynamic jumps that we found and mark the options as labels
-	dis.resolveDynJumpCases()
+	// pick up the code that the emulator saw executed
+	dis.markCdlCode()
+	dis.applyHintsDuring()
+
+	// go over the jump tables that we found and mark the options as labels
+	dis.resolveJumpTables()
 
 	dis.identifyOrgs()
-	dis.groupAsciiStrings()
+	if dis.textTable != nil {
+		dis.groupTableStrings()
+	} else {
+		dis.groupAsciiStrings()
+	}
 	dis.collapseDataStatements()
+	dis.symbolizeRegisters()
+	dis.symbolizeRam()
+	dis.nameLabels()
+	dis.commentJumpTables()
+	dis.annotate(opts.ShowBytes)
+	dis.placeComments()
 
 	p := dis.ToProgram()
 	p.ChrRom = r.ChrRom
 	p.PrgRom = r.PrgRom
 	p.Mirroring = r.Mirroring
+	p.TextTable = dis.textTable
+	p.Report = dis.report()
 
 	return p, nil
 }
@@ -813,25 +835,27 @@ func Disassemble(reader io.Reader) (*Program, error) {
 		return nil, err
 	}
 	r.PrgRom = append(r.PrgRom, bank)
-	return r.Disassemble()
+	return r.Disassemble(nil)
 }
 
-func DisassembleFile(filename string) (*Program, error) {
-	fd, err := os.Open(filename)
+// LoadPrgFile reads 6502 machine code without an NES header, such as
+// a PRG ROM bank, as a Rom so that it can be disassembled with options.
+func LoadPrgFile(filename string) (*Rom, error) {
+	bank, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
+	r := new(Rom)
+	r.PrgRom = append(r.PrgRom, bank)
+	return r, nil
+}
 
-	p, err := Disassemble(fd)
-	err2 := fd.Close()
+func DisassembleFile(filename string) (*Program, error) {
+	r, err := LoadPrgFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	if err2 != nil {
-		return nil, err2
-	}
-
-	return p, nil
+	return r.Disassemble(nil)
 }
 
 func (i *Instruction) Render() string {
@@ -886,9 +910,11 @@ func (s *DataStatement) Render() string {
 		case *LabelCall:
 			buf.WriteString(t.LabelName)
 		case *StringDataItem:
-			buf.WriteString("\"")
-			buf.WriteString(string(*t))
-			buf.WriteString("\"")
+			if s.table == nil {
+				buf.WriteString("\"" + string(*t) + "\"")
+				break
+			}
+			buf.WriteString(quoteString(string(*t)))
 		case *IntegerDataItem:
 			switch s.Type {
 			default: panic("unexpected DataStatement Type")
@@ -905,29 +931,80 @@ func (s *DataStatement) Render() string {
 	return buf.String()
 }
 
+func (s *AssignStatement) Render() string {
+	if s.Value <= 0xff {
+		return fmt.Sprintf("%s = $%02x", s.VarName, s.Value)
+	}
+	return fmt.Sprintf("%s = $%04x", s.VarName, s.Value)
+}
+
 func (s *LabelStatement) Render() string {
 	return fmt.Sprintf("%s:", s.LabelName)
 }
 
+func (s *CommentStatement) Render() string {
+	return "; " + s.Text
+}
+
+func writeTrailingComment(w *bufio.Writer, comment string) (err error) {
+	if len(comment) == 0 {
+		return
+	}
+	_, err = w.WriteString(" ; ")
+	_, err = w.WriteString(comment)
+	return
+}
+
 func (p *Program) WriteSource(writer io.Writer) (err error) {
 	w := bufio.NewWriter(writer)
 
+	// comments go above the first label of an address, or the statement
+	// if it has none
+	commented := make(map[int]bool)
+	writeComments := func(addr int) {
+		if commented[addr] {
+			return
+		}
+		commented[addr] = true
+		for _, text := range p.Comments[addr] {
+			_, err = w.WriteString("; ")
+			_, err = w.WriteString(text)
+			_, err = w.WriteString("\n")
+		}
+	}
+
 	for e := p.List.Front(); e != nil; e = e.Next() {
 		switch t := e.Value.(type) {
 		default:
 			panic(fmt.Sprintf("unrecognized node: %T", e.Value))
 		case *Instruction:
+			writeComments(t.Offset)
 			_, err = w.WriteString("    ")
 			_, err = w.WriteString(t.Render())
+			err = writeTrailingComment(w, t.Comment)
 			_, err = w.WriteString("\n")
 		case *LabelStatement:
+			if addr, ok := p.Labels[t.LabelName]; ok {
+				writeComments(addr)
+			}
 			_, err = w.WriteString(t.Render())
+			err = writeTrailingComment(w, t.Comment)
 			_, err = w.WriteString("\n")
 		case *DataStatement:
+			writeComments(t.Offset)
 			_, err = w.WriteString("    ")
 			_, err = w.WriteString(t.Render())
+			err = writeTrailingComment(w, t.Comment)
 			_, err = w.WriteString("\n")
 		case *OrgPseudoOp:
+			_, err = w.WriteString(t.Render())
+			err = writeTrailingComment(w, t.Comment)
+			_, err = w.WriteString("\n")
+		case *AssignStatement:
+			_, err = w.WriteString(t.Render())
+			err = writeTrailingComment(w, t.Comment)
+			_, err = w.WriteString("\n")
+		case *CommentStatement:
 			_, err = w.WriteString(t.Render())
 			_, err = w.WriteString("\n")
 		}
@@ -0,0 +1,216 @@
+package jamulator
+
+import (
+	"github.com/axw/gollvm/llvm"
+)
+
+// the N, Z, C and V flags are computed lazily. instructions record
+// what the flags come from, and a flag is only worked out where
+// something reads it: branches, php, adc, sbc, rol, ror, the
+// interpreter, and interrupts, which push the status.
+//
+//	rNZ     16 bits, the last result. Z is set when the low byte is
+//	        zero, and N when bit 7 or 8 is. bit 8 is for when N and Z
+//	        are both set, after bit or plp.
+//	rCarry  16 bits, the sum that the carry comes out of. C is bit 8.
+//	rOver   8 bits. V is bit 7.
+//
+// these are synced with their globals like the other registers, so an
+// interrupt taken during rom_cycle works the flags out when it needs
+// them. with EagerFlagsFlag, each flag is computed when it is set and
+// kept in a bit of its own, which is useful to check the lazy flags
+// against.
+
+func (c *Compilation) eagerFlags() bool {
+	return c.Flags&EagerFlagsFlag != 0
+}
+
+func (c *Compilation) createFlagRegisters(create func(*llvm.Value, llvm.Type, string)) {
+	if c.eagerFlags() {
+		create(&c.rSNeg, llvm.Int1Type(), "S_neg")
+		create(&c.rSOver, llvm.Int1Type(), "S_over")
+		create(&c.rSZero, llvm.Int1Type(), "S_zero")
+		create(&c.rSCarry, llvm.Int1Type(), "S_carry")
+		return
+	}
+	create(&c.rNZ, llvm.Int16Type(), "S_nz")
+	create(&c.rCarry, llvm.Int16Type(), "S_carry")
+	create(&c.rOver, llvm.Int8Type(), "S_over")
+}
+
+// sets N and Z from a result
+func (c *Compilation) setNZ(v llvm.Value) {
+	if c.eagerFlags() {
+		c.dynTestAndSetZero(v)
+		c.dynTestAndSetNeg(v)
+		return
+	}
+	c.builder.CreateStore(c.builder.CreateZExt(v, llvm.Int16Type(), ""), c.rNZ)
+}
+
+// sets N and Z to the bits n and z
+func (c *Compilation) setNegZero(n llvm.Value, z llvm.Value) {
+	if c.eagerFlags() {
+		c.builder.CreateStore(n, c.rSNeg)
+		c.builder.CreateStore(z, c.rSZero)
+		return
+	}
+	c8 := llvm.ConstInt(llvm.Int16Type(), 8, false)
+	n16 := c.builder.CreateShl(c.builder.CreateZExt(n, llvm.Int16Type(), ""), c8, "")
+	notZ16 := c.builder.CreateZExt(c.builder.CreateNot(z, ""), llvm.Int16Type(), "")
+	c.builder.CreateStore(c.builder.CreateOr(n16, notZ16, ""), c.rNZ)
+}
+
+func (c *Compilation) setCarryBit(carry llvm.Value) {
+	if c.eagerFlags() {
+		c.builder.CreateStore(carry, c.rSCarry)
+		return
+	}
+	c8 := llvm.ConstInt(llvm.Int16Type(), 8, false)
+	carry16 := c.builder.CreateZExt(carry, llvm.Int16Type(), "")
+	c.builder.CreateStore(c.builder.CreateShl(carry16, c8, ""), c.rCarry)
+}
+
+// sets C to the carry out of a + v + carry
+func (c *Compilation) setCarryAddition(a llvm.Value, v llvm.Value, carry llvm.Value) {
+	if c.eagerFlags() {
+		c.dynTestAndSetCarryAddition(a, v, carry)
+		return
+	}
+	sum := c.builder.CreateAdd(c.builder.CreateZExt(a, llvm.Int16Type(), ""),
+		c.builder.CreateZExt(v, llvm.Int16Type(), ""), "")
+	sum = c.builder.CreateAdd(sum, c.builder.CreateZExt(carry, llvm.Int16Type(), ""), "")
+	c.builder.CreateStore(sum, c.rCarry)
+}
+
+// sets C for a - v - (1 - carry), which the 6502 works out as
+// a + ^v + carry
+func (c *Compilation) setCarrySubtraction(a llvm.Value, v llvm.Value, carry llvm.Value) {
+	if c.eagerFlags() {
+		c.dynTestAndSetCarrySubtraction3(a, v, carry)
+		return
+	}
+	c.setCarryAddition(a, c.builder.CreateNot(v, ""), carry)
+}
+
+// sets C the way cmp, cpx and cpy do
+func (c *Compilation) setCarryCompare(left llvm.Value, right llvm.Value) {
+	if c.eagerFlags() {
+		c.dynTestAndSetCarrySubtraction(left, right)
+		return
+	}
+	c.setCarryAddition(left, c.builder.CreateNot(right, ""), llvm.ConstInt(llvm.Int8Type(), 1, false))
+}
+
+// sets C to bit 7 of val, which a left shift moves out
+func (c *Compilation) setCarryShl(val llvm.Value) {
+	if c.eagerFlags() {
+		c.dynTestAndSetCarryShl(val)
+		return
+	}
+	c1 := llvm.ConstInt(llvm.Int16Type(), 1, false)
+	val16 := c.builder.CreateZExt(val, llvm.Int16Type(), "")
+	c.builder.CreateStore(c.builder.CreateShl(val16, c1, ""), c.rCarry)
+}
+
+// sets C to bit 0 of val, which a right shift moves out
+func (c *Compilation) setCarryLShr(val llvm.Value) {
+	if c.eagerFlags() {
+		c.dynTestAndSetCarryLShr(val)
+		return
+	}
+	c1 := llvm.ConstInt(llvm.Int8Type(), 1, false)
+	c.setCarryBit(c.builder.CreateTrunc(c.builder.CreateAnd(val, c1, ""), llvm.Int1Type(), ""))
+}
+
+func (c *Compilation) setOverflowBit(over llvm.Value) {
+	if c.eagerFlags() {
+		c.builder.CreateStore(over, c.rSOver)
+		return
+	}
+	c7 := llvm.ConstInt(llvm.Int8Type(), 7, false)
+	over8 := c.builder.CreateZExt(over, llvm.Int8Type(), "")
+	c.builder.CreateStore(c.builder.CreateShl(over8, c7, ""), c.rOver)
+}
+
+// sets V for r = a + v + carry. it overflowed if a and v have the same
+// sign and r does not.
+func (c *Compilation) setOverflowAddition(a llvm.Value, v llvm.Value, r llvm.Value) {
+	if c.eagerFlags() {
+		c.dynTestAndSetOverflowAddition(a, v, r)
+		return
+	}
+	aXorR := c.builder.CreateXor(a, r, "")
+	vXorR := c.builder.CreateXor(v, r, "")
+	c.builder.CreateStore(c.builder.CreateAnd(aXorR, vXorR, ""), c.rOver)
+}
+
+// sets V for r = a - v - (1 - carry). it overflowed if a and v have
+// different signs and r does not have the sign of a.
+func (c *Compilation) setOverflowSubtraction(a llvm.Value, v llvm.Value, carry llvm.Value, r llvm.Value) {
+	if c.eagerFlags() {
+		c.dynTestAndSetOverflowSubtraction(a, v, carry)
+		return
+	}
+	aXorV := c.builder.CreateXor(a, v, "")
+	aXorR := c.builder.CreateXor(a, r, "")
+	c.builder.CreateStore(c.builder.CreateAnd(aXorV, aXorR, ""), c.rOver)
+}
+
+// the flag functions below work a flag out as a bit, reading registers
+// with load. outside of the compiled 6502 code, load reads the globals
+// instead.
+
+func (c *Compilation) loadLocal(ptr llvm.Value) llvm.Value {
+	return c.builder.CreateLoad(ptr, "")
+}
+
+func (c *Compilation) testBits(v llvm.Value, mask int) llvm.Value {
+	masked := c.builder.CreateAnd(v, llvm.ConstInt(v.Type(), uint64(mask), false), "")
+	return c.builder.CreateICmp(llvm.IntNE, masked, llvm.ConstInt(v.Type(), 0, false), "")
+}
+
+func (c *Compilation) negFlag(load func(llvm.Value) llvm.Value) llvm.Value {
+	if c.eagerFlags() {
+		return load(c.rSNeg)
+	}
+	return c.testBits(load(c.rNZ), 0x180)
+}
+
+func (c *Compilation) zeroFlag(load func(llvm.Value) llvm.Value) llvm.Value {
+	if c.eagerFlags() {
+		return load(c.rSZero)
+	}
+	notZero := c.testBits(load(c.rNZ), 0xff)
+	return c.builder.CreateNot(notZero, "")
+}
+
+func (c *Compilation) carryFlag(load func(llvm.Value) llvm.Value) llvm.Value {
+	if c.eagerFlags() {
+		return load(c.rSCarry)
+	}
+	return c.testBits(load(c.rCarry), 0x100)
+}
+
+func (c *Compilation) overflowFlag(load func(llvm.Value) llvm.Value) llvm.Value {
+	if c.eagerFlags() {
+		return load(c.rSOver)
+	}
+	return c.testBits(load(c.rOver), 0x80)
+}
+
+func (c *Compilation) getNeg() llvm.Value {
+	return c.negFlag(c.loadLocal)
+}
+
+func (c *Compilation) getZero() llvm.Value {
+	return c.zeroFlag(c.loadLocal)
+}
+
+func (c *Compilation) getCarry() llvm.Value {
+	return c.carryFlag(c.loadLocal)
+}
+
+func (c *Compilation) getOverflow() llvm.Value {
+	return c.overflowFlag(c.loadLocal)
+}
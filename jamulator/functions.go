@@ -0,0 +1,143 @@
+package jamulator
+
+import (
+	"container/list"
+)
+
+// compilableSubroutines finds the subroutines whose jsr and rts the
+// recompiler can turn into an LLVM call and return. A subroutine
+// qualifies when:
+//
+//	it is only entered by jsr, and none of its blocks are reached from
+//	outside of it, other than by returning from a call
+//	it only leaves by rts, after as many pulls as pushes on every path
+//	and without txs, so that the rts pulls the address the jsr pushed
+//	every subroutine it calls qualifies as well
+//
+// a store through a pointer could still overwrite the return address on
+// the stack, so the code which makes the call checks where the rts went.
+// when keep is not nil, the subroutines it returns false for are ruled
+// out too, before their callers are.
+func (p *Program) compilableSubroutines(g *ControlFlowGraph, keep func(*CfgSubroutine) bool) map[int]*CfgSubroutine {
+	excluded := make(map[int]bool)
+	for _, vector := range []int{0xfffa, 0xfffc, 0xfffe} {
+		addr, ok := p.vectorTarget(vector)
+		if ok {
+			excluded[addr] = true
+		}
+	}
+	// code which jmp (ind) goes to is reached through the dynamic jump
+	// table of rom_start, so it has to stay there
+	for _, j := range p.IndirectJumps() {
+		for _, addr := range p.indirectJumpTargets(j) {
+			excluded[addr] = true
+		}
+	}
+
+	subs := make(map[int]*CfgSubroutine)
+	for _, sub := range g.Subroutines {
+		if (keep == nil || keep(sub)) && p.hasStackDiscipline(g, sub, excluded) {
+			subs[sub.Entry] = sub
+		}
+	}
+	// drop the ones which call a subroutine that does not qualify,
+	// until there are none left to drop
+	for changed := true; changed; {
+		changed = false
+		for entry, sub := range subs {
+			for _, callee := range sub.Calls {
+				if subs[callee] == nil {
+					delete(subs, entry)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return subs
+}
+
+func (p *Program) hasStackDiscipline(g *ControlFlowGraph, sub *CfgSubroutine, excluded map[int]bool) bool {
+	inSub := make(map[int]bool)
+	for _, addr := range sub.Blocks {
+		if excluded[addr] {
+			return false
+		}
+		inSub[addr] = true
+	}
+	for _, addr := range sub.Blocks {
+		b := g.BlockAt(addr)
+		for _, edge := range b.Preds {
+			switch edge.Kind {
+			case CallEdge:
+				if b.Start != sub.Entry {
+					return false
+				}
+			case ReturnEdge:
+				// back from a subroutine this one calls
+			default:
+				if !inSub[edge.From] {
+					return false
+				}
+			}
+		}
+		for _, edge := range b.Succs {
+			switch edge.Kind {
+			case DynamicEdge:
+				return false
+			case FallthroughEdge, BranchEdge, JumpEdge:
+				if g.BlockAt(edge.To) == nil {
+					return false
+				}
+			}
+		}
+		last := b.Instructions[len(b.Instructions)-1]
+		switch opCodeDataMap[last.OpCode].opName {
+		case "rti", "brk":
+			return false
+		}
+		if fallsThrough(last.OpCode) && g.BlockAt(b.End) == nil {
+			// runs into data
+			return false
+		}
+	}
+
+	// how many bytes have been pushed at the start of each block
+	depth := map[int]int{sub.Entry: 0}
+	work := list.New()
+	work.PushBack(g.BlockAt(sub.Entry))
+	for work.Len() > 0 {
+		b := work.Remove(work.Front()).(*CfgBlock)
+		d := depth[b.Start]
+		for _, i := range b.Instructions {
+			switch i.OpCode {
+			case 0x48, 0x08: // pha, php
+				d += 1
+			case 0x68, 0x28: // pla, plp
+				d -= 1
+				if d < 0 {
+					return false
+				}
+			case 0x9a: // txs
+				return false
+			case 0x60: // rts
+				if d != 0 {
+					return false
+				}
+			}
+		}
+		for _, edge := range b.Succs {
+			switch edge.Kind {
+			case FallthroughEdge, BranchEdge, JumpEdge:
+				existing, ok := depth[edge.To]
+				if !ok {
+					depth[edge.To] = d
+					work.PushBack(g.BlockAt(edge.To))
+				} else if existing != d {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
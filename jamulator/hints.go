@@ -0,0 +1,329 @@
+package jamulator
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// inclusive range of addresses
+type AddrRange struct {
+	Start int
+	End   int
+}
+
+// DisassemblyHints is knowledge about a ROM supplied by a person, which
+// overrides what the disassembler would otherwise guess.
+type DisassemblyHints struct {
+	Labels map[int]string
+	// addresses which are known to be reachable code
+	Entries []int
+	// ranges which contain only code
+	Code []AddrRange
+	// ranges which contain only bytes of data
+	Bytes []AddrRange
+	// ranges which contain only words of data
+	Words []AddrRange
+	// ranges which contain words pointing to code
+	Pointers []AddrRange
+	// ranges which contain words pointing to one byte before code, which
+	// are pushed onto the stack and then jumped to with rts
+	RtsTables []AddrRange
+	// subroutines which jump to an entry in a table of words following
+	// the jsr which called them
+	JumpTables []int
+	Comments   map[int][]string
+}
+
+func parseHintAddr(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	var n uint64
+	var err error
+	switch {
+	case strings.HasPrefix(s, "$"):
+		n, err = strconv.ParseUint(s[1:], 16, 16)
+	case strings.HasPrefix(s, "0x"):
+		n, err = strconv.ParseUint(s[2:], 16, 16)
+	default:
+		n, err = strconv.ParseUint(s, 10, 16)
+	}
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("invalid address: %s", s))
+	}
+	return int(n), nil
+}
+
+func parseHintRange(s string) (AddrRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	start, err := parseHintAddr(parts[0])
+	if err != nil {
+		return AddrRange{}, err
+	}
+	if len(parts) == 1 {
+		return AddrRange{start, start}, nil
+	}
+	end, err := parseHintAddr(parts[1])
+	if err != nil {
+		return AddrRange{}, err
+	}
+	if end < start {
+		return AddrRange{}, errors.New(fmt.Sprintf("range ends before it starts: %s", s))
+	}
+	return AddrRange{start, end}, nil
+}
+
+// ReadDisassemblyHints parses a hints file. Each line is one of:
+//
+//	label=$c000,Name
+//	entry=$c000
+//	code=$c000-$c0ff
+//	bytes=$c000-$c0ff
+//	words=$c000-$c0ff
+//	pointers=$c000-$c0ff
+//	rtstable=$c000-$c0ff
+//	jumptable=$c000
+//	comment=$c000,some text
+//
+// Lines starting with '#' are ignored. A label in RAM names the variable
+// there instead.
+func ReadDisassemblyHints(ioreader io.Reader) (*DisassemblyHints, error) {
+	reader := bufio.NewReader(ioreader)
+	h := &DisassemblyHints{
+		Labels:   make(map[int]string),
+		Comments: make(map[int][]string),
+	}
+	lineCount := 0
+	for {
+		lineCount += 1
+		rawLine, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		line := strings.TrimSpace(rawLine)
+		if len(line) > 0 && line[0] != '#' {
+			err2 := h.parseLine(line)
+			if err2 != nil {
+				return nil, errors.New(fmt.Sprintf("Line %d: %s", lineCount, err2.Error()))
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return h, nil
+}
+
+func (h *DisassemblyHints) parseLine(line string) error {
+	parts := strings.SplitN(line, "=", 2)
+	if len(parts) != 2 {
+		return errors.New("syntax error")
+	}
+	key := strings.TrimSpace(parts[0])
+	value := strings.TrimSpace(parts[1])
+	switch key {
+	case "label", "comment":
+		args := strings.SplitN(value, ",", 2)
+		if len(args) != 2 {
+			return errors.New(fmt.Sprintf("expected address and text: %s", value))
+		}
+		addr, err := parseHintAddr(args[0])
+		if err != nil {
+			return err
+		}
+		text := strings.TrimSpace(args[1])
+		if key == "label" {
+			h.Labels[addr] = text
+		} else {
+			h.Comments[addr] = append(h.Comments[addr], text)
+		}
+	case "entry", "jumptable":
+		addr, err := parseHintAddr(value)
+		if err != nil {
+			return err
+		}
+		if key == "entry" {
+			h.Entries = append(h.Entries, addr)
+		} else {
+			h.JumpTables = append(h.JumpTables, addr)
+		}
+	case "code", "bytes", "words", "pointers", "rtstable":
+		r, err := parseHintRange(value)
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "code":
+			h.Code = append(h.Code, r)
+		case "bytes":
+			h.Bytes = append(h.Bytes, r)
+		case "words":
+			h.Words = append(h.Words, r)
+		case "pointers":
+			h.Pointers = append(h.Pointers, r)
+		case "rtstable":
+			h.RtsTables = append(h.RtsTables, r)
+		}
+		if key != "code" && key != "bytes" && (r.End-r.Start)%2 != 1 {
+			return errors.New(fmt.Sprintf("%s range must contain a whole number of words: %s", key, value))
+		}
+	default:
+		return errors.New(fmt.Sprintf("unrecognized hint: %s", key))
+	}
+	return nil
+}
+
+func LoadDisassemblyHintsFile(filename string) (*DisassemblyHints, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	h, err := ReadDisassemblyHints(fd)
+	err2 := fd.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err2 != nil {
+		return nil, err2
+	}
+	return h, nil
+}
+
+func inRanges(ranges []AddrRange, addr int) bool {
+	for _, r := range ranges {
+		if addr >= r.Start && addr <= r.End {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the hints say addr is data
+func (d *Disassembly) hintIsData(addr int) bool {
+	h := d.hints
+	if h == nil {
+		return false
+	}
+	return inRanges(h.Bytes, addr) || inRanges(h.Words, addr) ||
+		inRanges(h.Pointers, addr) || inRanges(h.RtsTables, addr)
+}
+
+// names, data ranges, and jump table routines must be known before
+// recursive descent begins
+func (d *Disassembly) applyHintsBefore() {
+	h := d.hints
+	if h == nil {
+		return
+	}
+	labelAddrs := make([]int, 0, len(h.Labels))
+	for addr := range h.Labels {
+		labelAddrs = append(labelAddrs, addr)
+	}
+	sort.Ints(labelAddrs)
+	for _, addr := range labelAddrs {
+		name := h.Labels[addr]
+		if isRamAddr(addr) {
+			// symbolizeRam and insertRamEquates use the name
+			d.prog.Variables[name] = addr
+			continue
+		}
+		if addr < 0x8000 {
+			d.warn("$%04x: unable to name %s: not in PRG ROM or RAM", addr, name)
+			continue
+		}
+		_, err := d.prog.getLabelAt(addr, name)
+		if err != nil {
+			d.warn("$%04x: unable to name %s: %s", addr, name, err.Error())
+		}
+	}
+	for _, addr := range h.JumpTables {
+		d.jumpTables[addr] = true
+	}
+	for _, r := range h.Words {
+		for addr := r.Start; addr < r.End; addr += 2 {
+			_, err := d.markAsDataWord(addr)
+			if err != nil {
+				d.warn("$%04x: unable to mark as word: %s", addr, err.Error())
+			}
+		}
+	}
+	commentAddrs := make([]int, 0, len(h.Comments))
+	for addr := range h.Comments {
+		commentAddrs = append(commentAddrs, addr)
+	}
+	sort.Ints(commentAddrs)
+	for _, addr := range commentAddrs {
+		if d.prog.elemAtAddr(addr) == nil {
+			d.warn("$%04x: unable to add comment", addr)
+			continue
+		}
+		for _, comment := range h.Comments[addr] {
+			d.prog.addComment(addr, comment)
+		}
+	}
+}
+
+func (d *Disassembly) applyHintsDuring() {
+	h := d.hints
+	if h == nil {
+		return
+	}
+	for _, addr := range h.Entries {
+		err := d.markAsInstruction(addr)
+		if err != nil {
+			d.warn("$%04x: unable to mark entry point as code: %s", addr, err.Error())
+		}
+		d.prog.getLabelAt(addr, "")
+	}
+	for _, r := range h.Code {
+		addr := r.Start
+		for addr <= r.End {
+			err := d.markAsInstruction(addr)
+			if err != nil {
+				d.warn("$%04x: unable to mark as code: %s", addr, err.Error())
+				break
+			}
+			elem := d.prog.elemAtAddr(addr)
+			if elem == nil {
+				break
+			}
+			i, ok := elem.Value.(*Instruction)
+			if !ok {
+				break
+			}
+			addr += len(i.Payload)
+		}
+	}
+	for _, r := range h.Pointers {
+		for addr := r.Start; addr < r.End; addr += 2 {
+			err := d.markAsDataWordLabel(addr, "")
+			if err != nil {
+				d.warn("$%04x: unable to mark as pointer: %s", addr, err.Error())
+			}
+		}
+	}
+	for _, r := range h.RtsTables {
+		for addr := r.Start; addr < r.End; addr += 2 {
+			stmt, err := d.markAsDataWord(addr)
+			if err != nil {
+				d.warn("$%04x: unable to mark as rts table entry: %s", addr, err.Error())
+				continue
+			}
+			item, ok := stmt.dataList.Front().Value.(*IntegerDataItem)
+			if !ok {
+				continue
+			}
+			target := int(*item) + 1
+			err = d.markAsInstruction(target)
+			if err != nil {
+				d.warn("$%04x: rts table entry $%04x is not code: %s", addr, target, err.Error())
+				continue
+			}
+			d.prog.getLabelAt(target, "")
+		}
+	}
+}
@@ -22,7 +22,7 @@ var interpretOps = [256]func(*Compilation) {
 		c.debugPrintf("asl\n", []llvm.Value{})
 		a := c.builder.CreateLoad(c.rA, "")
 		c.builder.CreateStore(c.performAsl(a), c.rA)
-		c.cycle(2, -1)
+		c.cycleOp(0x0a, -1)
 	},
 	nil,
 	nil,
@@ -59,7 +59,7 @@ var interpretOps = [256]func(*Compilation) {
 
 		c.pushWordToStack(pcMinusOne)
 		c.builder.CreateStore(newPc, c.rPC)
-		c.cycle(6, -1)
+		c.cycleOp(0x20, -1)
 	},
 	nil,
 	nil,
@@ -77,7 +77,7 @@ var interpretOps = [256]func(*Compilation) {
 		addr := c.interpAbsAddr()
 		c.debugPrintf("bit $%04x\n", []llvm.Value{addr})
 		c.performBit(c.dynLoad(addr, 0, 0xffff))
-		c.cycle(4, -1)
+		c.cycleOp(0x2c, -1)
 	},
 	nil,
 	nil,
@@ -113,7 +113,7 @@ var interpretOps = [256]func(*Compilation) {
 		c.debugPrintf("pha\n", []llvm.Value{})
 		a := c.builder.CreateLoad(c.rA, "")
 		c.pushToStack(a)
-		c.cycle(3, -1)
+		c.cycleOp(0x48, -1)
 	},
 	nil,
 	nil,
@@ -184,7 +184,7 @@ var interpretOps = [256]func(*Compilation) {
 		addr := c.interpZpgAddr()
 		c.debugPrintf("sta $%02x\n", []llvm.Value{addr})
 		c.dynStore(addr, 0, 0xff, c.builder.CreateLoad(c.rA, ""))
-		c.cycle(3, -1)
+		c.cycleOp(0x85, -1)
 	},
 	nil,
 	nil,
@@ -198,7 +198,7 @@ var interpretOps = [256]func(*Compilation) {
 		v := c.interpAbsAddr()
 		c.debugPrintf("sta $%04x\n", []llvm.Value{v})
 		c.dynStore(v, 0, 0xffff, c.builder.CreateLoad(c.rA, ""))
-		c.cycle(4, -1)
+		c.cycleOp(0x8d, -1)
 	},
 	nil,
 	nil,
@@ -227,7 +227,7 @@ var interpretOps = [256]func(*Compilation) {
 		v := c.interpImmedAddr()
 		c.debugPrintf("ldx #$%02x\n", []llvm.Value{v})
 		c.performLdx(v)
-		c.cycle(2, -1)
+		c.cycleOp(0xa2, -1)
 	},
 	nil,
 	nil,
@@ -240,7 +240,7 @@ var interpretOps = [256]func(*Compilation) {
 		v := c.interpImmedAddr()
 		c.debugPrintf("lda #$%02x\n", []llvm.Value{v})
 		c.performLda(v)
-		c.cycle(2, -1)
+		c.cycleOp(0xa9, -1)
 	},
 	nil,
 	nil,
@@ -259,7 +259,7 @@ var interpretOps = [256]func(*Compilation) {
 		c.debugPrintf("ldy $%02x, X\n", []llvm.Value{addr})
 		v := c.dynLoad(addr, 0, 0xff)
 		c.performLdy(v)
-		c.cycle(4, -1)
+		c.cycleOp(0xb4, -1)
 	},
 	nil,
 	nil,
@@ -292,6 +292,7 @@ var interpretOps = [256]func(*Compilation) {
 	// 0xd0
 	func (c *Compilation) {
 		// 0xd0 bne relative
+		bne := opCodeDataMap[0xd0]
 		// TODO: optimize by not loading destAddr if we're not in debug mode
 		destAddr := c.interpRelAddr()
 		c.debugPrintf("bne $%04x\n", []llvm.Value{destAddr})
@@ -301,7 +302,7 @@ var interpretOps = [256]func(*Compilation) {
 		xff00 := llvm.ConstInt(llvm.Int16Type(), uint64(0xff00), false)
 
 		doneBlock := c.createBlock("done")
-		isZero := c.builder.CreateLoad(c.rSZero, "")
+		isZero := c.getZero()
 		notZero := c.builder.CreateNot(isZero, "")
 		// if ! zero
 		notBranchingBlock := c.createIf(notZero)
@@ -313,18 +314,18 @@ var interpretOps = [256]func(*Compilation) {
 		eq := c.builder.CreateICmp(llvm.IntEQ, maskedInstrAddr, maskedDestAddr, "")
 		// if same page page
 		crossedPageBlock := c.createIf(eq)
-		c.cycle(3, -1)
+		c.cycle(bne.cycles+bne.branchTakenCycles, -1)
 		c.builder.CreateBr(doneBlock)
 		// else if crossed page
 		c.selectBlock(crossedPageBlock)
-		c.cycle(4, -1)
+		c.cycle(bne.cycles+bne.branchTakenCycles+bne.pageCrossCycles, -1)
 		c.builder.CreateBr(doneBlock)
 		// else if not branching
 		c.selectBlock(notBranchingBlock)
 		// pc++
 		newPc := c.builder.CreateAdd(pc, c1, "")
 		c.builder.CreateStore(newPc, c.rPC)
-		c.cycle(2, -1)
+		c.cycleOp(0xd0, -1)
 		c.builder.CreateBr(doneBlock)
 		// done
 		c.selectBlock(doneBlock)
@@ -459,6 +460,7 @@ func (c *Compilation) addInterpretBlock() {
 		fn(c)
 		// jump back to dynJumpBlock. maybe we're back in
 		// statically compiled happy land.
+		c.flushCycles()
 		c.builder.CreateBr(c.dynJumpBlock)
 	}
 }
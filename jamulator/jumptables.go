@@ -0,0 +1,576 @@
+package jamulator
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+)
+
+// a step of an instruction pattern matches any one of these op codes
+type patternStep []byte
+
+func (s patternStep) matches(opCode byte) bool {
+	for _, op := range s {
+		if op == opCode {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	ldaAbsIndexed = patternStep{0xbd, 0xb9} // lda abs,x  lda abs,y
+	staMem        = patternStep{0x85, 0x8d} // sta zp  sta abs
+)
+
+// the jump engine from Super Mario Bros. it is called with jsr, followed
+// by a table of words, and uses its own return address to find the table.
+var jsrDispatchPattern = []patternStep{
+	{0x0a}, // asl
+	{0xa8}, // tay
+	{0x68}, // pla
+	staMem,
+	{0x68}, // pla
+	staMem,
+	{0xc8}, // iny
+	{0xb1}, // lda (zp),y
+	staMem,
+	{0xc8}, // iny
+	{0xb1}, // lda (zp),y
+	staMem,
+	{0x6c}, // jmp (ind)
+}
+
+// lda lo,x  sta ptr  lda hi,x  sta ptr+1  jmp (ptr)
+var jmpIndirectPattern = []patternStep{
+	ldaAbsIndexed,
+	staMem,
+	ldaAbsIndexed,
+	staMem,
+	{0x6c}, // jmp (ind)
+}
+
+// lda hi,x  pha  lda lo,x  pha  rts
+var rtsDispatchPattern = []patternStep{
+	ldaAbsIndexed,
+	{0x48}, // pha
+	ldaAbsIndexed,
+	{0x48}, // pha
+	{0x60}, // rts
+}
+
+// returns the instructions starting at elem if they match pattern.
+// labels and comments in between are skipped.
+func matchPattern(elem *list.Element, pattern []patternStep) []*Instruction {
+	instrs := make([]*Instruction, 0, len(pattern))
+	for ; elem != nil && len(instrs) < len(pattern); elem = elem.Next() {
+		switch t := elem.Value.(type) {
+		case *LabelStatement, *CommentStatement:
+			continue
+		case *Instruction:
+			if !pattern[len(instrs)].matches(t.OpCode) {
+				return nil
+			}
+			instrs = append(instrs, t)
+		default:
+			return nil
+		}
+	}
+	if len(instrs) != len(pattern) {
+		return nil
+	}
+	return instrs
+}
+
+// walks back count instructions from elem
+func instructionsBack(elem *list.Element, count int) *list.Element {
+	for count > 0 {
+		elem = elem.Prev()
+		if elem == nil {
+			return nil
+		}
+		if _, ok := elem.Value.(*Instruction); ok {
+			count -= 1
+		}
+	}
+	return elem
+}
+
+func (d *Disassembly) isJumpTable(addr int) bool {
+	isJmpTable, ok := d.jumpTables[addr]
+	if ok {
+		return isJmpTable
+	}
+	isJmpTable = d.detectJumpTable(addr)
+	d.jumpTables[addr] = isJmpTable
+	return isJmpTable
+}
+
+// whether the subroutine at addr is a jump engine which expects a table
+// of words after the jsr which calls it
+func (d *Disassembly) detectJumpTable(addr int) bool {
+	m := matchPattern(d.prog.elemAtAddr(addr), jsrDispatchPattern)
+	if m == nil {
+		return false
+	}
+	retAddr := m[3].Value
+	ptr := m[8].Value
+	return m[5].Value == retAddr+1 && m[7].Value == retAddr &&
+		m[10].Value == retAddr && m[11].Value == ptr+1 && m[12].Value == ptr
+}
+
+// a table of code addresses which is indexed at run time
+type jumpTable struct {
+	// address of the low bytes of the entries
+	lo int
+	// address of the high bytes of the entries. lo+1 for a table of words.
+	hi int
+	// entries are one less than the address they jump to, because they
+	// are pushed onto the stack and jumped to with rts
+	rts bool
+	// how many entries the compare which guards the index allows, or 0
+	// when there is none
+	count int
+}
+
+// a jump table and the targets which were disassembled from it
+type followedTable struct {
+	table   jumpTable
+	targets []int
+}
+
+func (t *jumpTable) isWords() bool {
+	return t.hi == t.lo+1
+}
+
+// checks whether the jmp (ind) or rts at elem dispatches through a table
+func (d *Disassembly) matchDispatch(elem *list.Element) *jumpTable {
+	i := elem.Value.(*Instruction)
+	var t *jumpTable
+	var first *list.Element
+	switch i.OpCode {
+	case 0x6c: // jmp (ind)
+		first = instructionsBack(elem, len(jmpIndirectPattern)-1)
+		m := matchPattern(first, jmpIndirectPattern)
+		if m == nil || m[0].RegisterName != m[2].RegisterName {
+			return nil
+		}
+		switch {
+		case m[1].Value == i.Value && m[3].Value == i.Value+1:
+			t = &jumpTable{lo: m[0].Value, hi: m[2].Value}
+		case m[1].Value == i.Value+1 && m[3].Value == i.Value:
+			t = &jumpTable{lo: m[2].Value, hi: m[0].Value}
+		default:
+			return nil
+		}
+	case 0x60: // rts
+		first = instructionsBack(elem, len(rtsDispatchPattern)-1)
+		m := matchPattern(first, rtsDispatchPattern)
+		if m == nil || m[0].RegisterName != m[2].RegisterName {
+			return nil
+		}
+		// the high byte is pushed first
+		t = &jumpTable{lo: m[2].Value, hi: m[0].Value, rts: true}
+	default:
+		return nil
+	}
+	if t.lo < 0x8000 || t.hi < 0x8000 {
+		// table is in RAM
+		return nil
+	}
+	if t.lo == t.hi {
+		return nil
+	}
+	stride := 1
+	if t.isWords() {
+		stride = 2
+	}
+	t.count = d.indexBound(first, first.Value.(*Instruction).RegisterName, stride)
+	return t
+}
+
+// the instruction before elem, skipping labels and comments
+func prevInstruction(elem *list.Element) *list.Element {
+	for elem = elem.Prev(); elem != nil; elem = elem.Prev() {
+		switch elem.Value.(type) {
+		case *LabelStatement, *CommentStatement:
+			continue
+		case *Instruction:
+			return elem
+		}
+		return nil
+	}
+	return nil
+}
+
+// how many instructions before an rts pushesReturnAddress looks for the
+// two pha
+const pushWindow = 6
+
+// whether the rts at elem returns to an address which was pushed with two
+// pha just before it, rather than to a jsr
+func pushesReturnAddress(elem *list.Element) bool {
+	pushes := 0
+	e := prevInstruction(elem)
+	for n := 0; e != nil && n < pushWindow && pushes < 2; n++ {
+		switch e.Value.(*Instruction).OpCode {
+		case 0x48: // pha
+			pushes += 1
+		case 0x68, 0x08, 0x28, 0x9a, 0x20, 0x4c, 0x6c, 0x40, 0x60: // pla, php, plp, txs, jsr, jmp, jmp (ind), rti, rts
+			return false
+		}
+		e = prevInstruction(e)
+	}
+	return pushes == 2
+}
+
+// finds the rts instructions which return to a pushed address that no
+// table could be found for
+func (d *Disassembly) unresolvedRtsDispatches() []int {
+	var addrs []int
+	for e := d.prog.List.Front(); e != nil; e = e.Next() {
+		i, ok := e.Value.(*Instruction)
+		if !ok || i.OpCode != 0x60 || !pushesReturnAddress(e) {
+			continue
+		}
+		if d.matchDispatch(e) == nil {
+			addrs = append(addrs, i.Offset)
+		}
+	}
+	return addrs
+}
+
+// how many instructions before a dispatch indexBound looks for a
+// branch over the exit
+const indexBoundWindow = 4
+
+// works out how many entries a table indexed by reg at elem can have,
+// from the compare which guards the index:
+//
+//	cmp #N  bcs out  asl  tax  lda table,x
+//	cpx #N  bcs out  lda table,x
+//	cmp #N  bcc ok  rts  ok: asl  tax  lda table,x
+//
+// returns 0 when there is no such compare.
+func (d *Disassembly) indexBound(elem *list.Element, reg string, stride int) int {
+	transfer := byte(0xaa) // tax
+	compare := byte(0xe0)  // cpx #
+	if reg == "Y" {
+		transfer = 0xa8 // tay
+		compare = 0xc0  // cpy #
+	}
+	shifted := false
+	start := elem
+	e := prevInstruction(elem)
+	if e != nil && e.Value.(*Instruction).OpCode == transfer {
+		compare = 0xc9 // cmp #
+		start = e
+		e = prevInstruction(e)
+		if e != nil && e.Value.(*Instruction).OpCode == 0x0a { // asl
+			shifted = true
+			start = e
+			e = prevInstruction(e)
+		}
+	}
+	startAddr := start.Value.(*Instruction).Offset
+	for n := 0; e != nil && n < indexBoundWindow; n++ {
+		branch := e.Value.(*Instruction)
+		e = prevInstruction(e)
+		if e == nil {
+			break
+		}
+		target, ok := d.prog.instructionTarget(branch)
+		guards := (branch.OpCode == 0xb0 && n == 0) || // bcs
+			(branch.OpCode == 0x90 && ok && target == startAddr) // bcc
+		cmp := e.Value.(*Instruction)
+		if !guards || cmp.OpCode != compare {
+			continue
+		}
+		if cmp.Value <= 0 {
+			return 0
+		}
+		maxIndex := cmp.Value - 1
+		if shifted {
+			maxIndex *= 2
+		}
+		return maxIndex/stride + 1
+	}
+	return 0
+}
+
+// whether addr is a plausible destination of a jump table entry
+func (d *Disassembly) looksLikeCode(addr int) bool {
+	if addr < 0x8000 {
+		return false
+	}
+	elem := d.prog.elemAtAddr(addr)
+	if elem == nil {
+		return false
+	}
+	if _, ok := elem.Value.(*Instruction); ok {
+		return true
+	}
+	b, err := d.elemAsByte(elem)
+	if err != nil {
+		return false
+	}
+	if d.cdlIsData(addr) || d.hintIsData(addr) {
+		return false
+	}
+	// brk is a valid op code but nobody jumps to it
+	return b != 0x00 && opCodeDataMap[b].addrMode != nilAddr
+}
+
+// how many entries of a table with no compare guarding its index are
+// read before the rest need the code/data log or hints to confirm them
+const jumpTableUnconfirmed = 4
+
+// whether the code/data log or hints agree that the entry of a table at
+// addr goes to target
+func (d *Disassembly) confirmedTableEntry(addr int, target int) bool {
+	if d.cdlFlags(target)&cdlCode != 0 {
+		return true
+	}
+	h := d.hints
+	if h == nil {
+		return false
+	}
+	if inRanges(h.Pointers, addr) || inRanges(h.RtsTables, addr) || inRanges(h.Code, target) {
+		return true
+	}
+	for _, entry := range h.Entries {
+		if entry == target {
+			return true
+		}
+	}
+	return false
+}
+
+// reads entries of t until one does not look like a code address, runs
+// into something else, or the index would no longer fit in a register.
+// a compare guarding the index limits the count, and without one only
+// the first few entries are taken on trust.
+func (d *Disassembly) readJumpTable(t *jumpTable) []int {
+	stride := 1
+	if t.isWords() {
+		stride = 2
+	}
+	var targets []int
+	for n := 0; n*stride < 0x100; n++ {
+		if t.count > 0 && n >= t.count {
+			break
+		}
+		loAddr := t.lo + n*stride
+		hiAddr := t.hi + n*stride
+		if !t.isWords() && ((t.lo < t.hi && loAddr >= t.hi) || (t.hi < t.lo && hiAddr >= t.lo)) {
+			// ran into the other half of the table
+			break
+		}
+		loElem := d.prog.elemAtAddr(loAddr)
+		hiElem := d.prog.elemAtAddr(hiAddr)
+		if n > 0 && (d.prog.elemLabelStmt(loElem) != nil || d.prog.elemLabelStmt(hiElem) != nil) {
+			// something else starts here
+			break
+		}
+		lo, err := d.elemAsByte(loElem)
+		if err != nil {
+			break
+		}
+		hi, err := d.elemAsByte(hiElem)
+		if err != nil {
+			break
+		}
+		target := int(hi)<<8 | int(lo)
+		if t.rts {
+			target += 1
+		}
+		if !d.looksLikeCode(target) {
+			break
+		}
+		if t.count == 0 && n >= jumpTableUnconfirmed && !d.confirmedTableEntry(loAddr, target) {
+			break
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// disassembles the targets of t and labels the table
+func (d *Disassembly) markJumpTable(t *jumpTable, targets []int) {
+	if t.isWords() {
+		// code which reads the high byte of each entry put a label on it
+		d.prog.removeLabelAt(t.hi)
+		// claim the table before its targets are disassembled
+		for n := range targets {
+			_, err := d.markAsDataWord(t.lo + 2*n)
+			if err != nil {
+				d.warn("$%04x: unable to mark jump table entry: %s", t.lo+2*n, err.Error())
+			}
+		}
+	}
+	found := make([]int, 0, len(targets))
+	for n, target := range targets {
+		err := d.markAsInstruction(target)
+		if err != nil {
+			d.warn("$%04x: jump table entry $%04x is not code: %s", t.lo, target, err.Error())
+			continue
+		}
+		if t.isWords() && !t.rts {
+			d.markAsDataWordLabel(t.lo+2*n, "")
+		}
+		_, err = d.prog.getLabelAt(target, "")
+		if err == nil {
+			found = append(found, target)
+		}
+	}
+	d.prog.getLabelAt(t.lo, "")
+	if !t.isWords() {
+		d.prog.getLabelAt(t.hi, "")
+	}
+	d.followedTables = append(d.followedTables, followedTable{*t, found})
+}
+
+// names of the labels at addrs
+func (d *Disassembly) labelNames(addrs []int) string {
+	names := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		name, err := d.prog.getLabelAt(addr, "")
+		if err == nil {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// describes each jump table and jmp (ind). this happens once labels
+// have their final names.
+func (d *Disassembly) commentJumpTables() {
+	for _, addr := range d.inlineTables {
+		elem := d.prog.elemAtAddr(addr)
+		if elem == nil || d.prog.elemLabelStmt(elem) == nil {
+			continue
+		}
+		d.prog.addComment(addr, "jump table")
+	}
+	for _, ft := range d.followedTables {
+		t := ft.table
+		kind := "jump table"
+		if t.rts {
+			kind = "rts jump table, entries are one less than their targets"
+		}
+		loElem := d.prog.elemAtAddr(t.lo)
+		loLabel := d.prog.elemLabelStmt(loElem)
+		if loLabel == nil {
+			continue
+		}
+		if t.isWords() {
+			d.prog.addComment(t.lo, kind)
+			if t.rts {
+				d.prog.addComment(t.lo, "targets: "+d.labelNames(ft.targets))
+			}
+			continue
+		}
+		d.prog.addComment(t.lo, fmt.Sprintf("low bytes of %s", kind))
+		d.prog.addComment(t.lo, "targets: "+d.labelNames(ft.targets))
+		hiElem := d.prog.elemAtAddr(t.hi)
+		if d.prog.elemLabelStmt(hiElem) != nil {
+			d.prog.addComment(t.hi, fmt.Sprintf("high bytes of jump table %s", loLabel.LabelName))
+		}
+	}
+	for _, j := range d.prog.IndirectJumps() {
+		targets := d.prog.indirectJumpTargets(j)
+		if len(targets) == 0 {
+			continue
+		}
+		d.prog.instructionAt(j.Addr).addComment("jumps to " + d.labelNames(targets))
+	}
+}
+
+// looks for jmp (ind) and rts instructions which dispatch through a
+// table, and disassembles the code the table points to. returns whether
+// any new tables were found.
+func (d *Disassembly) findDispatchTables() bool {
+	var tables []*jumpTable
+	for e := d.prog.List.Front(); e != nil; e = e.Next() {
+		i, ok := e.Value.(*Instruction)
+		if !ok || d.dispatches[i.Offset] {
+			continue
+		}
+		if i.OpCode != 0x6c && i.OpCode != 0x60 {
+			continue
+		}
+		d.dispatches[i.Offset] = true
+		t := d.matchDispatch(e)
+		if t != nil {
+			tables = append(tables, t)
+		}
+	}
+	found := false
+	for _, t := range tables {
+		if d.followJumpTable(*t) {
+			found = true
+		}
+	}
+	return found
+}
+
+func (d *Disassembly) followJumpTable(t jumpTable) bool {
+	if d.tables[t] {
+		return false
+	}
+	d.tables[t] = true
+	targets := d.readJumpTable(&t)
+	if len(targets) == 0 {
+		return false
+	}
+	d.markJumpTable(&t, targets)
+	return true
+}
+
+// disassembles the places that jmp (ind) instructions can go, according
+// to the values which are stored to their pointers. returns whether any
+// new code was found.
+func (d *Disassembly) findIndirectJumpTargets() bool {
+	found := false
+	for _, j := range d.prog.IndirectJumps() {
+		for _, target := range j.Targets {
+			if d.indirectTargets[target] || !d.looksLikeCode(target) {
+				continue
+			}
+			d.indirectTargets[target] = true
+			err := d.markAsInstruction(target)
+			if err != nil {
+				d.warn("$%04x: indirect jump target $%04x is not code: %s", j.Addr, target, err.Error())
+				continue
+			}
+			d.prog.getLabelAt(target, "")
+			found = true
+		}
+		for _, t := range j.tables {
+			if d.followJumpTable(t) {
+				found = true
+			}
+		}
+	}
+	return found
+}
+
+// disassembles everything reachable through jump tables. code found in
+// one kind of table can lead to the other kind, so this repeats until
+// nothing new turns up.
+func (d *Disassembly) resolveJumpTables() {
+	d.resolveDynJumpCases()
+	for d.findDispatchTables() || d.findIndirectJumpTargets() {
+		d.resolveDynJumpCases()
+	}
+	for _, addr := range d.inlineTables {
+		elem := d.prog.elemAtAddr(addr)
+		if elem == nil {
+			continue
+		}
+		stmt, ok := elem.Value.(*DataStatement)
+		if ok && stmt.Type == WordDataStmt {
+			d.prog.getLabelAt(addr, "")
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package jamulator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// labels which getLabelAt made up, as opposed to ones from the vectors
+// or from hints, look like Label_c123
+func isMadeUpLabel(name string) bool {
+	return len(name) == len("Label_0000") && strings.HasPrefix(name, "Label_")
+}
+
+// chooses a prefix for a label according to how its address is used.
+// returns "" when nothing is known about it.
+func labelPrefix(target interface{}, called, indexed bool) string {
+	switch t := target.(type) {
+	case *Instruction:
+		if called {
+			return "sub"
+		}
+		return "loc"
+	case *DataStatement:
+		if t.Type == WordDataStmt {
+			return "ptr"
+		}
+		if _, ok := t.dataList.Front().Value.(*StringDataItem); ok {
+			return "str"
+		}
+		if indexed {
+			return "tbl"
+		}
+	}
+	return ""
+}
+
+// renames the labels which the disassembler made up after the way the
+// code uses them: sub_ for subroutines, loc_ for other code, tbl_ for
+// data which is indexed, ptr_ for words and str_ for strings. anything
+// else keeps its Label_ name. names come from addresses, so they are the
+// same every time a ROM is disassembled.
+func (d *Disassembly) nameLabels() {
+	called := make(map[string]bool)
+	indexed := make(map[string]bool)
+	for e := d.prog.List.Front(); e != nil; e = e.Next() {
+		i, ok := e.Value.(*Instruction)
+		if !ok || len(i.LabelName) == 0 {
+			continue
+		}
+		switch {
+		case i.OpCode == 0x20: // jsr
+			called[i.LabelName] = true
+		case i.Type == DirectWithLabelIndexedInstruction:
+			indexed[i.LabelName] = true
+		}
+	}
+
+	renames := make(map[string]string)
+	for e := d.prog.List.Front(); e != nil; e = e.Next() {
+		stmt, ok := e.Value.(*LabelStatement)
+		if !ok || !isMadeUpLabel(stmt.LabelName) || e.Next() == nil {
+			continue
+		}
+		prefix := labelPrefix(e.Next().Value, called[stmt.LabelName], indexed[stmt.LabelName])
+		if len(prefix) == 0 {
+			continue
+		}
+		name := fmt.Sprintf("%s_%04X", prefix, d.prog.Labels[stmt.LabelName])
+		if _, taken := d.prog.Labels[name]; taken {
+			continue
+		}
+		renames[stmt.LabelName] = name
+	}
+	d.prog.renameLabels(renames)
+}
+
+// renames labels and everything which refers to them
+func (p *Program) renameLabels(renames map[string]string) {
+	rename := func(name *string) {
+		if newName, ok := renames[*name]; ok {
+			*name = newName
+		}
+	}
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		switch t := e.Value.(type) {
+		case *LabelStatement:
+			rename(&t.LabelName)
+		case *Instruction:
+			rename(&t.LabelName)
+		case *DataStatement:
+			for de := t.dataList.Front(); de != nil; de = de.Next() {
+				if call, ok := de.Value.(*LabelCall); ok {
+					rename(&call.LabelName)
+				}
+			}
+		}
+	}
+	for oldName, newName := range renames {
+		p.Labels[newName] = p.Labels[oldName]
+		delete(p.Labels, oldName)
+	}
+}
+
+// whether addr is in the internal RAM, its mirrors, or cartridge RAM
+func isRamAddr(addr int) bool {
+	return addr < 0x2000 || (addr >= 0x6000 && addr < 0x8000)
+}
+
+// refers to the RAM which code reads and writes by name, zp_ for zero
+// page and var_ for the rest, unless a hint named it. operands which are
+// encoded as absolute but point into zero page keep their number, since a
+// name would assemble to the shorter zero page form.
+func (d *Disassembly) symbolizeRam() {
+	hinted := make(map[int]string)
+	for name, addr := range d.prog.Variables {
+		if isRamAddr(addr) {
+			hinted[addr] = name
+		}
+	}
+	for e := d.prog.List.Front(); e != nil; e = e.Next() {
+		i, ok := e.Value.(*Instruction)
+		if !ok || !isRamAddr(i.Value) {
+			continue
+		}
+		switch opCodeDataMap[i.OpCode].addrMode {
+		case zeroPageAddr, zeroXIndexAddr, zeroYIndexAddr:
+		case absAddr, absXAddr, absYAddr:
+			if i.Value <= 0xff {
+				continue
+			}
+		default:
+			continue
+		}
+		name, ok := hinted[i.Value]
+		if !ok {
+			name = ramName(i.Value)
+			if _, isLabel := d.prog.Labels[name]; isLabel {
+				continue
+			}
+		}
+		switch i.Type {
+		case DirectInstruction:
+			i.Type = DirectWithLabelInstruction
+		case DirectIndexedInstruction:
+			i.Type = DirectWithLabelIndexedInstruction
+		default:
+			continue
+		}
+		i.LabelName = name
+		d.prog.Variables[name] = i.Value
+	}
+}
+
+// how the code uses an address in RAM
+type ramAccess struct {
+	reads  int
+	writes int
+	// index registers used to reach the address, which suggest an array
+	indexX bool
+	indexY bool
+	// used as the address of a pointer by an indirect instruction
+	pointer bool
+}
+
+func ramName(addr int) string {
+	if addr <= 0xff {
+		return fmt.Sprintf("zp_%02X", addr)
+	}
+	return fmt.Sprintf("var_%04X", addr)
+}
+
+// tallies the reads and writes of every RAM address which instructions
+// refer to directly
+func (p *Program) ramAccesses() map[int]*ramAccess {
+	accesses := make(map[int]*ramAccess)
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		i, ok := e.Value.(*Instruction)
+		if !ok || !isRamAddr(i.Value) {
+			continue
+		}
+		info := opCodeDataMap[i.OpCode]
+		switch info.addrMode {
+		case zeroPageAddr, zeroXIndexAddr, zeroYIndexAddr, absAddr, absXAddr, absYAddr,
+			indirectYIndexAddr, xIndexIndirectAddr, indirectAddr:
+		default:
+			continue
+		}
+		if info.opName == "jmp" && info.addrMode != indirectAddr || info.opName == "jsr" {
+			continue
+		}
+		a, ok := accesses[i.Value]
+		if !ok {
+			a = new(ramAccess)
+			accesses[i.Value] = a
+		}
+		switch info.addrMode {
+		case indirectYIndexAddr, xIndexIndirectAddr, indirectAddr:
+			a.pointer = true
+			a.reads += 1
+			continue
+		case zeroXIndexAddr, absXAddr:
+			a.indexX = true
+		case zeroYIndexAddr, absYAddr:
+			a.indexY = true
+		}
+		switch info.opName {
+		case "sta", "stx", "sty":
+			a.writes += 1
+		case "inc", "dec", "asl", "lsr", "rol", "ror":
+			a.reads += 1
+			a.writes += 1
+		default:
+			a.reads += 1
+		}
+	}
+	return accesses
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, word)
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
+
+// describes an access pattern, such as "2 reads, 1 write, array indexed by X"
+func (a *ramAccess) String() string {
+	str := plural(a.reads, "read") + ", " + plural(a.writes, "write")
+	switch {
+	case a.indexX && a.indexY:
+		str += ", array indexed by X and Y"
+	case a.indexX:
+		str += ", array indexed by X"
+	case a.indexY:
+		str += ", array indexed by Y"
+	}
+	if a.pointer {
+		str += ", pointer"
+	}
+	return str
+}
+
+// puts an equate for every RAM address the code refers to at the top of
+// the program, each with a comment saying how it is used. addresses which
+// no operand could be named after, such as the pointers of indirect
+// instructions, get an equate all the same so the map of RAM is complete.
+func (d *Disassembly) insertRamEquates() {
+	accesses := d.prog.ramAccesses()
+	names := make(map[int]string)
+	for name, addr := range d.prog.Variables {
+		if isRamAddr(addr) {
+			names[addr] = name
+		}
+	}
+	for addr := range accesses {
+		if _, ok := names[addr]; ok {
+			continue
+		}
+		name := ramName(addr)
+		_, isLabel := d.prog.Labels[name]
+		_, isVariable := d.prog.Variables[name]
+		if isLabel || isVariable {
+			continue
+		}
+		names[addr] = name
+		d.prog.Variables[name] = addr
+	}
+	if len(names) == 0 {
+		return
+	}
+	addrs := make([]int, 0, len(names))
+	for addr := range names {
+		addrs = append(addrs, addr)
+	}
+	sort.Ints(addrs)
+	for n := len(addrs) - 1; n >= 0; n-- {
+		stmt := &AssignStatement{VarName: names[addrs[n]], Value: addrs[n]}
+		if a, ok := accesses[addrs[n]]; ok {
+			stmt.Comment = a.String()
+		}
+		d.prog.List.PushFront(stmt)
+	}
+	d.prog.List.PushFront(&CommentStatement{Text: "RAM"})
+}
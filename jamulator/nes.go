@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"image/color"
 	"io"
 	"io/ioutil"
 	"os"
@@ -13,7 +14,7 @@ import (
 	"strings"
 )
 
-func (r *Rom) disassembleToDirWithJam(dest string, jamFd io.Writer) error {
+func (r *Rom) disassembleToDirWithJam(dest string, jamFd io.Writer, opts *DisassembleOptions) error {
 	jam := bufio.NewWriter(jamFd)
 
 	jam.WriteString("# output file name when this rom is assembled\n")
@@ -32,10 +33,21 @@ func (r *Rom) disassembleToDirWithJam(dest string, jamFd io.Writer) error {
 
 	// save the prg rom
 	jam.WriteString("# assembly code\n")
-	program, err := r.Disassemble()
+	program, err := r.Disassemble(opts)
 	if err != nil {
 		return err
 	}
+	for _, warning := range program.Warnings {
+		jam.WriteString(fmt.Sprintf("# warning: %s\n", warning))
+	}
+	if opts != nil && opts.TextTable != nil {
+		err = saveTextTable(path.Join(dest, "text.tbl"), opts.TextTable)
+		if err != nil {
+			return err
+		}
+		jam.WriteString("# encoding of the strings in the assembly code\n")
+		jam.WriteString("tbl=text.tbl\n")
+	}
 	outpath := "prg.asm"
 	err = program.WriteSourceFile(path.Join(dest, outpath))
 	if err != nil {
@@ -47,6 +59,9 @@ func (r *Rom) disassembleToDirWithJam(dest string, jamFd io.Writer) error {
 	}
 	// save the chr banks
 	jam.WriteString("# video data\n")
+	if opts != nil && opts.ChrPng {
+		return r.saveChrPngs(dest, jam, opts.ChrPalette)
+	}
 	for i, bank := range r.ChrRom {
 		buf := bytes.NewBuffer(bank)
 		outpath := fmt.Sprintf("chr%d.chr", i)
@@ -76,7 +91,27 @@ func (r *Rom) disassembleToDirWithJam(dest string, jamFd io.Writer) error {
 	return nil
 }
 
-func (r *Rom) DisassembleToDir(dest string) error {
+func (r *Rom) saveChrPngs(dest string, jam *bufio.Writer, palette color.Palette) error {
+	if palette == nil {
+		palette = DefaultChrPalette
+	}
+	jam.WriteString("# colors of the CHR images, for images which are not indexed\n")
+	jam.WriteString(fmt.Sprintf("chrpalette=%s\n", chrPaletteString(palette)))
+	for i, bank := range r.ChrRom {
+		outpath := fmt.Sprintf("chr%d.png", i)
+		err := SaveChrPng(path.Join(dest, outpath), bank, palette)
+		if err != nil {
+			return err
+		}
+		_, err = jam.WriteString(fmt.Sprintf("chr=%s\n", outpath))
+		if err != nil {
+			return err
+		}
+	}
+	return jam.Flush()
+}
+
+func (r *Rom) DisassembleToDir(dest string, opts *DisassembleOptions) error {
 	// create the folder
 	err := os.Mkdir(dest, 0770)
 	if err != nil {
@@ -93,7 +128,7 @@ func (r *Rom) DisassembleToDir(dest string) error {
 		return err
 	}
 
-	err = r.disassembleToDirWithJam(dest, jamFd)
+	err = r.disassembleToDirWithJam(dest, jamFd, opts)
 	err2 := jamFd.Close()
 	if err != nil {
 		return err
@@ -104,6 +139,19 @@ func (r *Rom) DisassembleToDir(dest string) error {
 	return nil
 }
 
+func saveTextTable(filename string, t *TextTable) error {
+	fd, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = t.Save(fd)
+	err2 := fd.Close()
+	if err != nil {
+		return err
+	}
+	return err2
+}
+
 func removeExtension(filename string) string {
 	return filename[0 : len(filename)-len(path.Ext(filename))]
 }
@@ -114,6 +162,11 @@ func AssembleRom(dir string, ioreader io.Reader) (*Rom, error) {
 	r.PrgRom = make([][]byte, 0)
 	r.ChrRom = make([][]byte, 0)
 
+	// encoding of strings in the prg files which follow
+	var table *TextTable
+	// colors of the chr images which follow
+	chrPalette := DefaultChrPalette
+
 	lineCount := 0
 	for {
 		lineCount += 1
@@ -183,11 +236,11 @@ func AssembleRom(dir string, ioreader io.Reader) (*Rom, error) {
 			}
 		case "prg":
 			prgfile := path.Join(dir, parts[1])
-			programAst, err := ParseFile(prgfile)
+			programAst, err := ParseFileWithTextTable(prgfile, table)
 			if err != nil {
 				return nil, err
 			}
-			program := programAst.ToProgram()
+			program := programAst.ToProgramWithTextTable(table)
 			if len(program.Errors) > 0 {
 				return nil, errors.New(strings.Join(program.Errors, "\n"))
 			}
@@ -201,8 +254,26 @@ func AssembleRom(dir string, ioreader io.Reader) (*Rom, error) {
 				return nil, errors.New(fmt.Sprintf("%s: PRG ROM should be 0x4000 bytes; instead it is 0x%x", prgfile, buf.Len()))
 			}
 			r.PrgRom = append(r.PrgRom, buf.Bytes())
+		case "tbl":
+			table, err = LoadTextTableFile(path.Join(dir, parts[1]))
+			if err != nil {
+				return nil, err
+			}
+		case "chrpalette":
+			chrPalette, err = ParseChrPalette(parts[1])
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Line %d: %s", lineCount, err.Error()))
+			}
 		case "chr":
 			chrfile := path.Join(dir, parts[1])
+			if strings.ToLower(path.Ext(chrfile)) == ".png" {
+				bank, err := LoadChrPng(chrfile, chrPalette)
+				if err != nil {
+					return nil, err
+				}
+				r.ChrRom = append(r.ChrRom, bank)
+				break
+			}
 			chrFd, err := os.Open(chrfile)
 			if err != nil {
 				return nil, err
@@ -3,39 +3,59 @@ package jamulator
 import (
 	"errors"
 	"fmt"
+	"github.com/axw/gollvm/llvm"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 	"strings"
 )
 
-func (rom *Rom) RecompileToBinary(filename string, flags CompileFlags) error {
+// RecompileToBinary compiles the ROM and links it with the runtime into
+// an executable. toolchain may be nil for DefaultToolchain.
+func (rom *Rom) RecompileToBinary(filename string, compileOpts *CompileOptions, opts *DisassembleOptions, toolchain *Toolchain) error {
+	if toolchain == nil {
+		toolchain = DefaultToolchain()
+	}
+	compileOpts = compileOpts.normalize()
+	if !compileOpts.isHost() {
+		return errors.New(fmt.Sprintf("cannot recompile for %s: the runtime is linked for the host, %s. compile to bitcode or assembly and link it yourself instead",
+			compileOpts.Target, llvm.DefaultTargetTriple()))
+	}
+	_, err := toolchain.runtime()
+	if err != nil {
+		return err
+	}
 	if len(rom.PrgRom) != 1 && len(rom.PrgRom) != 2 {
 		return errors.New("only roms with 1-2 prg rom banks are supported")
 	}
 	fmt.Fprintf(os.Stderr, "Disassembling...\n")
-	program, err := rom.Disassemble()
+	program, err := rom.Disassemble(opts)
 	if err != nil {
 		return err
 	}
 	if len(program.Errors) > 0 {
 		return errors.New(strings.Join(program.Errors, "\n"))
 	}
+	if len(program.Warnings) != 0 {
+		fmt.Fprintf(os.Stderr, "Warnings:\n%s\n", strings.Join(program.Warnings, "\n"))
+	}
 
 	tmpDir, err := ioutil.TempDir("", "")
 	if err != nil {
 		return err
 	}
 	defer func() {
-		os.RemoveAll(tmpDir)
+		if toolchain.KeepTemps {
+			fmt.Fprintf(os.Stderr, "Kept temporary files in %s\n", tmpDir)
+		} else {
+			os.RemoveAll(tmpDir)
+		}
 	}()
-	runtimeArchive := "runtime/runtime.a"
 	tmpPrgBitcode := path.Join(tmpDir, "prg.bc")
 	tmpPrgObject := path.Join(tmpDir, "prg.o")
 
 	fmt.Fprintf(os.Stderr, "Decompiling...\n")
-	c, err := program.CompileToFilename(tmpPrgBitcode, flags)
+	c, err := program.CompileToFilename(tmpPrgBitcode, compileOpts)
 	if err != nil {
 		return err
 	}
@@ -46,15 +66,13 @@ func (rom *Rom) RecompileToBinary(filename string, flags CompileFlags) error {
 		fmt.Fprintf(os.Stderr, "Warnings:\n%s\n", strings.Join(c.Warnings, "\n"))
 	}
 	fmt.Fprintf(os.Stderr, "Compiling...\n")
-	out, err := exec.Command("llc", "-o", tmpPrgObject, "-filetype=obj", "-relocation-model=pic", tmpPrgBitcode).CombinedOutput()
-	fmt.Fprint(os.Stderr, string(out))
+	err = toolchain.compileObject(compileOpts, tmpPrgObject, tmpPrgBitcode)
 	if err != nil {
 		return err
 	}
 
 	fmt.Fprintf(os.Stderr, "Linking...\n")
-	out, err = exec.Command("gcc", tmpPrgObject, runtimeArchive, "-lGLEW", "-lGL", "-lSDL", "-lSDL_gfx", "-o", filename).CombinedOutput()
-	fmt.Fprint(os.Stderr, string(out))
+	err = toolchain.link(tmpPrgObject, filename)
 	if err != nil {
 		return err
 	}
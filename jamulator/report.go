@@ -0,0 +1,197 @@
+package jamulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ByteCounts is how the bytes of some PRG ROM were classified.
+type ByteCounts struct {
+	Code int `json:"code"`
+	// bytes which are referred to by a label, are words, or which the
+	// code/data log or hints say are data
+	Data    int `json:"data"`
+	Strings int `json:"strings"`
+	// bytes skipped over with .org
+	OrgFill int `json:"orgFill"`
+	// bytes which nothing was found to refer to
+	Unreached int `json:"unreached"`
+}
+
+func (c *ByteCounts) add(other ByteCounts) {
+	c.Code += other.Code
+	c.Data += other.Data
+	c.Strings += other.Strings
+	c.OrgFill += other.OrgFill
+	c.Unreached += other.Unreached
+}
+
+func (c ByteCounts) total() int {
+	return c.Code + c.Data + c.Strings + c.OrgFill + c.Unreached
+}
+
+type BankReport struct {
+	Bank  int `json:"bank"`
+	Start int `json:"start"`
+	ByteCounts
+}
+
+// DisassemblyReport describes how much of a ROM the disassembler was
+// able to identify, and where it had to guess or give up.
+type DisassemblyReport struct {
+	Banks []*BankReport `json:"banks"`
+	Total ByteCounts    `json:"total"`
+	// addresses of jmp (ind) instructions whose destinations are unknown,
+	// and of rts instructions which return to an unknown pushed address
+	UnresolvedJumps []int `json:"unresolvedJumps"`
+	// addresses which were reached as code but are not a valid op code
+	BadOpCodes []int `json:"badOpCodes"`
+	// addresses which something refers to, but which are in the middle
+	// of an instruction or word so could not be labeled
+	RefusedLabels []int `json:"refusedLabels"`
+}
+
+// sorts addrs and removes duplicates
+func uniqueAddrs(addrs []int) []int {
+	sort.Ints(addrs)
+	out := make([]int, 0, len(addrs))
+	for n, addr := range addrs {
+		if n == 0 || addr != addrs[n-1] {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+func (d *Disassembly) report() *DisassemblyReport {
+	r := &DisassemblyReport{
+		Banks:           make([]*BankReport, len(d.prog.PrgRom)),
+		UnresolvedJumps: []int{},
+		BadOpCodes:      uniqueAddrs(d.badOpCodes),
+		RefusedLabels:   uniqueAddrs(d.prog.refusedLabels),
+	}
+	for n := range r.Banks {
+		r.Banks[n] = &BankReport{Bank: n, Start: d.offset + n*0x4000}
+	}
+	bankCounts := func(addr int) *ByteCounts {
+		n := (addr - d.offset) / 0x4000
+		if n < 0 || n >= len(r.Banks) {
+			return new(ByteCounts)
+		}
+		return &r.Banks[n].ByteCounts
+	}
+
+	// end of the previous statement
+	offset := -1
+	// whether the data since the last instruction has a label
+	referenced := false
+	for e := d.prog.List.Front(); e != nil; e = e.Next() {
+		switch t := e.Value.(type) {
+		case *OrgPseudoOp:
+			for addr := offset; offset >= 0 && addr < t.Value; addr++ {
+				bankCounts(addr).OrgFill += 1
+			}
+			offset = t.Value
+			referenced = false
+		case *LabelStatement:
+			referenced = true
+		case *Instruction:
+			bankCounts(t.Offset).Code += len(t.Payload)
+			offset = t.Offset + len(t.Payload)
+			referenced = false
+		case *DataStatement:
+			addr := t.Offset
+			for de := t.dataList.Front(); de != nil; de = de.Next() {
+				switch item := de.Value.(type) {
+				case *StringDataItem:
+					size := d.textTable.stringSize(item)
+					bankCounts(addr).Strings += size
+					addr += size
+				case *LabelCall:
+					bankCounts(addr).Data += 2
+					addr += 2
+				case *IntegerDataItem:
+					if t.Type == WordDataStmt {
+						bankCounts(addr).Data += 2
+						addr += 2
+					} else if referenced || d.cdlIsData(addr) || d.hintIsData(addr) {
+						bankCounts(addr).Data += 1
+						addr += 1
+					} else {
+						bankCounts(addr).Unreached += 1
+						addr += 1
+					}
+				}
+			}
+			offset = addr
+		}
+	}
+	for _, bank := range r.Banks {
+		r.Total.add(bank.ByteCounts)
+	}
+
+	for _, j := range d.prog.IndirectJumps() {
+		if len(d.prog.indirectJumpTargets(j)) == 0 {
+			r.UnresolvedJumps = append(r.UnresolvedJumps, j.Addr)
+		}
+	}
+	r.UnresolvedJumps = uniqueAddrs(append(r.UnresolvedJumps, d.unresolvedRtsDispatches()...))
+	return r
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+func writeByteCounts(writer io.Writer, name string, c ByteCounts) error {
+	total := c.total()
+	_, err := fmt.Fprintf(writer, "%-14s %6d bytes: code %5.1f%%  data %5.1f%%  strings %5.1f%%  org fill %5.1f%%  unreached %5.1f%%\n",
+		name, total, percent(c.Code, total), percent(c.Data, total), percent(c.Strings, total),
+		percent(c.OrgFill, total), percent(c.Unreached, total))
+	return err
+}
+
+func (r *DisassemblyReport) WriteText(writer io.Writer) (err error) {
+	for _, bank := range r.Banks {
+		err = writeByteCounts(writer, fmt.Sprintf("bank %d $%04x", bank.Bank, bank.Start), bank.ByteCounts)
+		if err != nil {
+			return
+		}
+	}
+	err = writeByteCounts(writer, "total", r.Total)
+	if err != nil {
+		return
+	}
+	lists := []struct {
+		desc  string
+		addrs []int
+	}{
+		{"unresolved indirect jumps", r.UnresolvedJumps},
+		{"bad op codes reached as code", r.BadOpCodes},
+		{"labels refused mid-instruction", r.RefusedLabels},
+	}
+	for _, l := range lists {
+		if len(l.addrs) == 0 {
+			continue
+		}
+		_, err = fmt.Fprintf(writer, "%s: %s\n", l.desc, addrListStr(l.addrs))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (r *DisassemblyReport) WriteJson(writer io.Writer) error {
+	buf, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(buf)
+	return err
+}
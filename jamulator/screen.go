@@ -0,0 +1,154 @@
+package jamulator
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	ScreenWidth  = 256
+	ScreenHeight = 240
+	// 32x30 tile numbers followed by 64 bytes of attributes
+	NametableSize = 0x400
+	// the background half of palette RAM
+	ScreenPaletteSize = 16
+)
+
+// the same colors as PPU_PALETTE_RGB in runtime/ppu.c
+var ppuPaletteRgb = [64]uint32{
+	0x666666, 0x002A88, 0x1412A7, 0x3B00A4, 0x5C007E,
+	0x6E0040, 0x6C0600, 0x561D00, 0x333500, 0x0B4800,
+	0x005200, 0x004F08, 0x00404D, 0x000000, 0x000000,
+	0x000000, 0xADADAD, 0x155FD9, 0x4240FF, 0x7527FE,
+	0xA01ACC, 0xB71E7B, 0xB53120, 0x994E00, 0x6B6D00,
+	0x388700, 0x0C9300, 0x008F32, 0x007C8D, 0x000000,
+	0x000000, 0x000000, 0xFFFEFF, 0x64B0FF, 0x9290FF,
+	0xC676FF, 0xF36AFF, 0xFE6ECC, 0xFE8170, 0xEA9E22,
+	0xBCBE00, 0x88D800, 0x5CE430, 0x45E082, 0x48CDDE,
+	0x4F4F4F, 0x000000, 0x000000, 0xFFFEFF, 0xC0DFFF,
+	0xD3D2FF, 0xE8C8FF, 0xFBC2FF, 0xFEC4EA, 0xFECCC5,
+	0xF7D8A5, 0xE4E594, 0xCFEF96, 0xBDF4AB, 0xB3F3CC,
+	0xB5EBF2, 0xB8B8B8, 0x000000, 0x000000,
+}
+
+func ppuColor(entry byte) color.RGBA {
+	rgb := ppuPaletteRgb[entry%64]
+	return color.RGBA{byte(rgb >> 16), byte(rgb >> 8), byte(rgb), 0xff}
+}
+
+// Screen is everything needed to draw a background the way the PPU
+// would, without scrolling or sprites.
+type Screen struct {
+	// a bank of CHR ROM
+	Chr []byte
+	// which 4KB half of Chr the tiles come from, like bit 4 of PPUCTRL
+	PatternTable int
+	// tile numbers and attributes
+	Nametable []byte
+	// background palettes. entry 0 is the backdrop color.
+	Palette []byte
+}
+
+// Render draws the screen with the same palette lookup as
+// Ppu_bgPaletteEntry in runtime/ppu.c.
+func (s *Screen) Render() (*image.RGBA, error) {
+	if len(s.Nametable) < NametableSize {
+		return nil, errors.New(fmt.Sprintf("nametable should be %d bytes; instead it is %d", NametableSize, len(s.Nametable)))
+	}
+	if len(s.Palette) < ScreenPaletteSize {
+		return nil, errors.New(fmt.Sprintf("palette should be %d bytes; instead it is %d", ScreenPaletteSize, len(s.Palette)))
+	}
+	if s.PatternTable != 0 && s.PatternTable != 1 {
+		return nil, errors.New(fmt.Sprintf("pattern table should be 0 or 1; instead it is %d", s.PatternTable))
+	}
+	patternAddr := s.PatternTable * chrPageSize
+	if patternAddr+chrPageSize > len(s.Chr) {
+		return nil, errors.New(fmt.Sprintf("CHR bank is too small for pattern table %d", s.PatternTable))
+	}
+	img := image.NewRGBA(image.Rect(0, 0, ScreenWidth, ScreenHeight))
+	for ty := 0; ty < ScreenHeight/8; ty++ {
+		for tx := 0; tx < ScreenWidth/8; tx++ {
+			// each attribute byte covers 4x4 tiles, with 2 bits for each
+			// 2x2 tile quadrant
+			attrByte := s.Nametable[0x3c0+ty/4*8+tx/4]
+			shift := uint(ty%4/2*4 + tx%4/2*2)
+			attr := int(attrByte>>shift) & 0x03
+			tile := s.Chr[patternAddr+int(s.Nametable[ty*32+tx])*chrTileSize:]
+			for y := 0; y < 8; y++ {
+				for x := 0; x < 8; x++ {
+					bit := uint(7 - x)
+					pixel := int(tile[y]>>bit)&1 | (int(tile[y+8]>>bit)&1)<<1
+					entry := s.Palette[0]
+					if pixel != 0 {
+						entry = s.Palette[attr*4+pixel]
+					}
+					img.SetRGBA(tx*8+x, ty*8+y, ppuColor(entry))
+				}
+			}
+		}
+	}
+	return img, nil
+}
+
+// RenderToFile draws the screen to filename as a PNG.
+func (s *Screen) RenderToFile(filename string) error {
+	img, err := s.Render()
+	if err != nil {
+		return err
+	}
+	fd, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(fd, img)
+	err2 := fd.Close()
+	if err != nil {
+		return err
+	}
+	return err2
+}
+
+// ReadPrg returns size bytes of PRG ROM starting at the CPU address addr.
+func (r *Rom) ReadPrg(addr, size int) ([]byte, error) {
+	start := 0x10000 - len(r.PrgRom)*0x4000
+	if len(r.PrgRom) == 0 || addr < 0x8000 || addr+size > 0x10000 {
+		return nil, errors.New(fmt.Sprintf("$%04x-$%04x is not in PRG ROM", addr, addr+size-1))
+	}
+	out := make([]byte, size)
+	for n := range out {
+		a := addr + n
+		if a < start {
+			// a single bank is mirrored at $8000 and $c000
+			a += 0x4000
+		}
+		out[n] = r.PrgRom[(a-start)/0x4000][(a-start)%0x4000]
+	}
+	return out, nil
+}
+
+// ReadScreenData reads size bytes for a Screen. spec is either an address
+// in PRG ROM such as $c000, or the name of a file.
+func (r *Rom) ReadScreenData(spec string, size int) ([]byte, error) {
+	if strings.HasPrefix(spec, "$") {
+		addr, err := strconv.ParseUint(spec[1:], 16, 16)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid address: %s", spec))
+		}
+		return r.ReadPrg(int(addr), size)
+	}
+	data, err := ioutil.ReadFile(spec)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < size {
+		return nil, errors.New(fmt.Sprintf("%s: expected at least %d bytes; found %d", spec, size, len(data)))
+	}
+	return data[:size], nil
+}
@@ -0,0 +1,166 @@
+package jamulator
+
+import (
+	"errors"
+	"fmt"
+	"github.com/axw/gollvm/llvm"
+	"os"
+	"path"
+	"strings"
+)
+
+// a nil *CompileOptions is the same as OptLevel 2 for the host, like
+// the command line.
+type CompileOptions struct {
+	Flags CompileFlags
+	// 0 to 3, the same as clang's -O0 to -O3. DisableOptFlag in Flags
+	// makes it 0.
+	OptLevel int
+	// 1 for -Os and 2 for -Oz, which also need OptLevel 2
+	SizeLevel int
+	// LLVM target triple to generate code for, such as
+	// aarch64-linux-gnu or wasm32-unknown-unknown. empty for the host.
+	Target string
+	// CPU to generate code for, such as cortex-a53. empty for the
+	// generic CPU of Target.
+	CPU string
+	// what CompileToFile writes. CompileToFilename picks it from the
+	// file extension instead.
+	Output OutputType
+}
+
+type OutputType int
+
+const (
+	BitcodeOutput OutputType = iota
+	// LLVM IR as text
+	IrOutput
+	// native assembly for Target
+	AssemblyOutput
+)
+
+// OutputTypeForFile picks the output from the extension of filename:
+// .ll for IR, .s for assembly, and bitcode for anything else.
+func OutputTypeForFile(filename string) OutputType {
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".ll":
+		return IrOutput
+	case ".s":
+		return AssemblyOutput
+	}
+	return BitcodeOutput
+}
+
+// the options to compile with, filling in the defaults
+func (o *CompileOptions) normalize() *CompileOptions {
+	n := CompileOptions{OptLevel: 2}
+	if o != nil {
+		n = *o
+	}
+	if n.Flags&DisableOptFlag != 0 {
+		n.OptLevel = 0
+		n.SizeLevel = 0
+	}
+	return &n
+}
+
+// whether code for Target can run here, linked with the runtime
+func (o *CompileOptions) isHost() bool {
+	return o.Target == "" || o.Target == llvm.DefaultTargetTriple()
+}
+
+func (o *CompileOptions) triple() string {
+	if o.Target == "" {
+		return llvm.DefaultTargetTriple()
+	}
+	return o.Target
+}
+
+func (o *CompileOptions) codeGenLevel() llvm.CodeGenOptLevel {
+	switch o.OptLevel {
+	case 0:
+		return llvm.CodeGenLevelNone
+	case 1:
+		return llvm.CodeGenLevelLess
+	case 2:
+		return llvm.CodeGenLevelDefault
+	}
+	return llvm.CodeGenLevelAggressive
+}
+
+// the same thresholds clang uses
+func (o *CompileOptions) inlineThreshold() uint {
+	switch {
+	case o.SizeLevel == 1:
+		return 75
+	case o.SizeLevel > 1:
+		return 25
+	case o.OptLevel > 2:
+		return 275
+	}
+	return 225
+}
+
+func (o *CompileOptions) check() error {
+	if o.OptLevel < 0 || o.OptLevel > 3 {
+		return errors.New(fmt.Sprintf("optimization level should be 0 to 3; instead it is %d", o.OptLevel))
+	}
+	if o.SizeLevel < 0 || o.SizeLevel > 2 {
+		return errors.New(fmt.Sprintf("size level should be 0 to 2; instead it is %d", o.SizeLevel))
+	}
+	if o.SizeLevel > 0 && o.OptLevel != 2 {
+		return errors.New("optimizing for size needs optimization level 2")
+	}
+	return nil
+}
+
+func (o *CompileOptions) createTargetMachine() (llvm.TargetMachine, error) {
+	llvm.InitializeAllTargetInfos()
+	llvm.InitializeAllTargets()
+	llvm.InitializeAllTargetMCs()
+	llvm.InitializeAllAsmPrinters()
+	triple := o.triple()
+	target, err := llvm.GetTargetFromTriple(triple)
+	if err != nil {
+		return llvm.TargetMachine{}, errors.New(fmt.Sprintf("target %s: %s", triple, err.Error()))
+	}
+	machine := target.CreateTargetMachine(triple, o.CPU, "", o.codeGenLevel(), llvm.RelocPIC, llvm.CodeModelDefault)
+	return machine, nil
+}
+
+// runs the standard pass pipeline for the optimization level, the same
+// one that opt -O2 and so on run
+func (c *Compilation) optimize(o *CompileOptions, td llvm.TargetData) {
+	if o.OptLevel == 0 {
+		return
+	}
+	builder := llvm.NewPassManagerBuilder()
+	defer builder.Dispose()
+	builder.SetOptLevel(o.OptLevel)
+	builder.SetSizeLevel(o.SizeLevel)
+	if o.OptLevel > 1 {
+		builder.UseInlinerWithThreshold(o.inlineThreshold())
+	}
+	pass := llvm.NewPassManager()
+	defer pass.Dispose()
+	pass.Add(td)
+	builder.Populate(pass)
+	pass.Run(c.mod)
+}
+
+func (c *Compilation) writeOutput(file *os.File, o *CompileOptions, machine llvm.TargetMachine) error {
+	switch o.Output {
+	case IrOutput:
+		_, err := file.WriteString(c.mod.String())
+		return err
+	case AssemblyOutput:
+		buf, err := machine.EmitToMemoryBuffer(c.mod, llvm.AssemblyFile)
+		if err != nil {
+			return err
+		}
+		defer buf.Dispose()
+		_, err = file.Write(buf.Bytes())
+		return err
+	}
+	return llvm.WriteBitcodeToFile(c.mod, file)
+}
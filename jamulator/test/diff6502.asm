@@ -0,0 +1,190 @@
+; arithmetic, flags, the stack and addressing modes, for TestDifferential
+; to compare the recompiled code with the reference interpreter
+
+.org $c000
+Reset_Routine:
+    jsr Arithmetic
+    jsr Compares
+    jsr Stack
+    jsr Indexed
+    jsr ReadModifyWrite
+    lda #$00
+    sta $2009
+
+; adc, sbc and the logical operations on every value of X
+Arithmetic:
+    ldx #$00
+ArithLoop:
+    stx $00
+    txa
+    clc
+    adc #$7f
+    sta $0200, x
+    txa
+    sec
+    sbc #$80
+    sta $0300, x
+    lda $01
+    adc $00
+    sta $01
+    lda $02
+    sbc $00
+    sta $02
+    txa
+    eor #$5a
+    and #$f0
+    ora #$03
+    sta $0400, x
+    txa
+    asl
+    rol
+    lsr
+    ror
+    sta $0500, x
+    clv
+    inx
+    bne ArithLoop
+    rts
+
+; compares and branches on every value of X
+Compares:
+    ldx #$00
+    ldy #$00
+    lda #$80
+    sta $03
+CmpLoop:
+    txa
+    cmp $03
+    bcc CmpLess
+    bmi CmpNeg
+    iny
+CmpLess:
+    cpx #$40
+    beq CmpEqual
+    bpl CmpNext
+    dey
+CmpNeg:
+    cpy $03
+    bcs CmpNext
+    iny
+CmpEqual:
+    cpx $03
+    bne CmpNext
+    bit $03
+CmpNext:
+    bit $0200
+    sty $04
+    inx
+    bne CmpLoop
+    rts
+
+; pushes and pulls, and changing the stack pointer
+Stack:
+    tsx
+    stx $05
+    lda #$11
+    pha
+    lda #$22
+    pha
+    lda #$c3
+    pha
+    plp
+    pla
+    sta $06
+    pla
+    sta $07
+    sec
+    sei
+    cli
+    sed
+    cld
+    ldx #$80
+    txs
+    lda #$33
+    pha
+    tsx
+    stx $08
+    ldx $05
+    txs
+    jsr Nested
+    rts
+Nested:
+    tsx
+    stx $09
+    jsr Leaf
+    rts
+Leaf:
+    tsx
+    stx $0a
+    rts
+
+; zero page indexing wraps around, and absolute indexing can cross pages
+Indexed:
+    ldx #$f0
+    lda #$44
+    sta $20, x
+    lda $20, x
+    sta $11
+    ldy #$08
+    ldx $10, y
+    stx $12
+    ldy #$34
+    sty $20, x
+    ldy $20, x
+    sty $13
+    lda #$f8
+    sta $30
+    lda #$06
+    sta $31
+    ldy #$10
+    lda #$55
+    sta ($30), y
+    lda ($30), y
+    sta $14
+    ldx #$10
+    lda $06f8, x
+    sta $15
+    ldy $06f8, x
+    sty $16
+    lda $c400
+    sta $32
+    lda $c401
+    sta $33
+    jmp ($0032)
+IndirectTarget:
+    rts
+
+; shifts, increments and decrements in memory
+ReadModifyWrite:
+    lda #$81
+    sta $40
+    sta $0641
+    asl $40
+    rol $40
+    lsr $0641
+    ror $0641
+    ldx #$01
+    asl $40, x
+    inc $40, x
+    dec $40, x
+    inc $0640, x
+    dec $0640, x
+    asl $0640, x
+    rol $0640, x
+    inc $40
+    dec $41
+    inc $0641
+    dec $0641
+    rts
+
+IRQ_Routine:
+NMI_Routine:
+    rti
+
+.org $c400
+    .dw IndirectTarget
+
+.org $fffa
+    .dw NMI_Routine
+    .dw Reset_Routine
+    .dw IRQ_Routine
@@ -0,0 +1,144 @@
+; jump tables which the disassembler should be able to follow
+
+.org $c000
+Reset_Routine:
+    ldx #$01
+    jsr SplitDispatch
+    ldy #$02
+    jsr WordDispatch
+    ldx #$00
+    jsr RtsDispatch
+    ldx #$02
+    jsr RtsWordDispatch
+    jsr ConstDispatch
+    lda #$48
+    sta $06
+    lda #$c1
+    sta $07
+    jsr StoredDispatch
+    ldy #$02
+    jsr LoadDispatch
+    lda #$00
+    sta $2009
+
+; low and high bytes in separate tables
+SplitDispatch:
+    lda $c200, x
+    sta $00
+    lda $c202, x
+    sta $01
+    jmp ($0000)
+
+; table of words
+WordDispatch:
+    lda $c210, y
+    sta $02
+    lda $c211, y
+    sta $03
+    jmp ($0002)
+
+; pushes the target minus one and returns to it
+RtsDispatch:
+    lda $c220, x
+    pha
+    lda $c222, x
+    pha
+    rts
+
+RtsWordDispatch:
+    lda $c231, x
+    pha
+    lda $c230, x
+    pha
+    rts
+
+; pointer set to a constant
+ConstDispatch:
+    lda #$40
+    sta $04
+    lda #$c1
+    sta $05
+    jmp ($0004)
+
+; pointer set by the caller
+StoredDispatch:
+    jmp ($0006)
+
+; pointer loaded from a table of words through x and a
+LoadDispatch:
+    lda $c240, y
+    ldx $c241, y
+    sta $08
+    stx $09
+    jmp ($0008)
+
+.org $c100
+SplitA:
+    lda #$01
+    rts
+.org $c108
+SplitB:
+    lda #$02
+    rts
+.org $c110
+WordA:
+    lda #$03
+    rts
+.org $c118
+WordB:
+    lda #$04
+    rts
+.org $c120
+RtsA:
+    lda #$05
+    rts
+.org $c128
+RtsB:
+    lda #$06
+    rts
+.org $c130
+RtsWordA:
+    lda #$07
+    rts
+.org $c138
+RtsWordB:
+    lda #$08
+    rts
+.org $c140
+ConstA:
+    lda #$09
+    rts
+.org $c148
+StoredA:
+    lda #$0a
+    rts
+.org $c150
+LoadA:
+    lda #$0b
+    rts
+.org $c158
+LoadB:
+    lda #$0c
+    rts
+
+.org $c200
+    .db $00, $08
+    .db $c1, $c1
+.org $c210
+    .dw WordA, WordB
+.org $c220
+    .db $c1, $c1
+    .db $1f, $27
+.org $c230
+    .dw $c12f, $c137
+.org $c240
+    .dw LoadA, LoadB
+
+IRQ_Routine:
+NMI_Routine:
+    rti
+
+.org $fffa
+    .dw NMI_Routine
+    .dw Reset_Routine
+    .dw IRQ_Routine
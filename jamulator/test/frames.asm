@@ -0,0 +1,180 @@
+; times a loop against vblank, then draws a striped background and
+; scrolls it a pixel each frame, for TestRecompiledRoms to hash. roms/frames.nes is built from frames.jam
+
+.org $c000
+Reset_Routine:
+    sei
+    cld
+    ldx #$ff
+    txs
+    lda #$00
+    sta $2000
+    sta $2001
+WaitVblank1:
+    bit $2002
+    bpl WaitVblank1
+WaitVblank2:
+    bit $2002
+    bpl WaitVblank2
+
+    ; count in $01 to $04 how many times a run of 530 cycles fits in the
+    ; frame after each of four vblanks. $2002 is read 245 cycles into the
+    ; run, and then 266 more go by without any I/O, so this is only right
+    ; if cycles are counted before the read, and if none are lost when
+    ; there are more than 255 of them
+    ldx #$00
+CountFrame:
+    bit $2002
+    bpl CountFrame
+    lda #$00
+    sta $01, x
+CountLoop:
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    lda $2002
+    tay
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $0300, x
+    inc $01, x
+    tya
+    bmi CountedFrame
+    jmp CountLoop
+CountedFrame:
+    inx
+    cpx #$04
+    beq CountedFrames
+    jmp CountFrame
+CountedFrames:
+
+    ; background and sprite palettes
+    lda #$3f
+    sta $2006
+    lda #$00
+    sta $2006
+    ldx #$00
+PaletteLoop:
+    lda Palette, x
+    sta $2007
+    inx
+    cpx #$20
+    bne PaletteLoop
+
+    ; nametable 0 and its attributes: tiles 0 to 3 in turn
+    lda #$20
+    sta $2006
+    lda #$00
+    sta $2006
+    ldy #$04
+    ldx #$00
+NametableLoop:
+    txa
+    and #$03
+    sta $2007
+    inx
+    bne NametableLoop
+    dey
+    bne NametableLoop
+
+    lda #$00
+    sta $00
+    sta $2005
+    sta $2005
+    ; NMI on every vblank, and show the background
+    lda #$80
+    sta $2000
+    lda #$0a
+    sta $2001
+Forever:
+    jmp Forever
+
+; $00 counts frames and is the horizontal scroll
+NMI_Routine:
+    inc $00
+    lda $00
+    sta $2005
+    lda #$00
+    sta $2005
+    rti
+
+IRQ_Routine:
+    rti
+
+Palette:
+    .db $0f, $11, $21, $31, $0f, $16, $26, $36
+    .db $0f, $19, $29, $39, $0f, $13, $23, $33
+    .db $0f, $11, $21, $31, $0f, $16, $26, $36
+    .db $0f, $19, $29, $39, $0f, $13, $23, $33
+
+.org $fffa
+    .dw NMI_Routine
+    .dw Reset_Routine
+    .dw IRQ_Routine
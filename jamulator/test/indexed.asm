@@ -0,0 +1,104 @@
+; indexed stores into RAM and the PPU registers, with index values which
+; the compiler knows and which it does not, for TestDifferential
+
+.org $c000
+Reset_Routine:
+    ; known index into RAM
+    ldx #$05
+    lda #$11
+    sta $0300, x
+    ; a zero page index wraps around within zero page, to $08
+    ldx #$10
+    lda #$22
+    sta $f8, x
+    ; an absolute index wraps around past $ffff, to $0009
+    ldx #$11
+    lda #$33
+    sta $fff8, x
+    ; past $0800 is a mirror of RAM, so this is $0010
+    ldx #$20
+    lda #$44
+    sta $07f0, x
+
+    ; unknown index into RAM. the compiler forgets what is stored to RAM
+    lda #$03
+    sta $00
+    ldx $00
+    lda #$55
+    sta $0300, x
+    sta $f8, x
+    ldy $00
+    sty $fe, x
+    jsr Clobber
+    ; unknown again after a subroutine
+    lda #$66
+    sta $0300, x
+
+    ; known index into the PPU registers: $2006 and $2007
+    ldx #$06
+    lda #$3f
+    sta $2000, x
+    lda #$00
+    sta $2000, x
+    inx
+    lda #$0f
+    sta $2000, x
+    ; unknown index into the PPU registers, $2001 and a mirror of $2001
+    lda #$01
+    sta $00
+    ldx $00
+    lda #$00
+    sta $2000, x
+    sta $2ff8, x
+
+    ; print what was stored to RAM
+    ldx #$00
+Print:
+    lda $00, x
+    jsr PrintHex
+    inx
+    cpx #$12
+    bne Print
+    ldx #$00
+PrintPage3:
+    lda $0300, x
+    jsr PrintHex
+    inx
+    cpx #$08
+    bne PrintPage3
+    lda #$0a
+    sta $2008
+    lda #$00
+    sta $2009
+
+Clobber:
+    ldx #$00
+    rts
+
+; prints a as two hex digits
+PrintHex:
+    pha
+    lsr
+    lsr
+    lsr
+    lsr
+    jsr PrintDigit
+    pla
+    and #$0f
+PrintDigit:
+    cmp #$0a
+    bcc PrintDigit_decimal
+    adc #$06
+PrintDigit_decimal:
+    adc #$30
+    sta $2008
+    rts
+
+IRQ_Routine:
+NMI_Routine:
+    rti
+
+.org $fffa
+    .dw NMI_Routine
+    .dw Reset_Routine
+    .dw IRQ_Routine
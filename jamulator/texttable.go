@@ -0,0 +1,359 @@
+package jamulator
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// TextTable is a game's character encoding, in the .tbl format that ROM
+// hacking tools use. An entry maps one or more bytes to some text, which
+// can be a single character, several characters, or a name for a control
+// code such as [name].
+type TextTable struct {
+	toText  map[string]string
+	toBytes map[string][]byte
+	// byte sequences which end a string
+	ends map[string]bool
+	// lengths of the longest byte sequence and text, for greedy matching
+	maxBytes int
+	maxText  int
+	// entries in the order they were read, so the table can be saved
+	lines []string
+}
+
+// ReadTextTable parses a .tbl file. Each line is one of:
+//
+//	XX=text      the bytes XX, given in hex, are written as text
+//	*XX          the bytes XX are a new line
+//	*XX=text     the bytes XX are text followed by a new line
+//	/XX          the bytes XX end a string
+//	/XX=text     the bytes XX end a string, written as text
+//
+// lines which are blank or start with # or ; are ignored.
+func ReadTextTable(ioreader io.Reader) (*TextTable, error) {
+	reader := bufio.NewReader(ioreader)
+	t := &TextTable{
+		toText:  make(map[string]string),
+		toBytes: make(map[string][]byte),
+		ends:    make(map[string]bool),
+	}
+	lineCount := 0
+	for {
+		lineCount += 1
+		rawLine, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		line := strings.TrimRight(rawLine, "\r\n")
+		if len(line) > 0 && line[0] != '#' && line[0] != ';' {
+			parseErr := t.parseLine(line)
+			if parseErr != nil {
+				return nil, errors.New(fmt.Sprintf("Line %d: %s", lineCount, parseErr.Error()))
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return t, nil
+}
+
+func (t *TextTable) parseLine(line string) error {
+	kind := line[0]
+	entry := line
+	if kind == '*' || kind == '/' {
+		entry = line[1:]
+	}
+	parts := strings.SplitN(entry, "=", 2)
+	code, err := hex.DecodeString(strings.TrimSpace(parts[0]))
+	if err != nil || len(code) == 0 {
+		return errors.New(fmt.Sprintf("invalid hex: %s", parts[0]))
+	}
+	var text string
+	if len(parts) == 2 {
+		text = parts[1]
+	} else if kind != '*' && kind != '/' {
+		return errors.New("expected =")
+	}
+	switch kind {
+	case '*':
+		text += "\n"
+	case '/':
+		if len(text) == 0 {
+			text = "[end]"
+		}
+		t.ends[string(code)] = true
+	}
+	if len(text) == 0 {
+		return errors.New("entry has no text")
+	}
+	if _, ok := t.toText[string(code)]; ok {
+		return errors.New(fmt.Sprintf("duplicate entry for %X", code))
+	}
+	t.toText[string(code)] = text
+	// when several codes have the same text, the first one is used
+	// to encode it
+	if _, ok := t.toBytes[text]; !ok {
+		t.toBytes[text] = code
+	}
+	if len(code) > t.maxBytes {
+		t.maxBytes = len(code)
+	}
+	if len(text) > t.maxText {
+		t.maxText = len(text)
+	}
+	t.lines = append(t.lines, line)
+	return nil
+}
+
+func LoadTextTableFile(filename string) (*TextTable, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	t, err := ReadTextTable(fd)
+	err2 := fd.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err2 != nil {
+		return nil, err2
+	}
+	return t, nil
+}
+
+// Save writes the table back out in the .tbl format.
+func (t *TextTable) Save(writer io.Writer) error {
+	w := bufio.NewWriter(writer)
+	for _, line := range t.lines {
+		_, err := w.WriteString(line + "\n")
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// matches the longest entry at the start of data. returns the text and
+// how many bytes it covers, or 0 if no entry matches.
+func (t *TextTable) decodeOne(data []byte) (string, int) {
+	n := t.maxBytes
+	if n > len(data) {
+		n = len(data)
+	}
+	for ; n > 0; n-- {
+		if text, ok := t.toText[string(data[:n])]; ok {
+			return text, n
+		}
+	}
+	return "", 0
+}
+
+// Encode converts text to bytes, matching the longest entries first.
+func (t *TextTable) Encode(text string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for len(text) > 0 {
+		n := t.maxText
+		if n > len(text) {
+			n = len(text)
+		}
+		for ; n > 0; n-- {
+			if code, ok := t.toBytes[text[:n]]; ok {
+				buf.Write(code)
+				break
+			}
+		}
+		if n == 0 {
+			return nil, errors.New(fmt.Sprintf("no entry in text table for %q", text[:1]))
+		}
+		text = text[n:]
+	}
+	return buf.Bytes(), nil
+}
+
+// a run of bytes which the table decodes to text
+type textRun struct {
+	start int
+	end   int
+	text  string
+}
+
+// finds the runs of data which decode to text of at least minLen bytes
+// and encode back to the very same bytes. runs stop after a code which
+// ends a string.
+func (t *TextTable) findText(data []byte, minLen int) []textRun {
+	runs := make([]textRun, 0)
+	flush := func(run textRun) {
+		if run.end-run.start < minLen {
+			return
+		}
+		encoded, err := t.Encode(run.text)
+		if err != nil || !bytes.Equal(encoded, data[run.start:run.end]) {
+			return
+		}
+		runs = append(runs, run)
+	}
+	run := textRun{}
+	for pos := 0; pos < len(data); {
+		text, n := t.decodeOne(data[pos:])
+		if n == 0 {
+			flush(run)
+			pos += 1
+			run = textRun{start: pos, end: pos}
+			continue
+		}
+		run.text += text
+		pos += n
+		run.end = pos
+		if t.ends[string(data[pos-n:pos])] {
+			flush(run)
+			run = textRun{start: pos, end: pos}
+		}
+	}
+	flush(run)
+	return runs
+}
+
+// the number of bytes a string data item assembles to
+func (t *TextTable) stringSize(s *StringDataItem) int {
+	if t == nil {
+		return len(*s)
+	}
+	encoded, err := t.Encode(string(*s))
+	if err != nil {
+		return len(*s)
+	}
+	return len(encoded)
+}
+
+func (d *Disassembly) groupTableStrings() {
+	const threshold = 5
+	e := d.prog.List.Front()
+	for e != nil {
+		// collect a run of single bytes not interrupted by labels
+		elems := make([]*list.Element, 0)
+		data := make([]byte, 0)
+		hasComment := false
+		for ; e != nil; e = e.Next() {
+			stmt, ok := e.Value.(*DataStatement)
+			if !ok || stmt.Type != ByteDataStmt || stmt.dataList.Len() != 1 {
+				break
+			}
+			if len(elems) > 0 {
+				// a comment in the middle would be lost
+				if _, hasComment = d.prog.Comments[stmt.Offset]; hasComment {
+					break
+				}
+			}
+			v, ok := stmt.dataList.Front().Value.(*IntegerDataItem)
+			if !ok {
+				break
+			}
+			elems = append(elems, e)
+			data = append(data, byte(*v))
+		}
+		for _, run := range d.textTable.findText(data, threshold) {
+			firstStmt := elems[run.start].Value.(*DataStatement)
+			firstStmt.dataList = list.New()
+			firstStmt.table = d.textTable
+			tmp := StringDataItem(run.text)
+			firstStmt.dataList.PushBack(&tmp)
+			for _, elToDel := range elems[run.start+1 : run.end] {
+				d.prog.List.Remove(elToDel)
+			}
+		}
+		if e != nil && !hasComment {
+			e = e.Next()
+		}
+	}
+}
+
+// writes s as a quoted string, with a backslash before quotes and
+// backslashes and new lines as \n
+func quoteString(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	s = strings.Replace(s, "\n", "\\n", -1)
+	return "\"" + s + "\""
+}
+
+// the reverse of quoteString, without the quotes
+func unescapeString(s string) string {
+	buf := new(bytes.Buffer)
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			buf.WriteByte(s[i])
+			continue
+		}
+		i += 1
+		switch s[i] {
+		case 'n':
+			buf.WriteByte('\n')
+		default:
+			buf.WriteByte(s[i])
+		}
+	}
+	return buf.String()
+}
+
+// strings encoded with a text table can have escaped quotes in them. the
+// lexer only knows plain strings, as in a program without a table, where
+// a backslash before a quote is an ordinary character. so before lexing
+// a program with a table, its escaped quotes are swapped for
+// escapedQuote, a noncharacter which no text has, and back afterwards.
+const escapedQuote = "\ufdd0"
+
+// whether the program being parsed has a text table
+var parseEscapes bool
+
+func hideEscapedQuotes(reader io.Reader) (io.Reader, error) {
+	src, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	inString := false
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case inString && c == '\\' && i+1 < len(src) && src[i+1] == '"':
+			buf.WriteString(escapedQuote)
+			i += 1
+			continue
+		case inString && c == '\\' && i+1 < len(src) && src[i+1] == '\\':
+			buf.WriteString("\\\\")
+			i += 1
+			continue
+		case inString && (c == '"' || c == '\n'):
+			inString = false
+		case !inString && c == '"':
+			inString = true
+		case !inString && c == ';':
+			// a comment, which can have quotes of its own
+			for i < len(src) && src[i] != '\n' {
+				buf.WriteByte(src[i])
+				i += 1
+			}
+			i -= 1
+			continue
+		}
+		buf.WriteByte(c)
+	}
+	return buf, nil
+}
+
+// the text of a quoted string as it was written
+func restoreEscapedQuotes(s string) string {
+	if !parseEscapes {
+		return s
+	}
+	return strings.Replace(s, escapedQuote, "\\\"", -1)
+}
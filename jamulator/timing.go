@@ -0,0 +1,504 @@
+package jamulator
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// number of CPU cycles available during vertical blank on NTSC
+const VblankCycles = 2273
+
+// number of cycles the CPU spends entering an interrupt handler
+const interruptCycles = 7
+
+// CycleCount is the range of cycles a piece of code can take.
+type CycleCount struct {
+	Min int
+	Max int
+	// false when Max could not be determined, for example because of
+	// a loop with unknown bounds or an indirect jump
+	Bounded bool
+}
+
+type SubroutineTiming struct {
+	Name   string
+	Addr   int
+	Cycles CycleCount
+	// false if no path through the code reaches an rts or rti
+	Returns bool
+	// addresses of instructions which start a loop with unknown bounds
+	Loops []int
+	// addresses of instructions whose destination could not be followed
+	// statically, such as indirect jumps or code that runs into data
+	Unknown []int
+	// names of the subroutines called with jsr
+	Calls []string
+}
+
+type TimingReport struct {
+	Subroutines []*SubroutineTiming
+	// the subroutine pointed to by the NMI vector, or nil if there is none
+	Nmi *SubroutineTiming
+}
+
+// cost of the paths from an instruction to the end of its subroutine
+type cyclePath struct {
+	min     int
+	max     int
+	bounded bool
+	// whether any path reaches the end of the subroutine
+	exits bool
+}
+
+var deadEnd = cyclePath{}
+
+func (p cyclePath) plus(min, max int) cyclePath {
+	p.min += min
+	p.max += max
+	return p
+}
+
+// p followed by q
+func (p cyclePath) then(q cyclePath) cyclePath {
+	if !p.exits || !q.exits {
+		return deadEnd
+	}
+	return cyclePath{p.min + q.min, p.max + q.max, p.bounded && q.bounded, true}
+}
+
+// either p or q
+func (p cyclePath) or(q cyclePath) cyclePath {
+	if !p.exits {
+		q.bounded = false
+		return q
+	}
+	if !q.exits {
+		p.bounded = false
+		return p
+	}
+	r := cyclePath{p.min, p.max, p.bounded && q.bounded, true}
+	if q.min < r.min {
+		r.min = q.min
+	}
+	if q.max > r.max {
+		r.max = q.max
+	}
+	return r
+}
+
+type timingAnalyzer struct {
+	prog       *Program
+	labelNames map[int]string
+	subs       map[int]*SubroutineTiming
+	// subroutines whose analysis is in progress
+	analyzing map[int]bool
+}
+
+// an instruction in the walk of a subroutine, and how control leaves it
+type timingNode struct {
+	edges []timingEdge
+	// leaving the subroutine at this instruction, such as with rts
+	exit cyclePath
+	// Tarjan's strongly connected components
+	index   int
+	lowlink int
+	onStack bool
+	// the cost from here to the end of the subroutine, once its
+	// component is solved
+	path cyclePath
+}
+
+type timingEdge struct {
+	to int
+	// of the instruction, and of the subroutine it calls if it is a jsr
+	cost cyclePath
+}
+
+// the instructions of a subroutine are walked once each, and loops are
+// collapsed into their strongly connected components, which are solved
+// after everything they lead to.
+type subroutineWalk struct {
+	a     *timingAnalyzer
+	sub   *SubroutineTiming
+	nodes map[int]*timingNode
+	stack []int
+	index int
+}
+
+func (p *Program) instructionAt(addr int) *Instruction {
+	elem := p.elemAtAddr(addr)
+	if elem == nil {
+		return nil
+	}
+	i, ok := elem.Value.(*Instruction)
+	if !ok {
+		return nil
+	}
+	return i
+}
+
+// returns the address an instruction jumps or branches to
+func (p *Program) instructionTarget(i *Instruction) (int, bool) {
+	if len(i.LabelName) == 0 {
+		return i.Value, true
+	}
+	return p.getSymbol(i.LabelName, i.Offset)
+}
+
+// returns the address a vector such as 0xfffa points to
+func (p *Program) vectorTarget(addr int) (int, bool) {
+	elem := p.elemAtAddr(addr)
+	if elem == nil {
+		return 0, false
+	}
+	stmt, ok := elem.Value.(*DataStatement)
+	if !ok || stmt.Type != WordDataStmt {
+		return 0, false
+	}
+	switch t := stmt.dataList.Front().Value.(type) {
+	case *LabelCall:
+		target, ok := p.Labels[t.LabelName]
+		return target, ok
+	case *IntegerDataItem:
+		return int(*t), true
+	}
+	return 0, false
+}
+
+func (a *timingAnalyzer) subroutine(addr int) *SubroutineTiming {
+	sub, ok := a.subs[addr]
+	if ok {
+		return sub
+	}
+	name, ok := a.labelNames[addr]
+	if !ok {
+		name = fmt.Sprintf("$%04x", addr)
+	}
+	sub = &SubroutineTiming{
+		Name: name,
+		Addr: addr,
+	}
+	a.subs[addr] = sub
+	a.analyzing[addr] = true
+	w := &subroutineWalk{
+		a:     a,
+		sub:   sub,
+		nodes: make(map[int]*timingNode),
+	}
+	path := w.visit(addr).path
+	delete(a.analyzing, addr)
+	sub.Cycles = CycleCount{path.min, path.max, path.bounded}
+	sub.Returns = path.exits
+	sort.Ints(sub.Loops)
+	sort.Ints(sub.Unknown)
+	return sub
+}
+
+func appendAddr(list []int, addr int) []int {
+	for _, x := range list {
+		if x == addr {
+			return list
+		}
+	}
+	return append(list, addr)
+}
+
+func appendName(list []string, name string) []string {
+	for _, x := range list {
+		if x == name {
+			return list
+		}
+	}
+	return append(list, name)
+}
+
+func (w *subroutineWalk) visit(addr int) *timingNode {
+	node := &timingNode{index: w.index, lowlink: w.index, onStack: true}
+	w.index++
+	w.nodes[addr] = node
+	w.stack = append(w.stack, addr)
+	w.addEdges(addr, node)
+	for _, e := range node.edges {
+		succ, ok := w.nodes[e.to]
+		if !ok {
+			succ = w.visit(e.to)
+			if succ.lowlink < node.lowlink {
+				node.lowlink = succ.lowlink
+			}
+		} else if succ.onStack && succ.index < node.lowlink {
+			node.lowlink = succ.index
+		}
+	}
+	if node.lowlink == node.index {
+		n := len(w.stack) - 1
+		for w.stack[n] != addr {
+			n--
+		}
+		w.solve(w.stack[n:])
+		w.stack = w.stack[:n]
+	}
+	return node
+}
+
+// the paths of the instructions in a component, whose first instruction
+// is the one the walk entered it at. the nodes of the component are the
+// ones still on the stack.
+func (w *subroutineWalk) solve(component []int) {
+	loop := len(component) > 1
+	for _, addr := range component {
+		node := w.nodes[addr]
+		for _, e := range node.edges {
+			if e.to == addr {
+				loop = true
+			}
+		}
+		node.path = w.pathOut(node)
+	}
+	if loop {
+		w.sub.Loops = appendAddr(w.sub.Loops, component[0])
+		// going around the loop any number of times is a path too, so
+		// the maximum is unknown. the minimum can take the shortest way
+		// through the loop to an exit.
+		for _, addr := range component {
+			w.nodes[addr].path.bounded = false
+		}
+		for changed := true; changed; {
+			changed = false
+			for _, addr := range component {
+				node := w.nodes[addr]
+				for _, e := range node.edges {
+					succ := w.nodes[e.to]
+					if !succ.onStack {
+						continue
+					}
+					p := e.cost.then(succ.path)
+					if !p.exits {
+						continue
+					}
+					if !node.path.exits {
+						node.path = p
+						node.path.bounded = false
+						changed = true
+					} else if p.min < node.path.min {
+						node.path.min = p.min
+						changed = true
+					}
+				}
+			}
+		}
+	}
+	for _, addr := range component {
+		w.nodes[addr].onStack = false
+	}
+}
+
+// either way out of node that does not stay in its component
+func (w *subroutineWalk) pathOut(node *timingNode) cyclePath {
+	var path cyclePath
+	found := false
+	add := func(p cyclePath) {
+		if found {
+			path = path.or(p)
+		} else {
+			path = p
+			found = true
+		}
+	}
+	if node.exit.exits {
+		add(node.exit)
+	}
+	for _, e := range node.edges {
+		succ := w.nodes[e.to]
+		if !succ.onStack {
+			add(e.cost.then(succ.path))
+		}
+	}
+	if !found {
+		return deadEnd
+	}
+	return path
+}
+
+func (w *subroutineWalk) addEdge(node *timingNode, to int, cost cyclePath) {
+	node.edges = append(node.edges, timingEdge{to, cost})
+}
+
+func (w *subroutineWalk) addEdges(addr int, node *timingNode) {
+	p := w.a.prog
+	i := p.instructionAt(addr)
+	if i == nil {
+		w.sub.Unknown = appendAddr(w.sub.Unknown, addr)
+		return
+	}
+	info := opCodeDataMap[i.OpCode]
+	next := addr + len(i.Payload)
+	cost := cyclePath{info.cycles, info.cycles, true, true}
+	switch info.opName {
+	case "rts", "rti":
+		node.exit = cost
+		return
+	case "brk":
+		w.sub.Unknown = appendAddr(w.sub.Unknown, addr)
+		return
+	case "jmp":
+		if info.addrMode == indirectAddr {
+			w.sub.Unknown = appendAddr(w.sub.Unknown, addr)
+			node.exit = cyclePath{info.cycles, info.cycles, false, true}
+			return
+		}
+		target, ok := p.instructionTarget(i)
+		if !ok {
+			w.sub.Unknown = appendAddr(w.sub.Unknown, addr)
+			return
+		}
+		w.addEdge(node, target, cost)
+		return
+	case "jsr":
+		target, ok := p.instructionTarget(i)
+		if !ok {
+			w.sub.Unknown = appendAddr(w.sub.Unknown, addr)
+			return
+		}
+		var call cyclePath
+		if p.instructionAt(target) == nil {
+			// code outside the program, such as in RAM. assume it returns.
+			w.sub.Unknown = appendAddr(w.sub.Unknown, addr)
+			call = cyclePath{0, 0, false, true}
+		} else if w.a.analyzing[target] {
+			// recursion. we cannot know how deep it goes.
+			w.sub.Loops = appendAddr(w.sub.Loops, addr)
+			call = cyclePath{0, 0, false, true}
+		} else {
+			callee := w.a.subroutine(target)
+			call = cyclePath{callee.Cycles.Min, callee.Cycles.Max, callee.Cycles.Bounded, callee.Returns}
+			w.sub.Calls = appendName(w.sub.Calls, callee.Name)
+		}
+		w.addEdge(node, next, call.then(cost))
+		return
+	}
+	if info.addrMode == relativeAddr {
+		target, ok := p.instructionTarget(i)
+		if !ok {
+			w.sub.Unknown = appendAddr(w.sub.Unknown, addr)
+			return
+		}
+		takenCycles := info.cycles + info.branchTakenCycles
+		if next&0xff00 != target&0xff00 {
+			takenCycles += info.pageCrossCycles
+		}
+		w.addEdge(node, target, cyclePath{takenCycles, takenCycles, true, true})
+		w.addEdge(node, next, cost)
+		return
+	}
+	w.addEdge(node, next, cost.plus(0, info.pageCrossCycles))
+}
+
+// AnalyzeTiming computes the minimum and maximum number of cycles the NMI
+// handler and each of the labels in entries take, along with every
+// subroutine they call. Loop bounds are not inferred; any loop makes the
+// maximum of its subroutine unknown.
+func (p *Program) AnalyzeTiming(entries []string) (*TimingReport, error) {
+	a := &timingAnalyzer{
+		prog:       p,
+		labelNames: p.labelNamesByAddr(),
+		subs:       make(map[int]*SubroutineTiming),
+		analyzing:  make(map[int]bool),
+	}
+	r := new(TimingReport)
+	nmiAddr, ok := p.vectorTarget(0xfffa)
+	if ok && p.instructionAt(nmiAddr) != nil {
+		r.Nmi = a.subroutine(nmiAddr)
+	}
+	for _, name := range entries {
+		addr, ok := p.Labels[name]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("label %s not defined", name))
+		}
+		if p.instructionAt(addr) == nil {
+			return nil, errors.New(fmt.Sprintf("label %s does not point to code", name))
+		}
+		a.subroutine(addr)
+	}
+	for _, sub := range a.subs {
+		r.Subroutines = append(r.Subroutines, sub)
+	}
+	sort.Sort(subroutinesByAddr(r.Subroutines))
+	return r, nil
+}
+
+type subroutinesByAddr []*SubroutineTiming
+
+func (s subroutinesByAddr) Len() int           { return len(s) }
+func (s subroutinesByAddr) Less(i, j int) bool { return s[i].Addr < s[j].Addr }
+func (s subroutinesByAddr) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (c CycleCount) String() string {
+	if !c.Bounded {
+		return fmt.Sprintf("%d-?", c.Min)
+	}
+	if c.Min == c.Max {
+		return fmt.Sprintf("%d", c.Min)
+	}
+	return fmt.Sprintf("%d-%d", c.Min, c.Max)
+}
+
+func addrListStr(addrs []int) string {
+	str := ""
+	for n, addr := range addrs {
+		if n > 0 {
+			str += ", "
+		}
+		str += fmt.Sprintf("$%04x", addr)
+	}
+	return str
+}
+
+func (r *TimingReport) WriteText(writer io.Writer) (err error) {
+	for _, sub := range r.Subroutines {
+		_, err = fmt.Fprintf(writer, "$%04x %s: %s cycles\n", sub.Addr, sub.Name, sub.Cycles.String())
+		if err != nil {
+			return
+		}
+		if !sub.Returns {
+			_, err = fmt.Fprintf(writer, "    never returns\n")
+			if err != nil {
+				return
+			}
+		}
+		if len(sub.Loops) > 0 {
+			_, err = fmt.Fprintf(writer, "    loops with unknown bounds at %s\n", addrListStr(sub.Loops))
+			if err != nil {
+				return
+			}
+		}
+		if len(sub.Unknown) > 0 {
+			_, err = fmt.Fprintf(writer, "    unknown control flow at %s\n", addrListStr(sub.Unknown))
+			if err != nil {
+				return
+			}
+		}
+	}
+	if r.Nmi == nil {
+		_, err = fmt.Fprintf(writer, "\nno NMI handler found\n")
+		return
+	}
+	// the interrupt sequence itself takes cycles out of vblank too
+	c := r.Nmi.Cycles
+	c.Min += interruptCycles
+	c.Max += interruptCycles
+	var verdict string
+	switch {
+	case c.Min > VblankCycles:
+		verdict = "always exceeds vblank"
+	case !c.Bounded:
+		verdict = "may exceed vblank"
+	case c.Max > VblankCycles:
+		verdict = "may exceed vblank"
+	default:
+		verdict = "fits in vblank"
+	}
+	_, err = fmt.Fprintf(writer, "\nNMI %s: %s of %d cycles, %s\n", r.Nmi.Name, c.String(), VblankCycles, verdict)
+	return
+}
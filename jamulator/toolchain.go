@@ -0,0 +1,172 @@
+package jamulator
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// the programs and libraries which turn the compiled ROM into a binary.
+// DefaultToolchain fills it in from the environment:
+//
+//	JAMULATOR_LLC               llc, to compile bitcode into an object file
+//	JAMULATOR_CC                the C compiler that links it, or else CC
+//
+// and link looks up what the runtime needs there when it is not given:
+//
+//	JAMULATOR_RUNTIME           the archive of the sdl runtime
+//	JAMULATOR_LIBS              the libraries it needs, as linker flags
+//	JAMULATOR_HEADLESS_RUNTIME  the archive of the headless runtime
+type Toolchain struct {
+	Llc    string
+	Linker string
+	// which runtime to link with: "sdl", which shows the game in a
+	// window, or "headless", which does not need a display. empty is
+	// the same as "sdl".
+	Runtime string
+	// the archive of Runtime. taken from the environment, or else found
+	// with FindRuntime, when empty
+	RuntimeArchive string
+	// nil for the libraries that Runtime needs
+	Libs []string
+	// leave prg.bc and prg.o in the temporary directory
+	KeepTemps bool
+}
+
+type runtimeInfo struct {
+	archive    string
+	archiveEnv string
+	libs       []string
+	// empty when the libraries cannot be changed from the environment
+	libsEnv string
+}
+
+var runtimes = map[string]runtimeInfo{
+	"sdl":      {"runtime.a", "JAMULATOR_RUNTIME", []string{"-lGLEW", "-lGL", "-lSDL", "-lSDL_gfx"}, "JAMULATOR_LIBS"},
+	"headless": {"headless.a", "JAMULATOR_HEADLESS_RUNTIME", nil, ""},
+}
+
+func (info runtimeInfo) linkLibs() []string {
+	if info.libsEnv != "" {
+		if libs := os.Getenv(info.libsEnv); libs != "" {
+			return strings.Fields(libs)
+		}
+	}
+	return info.libs
+}
+
+func (t *Toolchain) runtime() (runtimeInfo, error) {
+	name := t.Runtime
+	if name == "" {
+		name = "sdl"
+	}
+	info, ok := runtimes[name]
+	if !ok {
+		return info, errors.New(fmt.Sprintf("unknown runtime: %s", name))
+	}
+	return info, nil
+}
+
+func DefaultToolchain() *Toolchain {
+	t := &Toolchain{
+		Llc:    os.Getenv("JAMULATOR_LLC"),
+		Linker: os.Getenv("JAMULATOR_CC"),
+	}
+	if t.Llc == "" {
+		t.Llc = "llc"
+	}
+	if t.Linker == "" {
+		t.Linker = os.Getenv("CC")
+	}
+	if t.Linker == "" {
+		t.Linker = "gcc"
+	}
+	return t
+}
+
+// FindRuntime looks for the archive of a runtime, such as runtime.a, in
+// runtime/ next to the jamulator binary, then in the current directory.
+func FindRuntime(archive string) (string, error) {
+	var dirs []string
+	exe, err := exec.LookPath(os.Args[0])
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err == nil {
+		dirs = append(dirs, filepath.Dir(exe))
+	}
+	dirs = append(dirs, ".")
+	var tried []string
+	for _, dir := range dirs {
+		filename := filepath.Join(dir, "runtime", archive)
+		if _, err := os.Stat(filename); err == nil {
+			return filename, nil
+		}
+		tried = append(tried, filename)
+	}
+	return "", errors.New(fmt.Sprintf("%s not found; tried %s. build it with make", archive, strings.Join(tried, ", ")))
+}
+
+// ToolError is a program in the toolchain which failed, with what it
+// printed.
+type ToolError struct {
+	Tool   string
+	Args   []string
+	Output string
+	Err    error
+}
+
+func (e *ToolError) Error() string {
+	msg := fmt.Sprintf("%s %s: %s", e.Tool, strings.Join(e.Args, " "), e.Err.Error())
+	if e.Output != "" {
+		msg += "\n" + strings.TrimRight(e.Output, "\n")
+	}
+	return msg
+}
+
+func runTool(tool string, args ...string) error {
+	out, err := exec.Command(tool, args...).CombinedOutput()
+	if err != nil {
+		return &ToolError{tool, args, string(out), err}
+	}
+	// warnings
+	fmt.Fprint(os.Stderr, string(out))
+	return nil
+}
+
+// the bitcode has the target triple in it already
+func (t *Toolchain) compileObject(opts *CompileOptions, object string, bitcode string) error {
+	opts = opts.normalize()
+	args := []string{"-o", object, "-filetype=obj", "-relocation-model=pic", fmt.Sprintf("-O%d", opts.OptLevel)}
+	if opts.CPU != "" {
+		args = append(args, "-mcpu="+opts.CPU)
+	}
+	return runTool(t.Llc, append(args, bitcode)...)
+}
+
+func (t *Toolchain) link(object string, filename string) error {
+	info, err := t.runtime()
+	if err != nil {
+		return err
+	}
+	runtimeArchive := t.RuntimeArchive
+	if runtimeArchive == "" {
+		runtimeArchive = os.Getenv(info.archiveEnv)
+	}
+	if runtimeArchive == "" {
+		runtimeArchive, err = FindRuntime(info.archive)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s, or set %s", err.Error(), info.archiveEnv))
+		}
+	}
+	libs := t.Libs
+	if libs == nil {
+		libs = info.linkLibs()
+	}
+	args := []string{object, runtimeArchive}
+	args = append(args, libs...)
+	return runTool(t.Linker, append(args, "-o", filename)...)
+}
@@ -0,0 +1,201 @@
+package jamulator
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// a program compiled with TraceFlag prints a line for every write to
+// memory, and then one with the registers after each instruction:
+//
+//	write ADDR VALUE
+//	trace PC A X Y P SP
+//
+// in hex. CompareTraces checks them against the same program run on Cpu.
+
+type TraceWrite struct {
+	Addr  uint16
+	Value byte
+}
+
+type TraceStep struct {
+	// the address of the instruction. only the reference knows it; it is
+	// 0 in a parsed trace.
+	Addr   uint16
+	PC     uint16
+	A      byte
+	X      byte
+	Y      byte
+	P      byte
+	SP     byte
+	Writes []TraceWrite
+}
+
+// the break and unused bits of P are not registers on the 6502
+const traceStatusMask = 0xcf
+
+func (s *TraceStep) equal(other *TraceStep) bool {
+	if s.PC != other.PC || s.A != other.A || s.X != other.X || s.Y != other.Y ||
+		s.P&traceStatusMask != other.P&traceStatusMask || s.SP != other.SP {
+		return false
+	}
+	if len(s.Writes) != len(other.Writes) {
+		return false
+	}
+	for n, w := range s.Writes {
+		if w != other.Writes[n] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *TraceStep) String() string {
+	str := fmt.Sprintf("PC $%04x  A $%02x  X $%02x  Y $%02x  P $%02x  SP $%02x",
+		s.PC, s.A, s.X, s.Y, s.P&traceStatusMask, s.SP)
+	for _, w := range s.Writes {
+		str += fmt.Sprintf("  $%04x=$%02x", w.Addr, w.Value)
+	}
+	return str
+}
+
+// ParseTrace reads the output of a program compiled with TraceFlag.
+// anything else the program prints, such as with putchar, is skipped.
+// writes after the last instruction, such as the one to $2009 which
+// exits, are left out.
+func ParseTrace(reader io.Reader) ([]TraceStep, error) {
+	var steps []TraceStep
+	var writes []TraceWrite
+	scanner := bufio.NewScanner(reader)
+	lineNumber := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		lineNumber += 1
+		if i := strings.Index(line, "write "); i >= 0 {
+			var w TraceWrite
+			_, err := fmt.Sscanf(line[i:], "write %x %x", &w.Addr, &w.Value)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("line %d: %s", lineNumber, err.Error()))
+			}
+			writes = append(writes, w)
+		} else if i := strings.Index(line, "trace "); i >= 0 {
+			s := TraceStep{Writes: writes}
+			_, err := fmt.Sscanf(line[i:], "trace %x %x %x %x %x %x", &s.PC, &s.A, &s.X, &s.Y, &s.P, &s.SP)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("line %d: %s", lineNumber, err.Error()))
+			}
+			steps = append(steps, s)
+			writes = nil
+		}
+	}
+	return steps, scanner.Err()
+}
+
+type traceMemory struct {
+	CpuMemory
+	writes []TraceWrite
+}
+
+func (m *traceMemory) Write(addr uint16, value byte) {
+	m.writes = append(m.writes, TraceWrite{addr, value})
+	m.CpuMemory.Write(addr, value)
+}
+
+// RunReference runs PRG ROM on Cpu from reset until it writes to $2009,
+// and returns what a program compiled with TraceFlag would print. it
+// gives up after limit instructions. out is where $2008 prints to and
+// may be nil.
+func RunReference(prgRom [][]byte, limit int, out io.Writer) ([]TraceStep, error) {
+	nes := NewNesMemory(prgRom)
+	nes.Out = out
+	mem := &traceMemory{CpuMemory: nes}
+	cpu := NewCpu(mem)
+	var steps []TraceStep
+	for len(steps) < limit {
+		addr := cpu.PC
+		mem.writes = nil
+		err := cpu.Step()
+		if err != nil {
+			return steps, err
+		}
+		if nes.Exited {
+			return steps, nil
+		}
+		steps = append(steps, TraceStep{
+			Addr:   addr,
+			PC:     cpu.PC,
+			A:      cpu.A,
+			X:      cpu.X,
+			Y:      cpu.Y,
+			P:      cpu.Status(),
+			SP:     cpu.SP,
+			Writes: mem.writes,
+		})
+	}
+	return steps, errors.New(fmt.Sprintf("the program did not exit after %d instructions", limit))
+}
+
+// CompareTraces returns an error describing the first instruction after
+// which actual differs from the reference trace, with the disassembly
+// of program around it. program may be nil.
+func CompareTraces(program *Program, reference []TraceStep, actual []TraceStep) error {
+	for n := range reference {
+		expected := &reference[n]
+		if n >= len(actual) {
+			return errors.New(fmt.Sprintf("instruction %d at $%04x: the compiled program stopped, expected\n  %s%s",
+				n+1, expected.Addr, expected.String(), program.disassemblyAround(expected.Addr)))
+		}
+		if !expected.equal(&actual[n]) {
+			return errors.New(fmt.Sprintf("instruction %d at $%04x:\n  expected %s\n  actual   %s%s",
+				n+1, expected.Addr, expected.String(), actual[n].String(), program.disassemblyAround(expected.Addr)))
+		}
+	}
+	if len(actual) > len(reference) {
+		return errors.New(fmt.Sprintf("the compiled program ran %d instructions, expected %d. the next one was\n  %s",
+			len(actual), len(reference), actual[len(reference)].String()))
+	}
+	return nil
+}
+
+// how many statements disassemblyAround shows on each side of addr
+const traceContext = 5
+
+func (p *Program) disassemblyAround(addr uint16) string {
+	if p == nil {
+		return ""
+	}
+	elem := p.elemAtAddr(int(addr))
+	if elem == nil {
+		return ""
+	}
+	first := elem
+	for n := 0; n < traceContext && first.Prev() != nil; n++ {
+		first = first.Prev()
+	}
+	str := "\n"
+	e := first
+	for n := 0; n < 2*traceContext+1 && e != nil; n++ {
+		str += renderTraceLine(e, e == elem)
+		e = e.Next()
+	}
+	return strings.TrimRight(str, "\n")
+}
+
+func renderTraceLine(e *list.Element, here bool) string {
+	marker := "  "
+	if here {
+		marker = "> "
+	}
+	renderer, ok := e.Value.(Renderer)
+	if !ok {
+		return ""
+	}
+	if a, ok := e.Value.(Assembler); ok {
+		return fmt.Sprintf("%s$%04x  %s\n", marker, a.GetOffset(), renderer.Render())
+	}
+	return fmt.Sprintf("%s       %s\n", marker, renderer.Render())
+}
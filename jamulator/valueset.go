@@ -0,0 +1,448 @@
+package jamulator
+
+import (
+	"sort"
+)
+
+// what is known about the value of a register or byte of memory at some
+// point in the program
+type abstractValue struct {
+	// the possible values, when they are all known
+	consts []int
+	// identifies an unknown value, so that copies of it can be recognized
+	unknown int
+	// when nonzero, the value was loaded from table indexed by the
+	// unknown value with id index
+	table int
+	index int
+}
+
+func constValues(values ...int) *abstractValue {
+	seen := make(map[int]bool)
+	consts := make([]int, 0, len(values))
+	for _, v := range values {
+		v &= 0xff
+		if !seen[v] {
+			seen[v] = true
+			consts = append(consts, v)
+		}
+	}
+	sort.Ints(consts)
+	return &abstractValue{consts: consts}
+}
+
+// the values a pointer to code was seen being assigned
+type pointerValues struct {
+	targets map[int]bool
+	tables  map[jumpTable]bool
+	// values stored to only one of the two bytes
+	lo []*abstractValue
+	hi []*abstractValue
+}
+
+// IndirectJump is a jmp through a pointer, and the addresses that the
+// pointer is known to be assigned.
+type IndirectJump struct {
+	Addr    int
+	Pointer int
+	Targets []int
+	// tables of addresses which the pointer is loaded from
+	tables []jumpTable
+}
+
+// tracks register and memory values through a run of instructions
+// which is only entered at the top
+type valueSetAnalyzer struct {
+	p        *Program
+	pointers map[int]*pointerValues
+	nextId   int
+	// treat every load from RAM as unknown, for analyses which must hold
+	// even if an interrupt writes to RAM between two instructions
+	forgetRam bool
+
+	a, x, y *abstractValue
+	mem     map[int]*abstractValue
+	// the latest values stored to each pointer in this run
+	lo map[int]*abstractValue
+	hi map[int]*abstractValue
+}
+
+func (a *valueSetAnalyzer) fresh() *abstractValue {
+	a.nextId += 1
+	return &abstractValue{unknown: a.nextId}
+}
+
+// reads a byte of PRG ROM
+func (p *Program) romByte(addr int) (byte, bool) {
+	switch {
+	case addr < 0x8000 || addr > 0xffff:
+		return 0, false
+	case len(p.PrgRom) == 1:
+		return p.PrgRom[0][addr&0x3fff], true
+	case len(p.PrgRom) == 2:
+		return p.PrgRom[(addr-0x8000)/0x4000][addr&0x3fff], true
+	}
+	return 0, false
+}
+
+func (a *valueSetAnalyzer) load(addr int) *abstractValue {
+	if b, ok := a.p.romByte(addr); ok {
+		return constValues(int(b))
+	}
+	if a.forgetRam {
+		return a.fresh()
+	}
+	v, ok := a.mem[addr]
+	if !ok {
+		v = a.fresh()
+		a.mem[addr] = v
+	}
+	return v
+}
+
+func (a *valueSetAnalyzer) loadIndexed(table int, index *abstractValue) *abstractValue {
+	if index.consts == nil {
+		if table < 0x8000 {
+			return a.fresh()
+		}
+		v := a.fresh()
+		v.table = table
+		v.index = index.unknown
+		return v
+	}
+	values := make([]int, 0, len(index.consts))
+	for _, n := range index.consts {
+		b, ok := a.p.romByte(table + n)
+		if !ok {
+			return a.fresh()
+		}
+		values = append(values, int(b))
+	}
+	return constValues(values...)
+}
+
+// applies f to every possible value of v
+func (a *valueSetAnalyzer) apply(v *abstractValue, f func(int) int) *abstractValue {
+	if v.consts == nil {
+		return a.fresh()
+	}
+	values := make([]int, len(v.consts))
+	for n, c := range v.consts {
+		values[n] = f(c)
+	}
+	return constValues(values...)
+}
+
+func (a *valueSetAnalyzer) store(addr int, v *abstractValue) {
+	a.mem[addr] = v
+	if _, ok := a.pointers[addr]; ok {
+		a.lo[addr] = v
+	}
+	if _, ok := a.pointers[addr-1]; ok {
+		a.hi[addr-1] = v
+	}
+}
+
+func (a *valueSetAnalyzer) startRun() {
+	a.endRun()
+	a.a = a.fresh()
+	a.x = a.fresh()
+	a.y = a.fresh()
+	a.mem = make(map[int]*abstractValue)
+	a.lo = make(map[int]*abstractValue)
+	a.hi = make(map[int]*abstractValue)
+}
+
+// pairs up the bytes stored to each pointer during the run
+func (a *valueSetAnalyzer) endRun() {
+	for ptr, lo := range a.lo {
+		pv := a.pointers[ptr]
+		hi, ok := a.hi[ptr]
+		if !ok {
+			pv.lo = append(pv.lo, lo)
+			continue
+		}
+		switch {
+		case lo.consts != nil && hi.consts != nil:
+			for _, l := range lo.consts {
+				for _, h := range hi.consts {
+					pv.targets[h<<8|l] = true
+				}
+			}
+		case lo.table != 0 && hi.table != 0 && lo.index == hi.index:
+			pv.tables[jumpTable{lo: lo.table, hi: hi.table}] = true
+		}
+	}
+	for ptr, hi := range a.hi {
+		if _, ok := a.lo[ptr]; !ok {
+			a.pointers[ptr].hi = append(a.pointers[ptr].hi, hi)
+		}
+	}
+	a.lo = nil
+	a.hi = nil
+}
+
+func (a *valueSetAnalyzer) visit(i *Instruction) {
+	switch i.OpCode {
+	case 0xa9, 0xa5, 0xad: // lda imm, zp, abs
+		a.a = a.operand(i)
+	case 0xa2, 0xa6, 0xae: // ldx imm, zp, abs
+		a.x = a.operand(i)
+	case 0xa0, 0xa4, 0xac: // ldy imm, zp, abs
+		a.y = a.operand(i)
+	case 0xbd: // lda abs,x
+		a.a = a.loadIndexed(i.Value, a.x)
+	case 0xb9: // lda abs,y
+		a.a = a.loadIndexed(i.Value, a.y)
+	case 0xbe: // ldx abs,y
+		a.x = a.loadIndexed(i.Value, a.y)
+	case 0xbc: // ldy abs,x
+		a.y = a.loadIndexed(i.Value, a.x)
+	case 0xaa: // tax
+		a.x = a.a
+	case 0xa8: // tay
+		a.y = a.a
+	case 0x8a: // txa
+		a.a = a.x
+	case 0x98: // tya
+		a.a = a.y
+	case 0xe8: // inx
+		a.x = a.apply(a.x, func(v int) int { return v + 1 })
+	case 0xca: // dex
+		a.x = a.apply(a.x, func(v int) int { return v - 1 })
+	case 0xc8: // iny
+		a.y = a.apply(a.y, func(v int) int { return v + 1 })
+	case 0x88: // dey
+		a.y = a.apply(a.y, func(v int) int { return v - 1 })
+	case 0x0a: // asl a
+		a.a = a.apply(a.a, func(v int) int { return v << 1 })
+	case 0x4a: // lsr a
+		a.a = a.apply(a.a, func(v int) int { return v >> 1 })
+	case 0x85, 0x8d: // sta zp, abs
+		a.store(i.Value, a.a)
+	case 0x86, 0x8e: // stx zp, abs
+		a.store(i.Value, a.x)
+	case 0x84, 0x8c: // sty zp, abs
+		a.store(i.Value, a.y)
+	case 0x20: // jsr
+		// the subroutine could change anything
+		a.a = a.fresh()
+		a.x = a.fresh()
+		a.y = a.fresh()
+		a.mem = make(map[int]*abstractValue)
+	default:
+		a.clobber(i)
+	}
+}
+
+func (a *valueSetAnalyzer) operand(i *Instruction) *abstractValue {
+	if i.Type == ImmediateInstruction {
+		return constValues(i.Value)
+	}
+	return a.load(i.Value)
+}
+
+// forgets whatever an instruction which is not modeled overwrites
+func (a *valueSetAnalyzer) clobber(i *Instruction) {
+	info := opCodeDataMap[i.OpCode]
+	switch info.opName {
+	case "adc", "sbc", "and", "ora", "eor", "pla", "lda":
+		a.a = a.fresh()
+	case "asl", "lsr", "rol", "ror":
+		if info.addrMode == impliedAddr {
+			a.a = a.fresh()
+		}
+	case "ldx", "tsx":
+		a.x = a.fresh()
+	case "ldy":
+		a.y = a.fresh()
+	}
+	switch info.addrMode {
+	case zeroPageAddr, absAddr:
+		switch info.opName {
+		case "inc", "dec", "asl", "lsr", "rol", "ror":
+			a.store(i.Value, a.fresh())
+		}
+	case zeroXIndexAddr, zeroYIndexAddr, absXAddr, absYAddr, indirectYIndexAddr, xIndexIndirectAddr:
+		switch info.opName {
+		case "sta", "stx", "sty", "inc", "dec", "asl", "lsr", "rol", "ror":
+			// could have written anywhere
+			a.mem = make(map[int]*abstractValue)
+		}
+	}
+}
+
+// whether execution can continue to the next instruction
+func fallsThrough(opCode byte) bool {
+	switch opCode {
+	case 0x4c, 0x6c, 0x60, 0x40, 0x00: // jmp, jmp (ind), rts, rti, brk
+		return false
+	}
+	return true
+}
+
+// IndirectJumps finds every jmp through a pointer and works out the
+// addresses that the pointer can hold, from the constants and tables
+// which are stored to it. Stores made in separate runs of code, where
+// only one byte of the pointer is written, are combined with every
+// value seen for the other byte.
+func (p *Program) IndirectJumps() []*IndirectJump {
+	a := &valueSetAnalyzer{
+		p:        p,
+		pointers: make(map[int]*pointerValues),
+	}
+	var jumps []*IndirectJump
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		i, ok := e.Value.(*Instruction)
+		if ok && i.OpCode == 0x6c {
+			jumps = append(jumps, &IndirectJump{Addr: i.Offset, Pointer: i.Value})
+			a.pointers[i.Value] = &pointerValues{
+				targets: make(map[int]bool),
+				tables:  make(map[jumpTable]bool),
+			}
+		}
+	}
+	if len(jumps) == 0 {
+		return nil
+	}
+
+	a.startRun()
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		switch t := e.Value.(type) {
+		case *LabelStatement, *DataStatement, *OrgPseudoOp:
+			// code can arrive from elsewhere
+			a.startRun()
+		case *Instruction:
+			a.visit(t)
+			if !fallsThrough(t.OpCode) {
+				a.startRun()
+			}
+		}
+	}
+	a.endRun()
+
+	for _, pv := range a.pointers {
+		for _, lo := range pv.lo {
+			for _, hi := range pv.hi {
+				if lo.consts == nil || hi.consts == nil {
+					continue
+				}
+				for _, l := range lo.consts {
+					for _, h := range hi.consts {
+						pv.targets[h<<8|l] = true
+					}
+				}
+			}
+		}
+	}
+	for _, jump := range jumps {
+		pv := a.pointers[jump.Pointer]
+		for target := range pv.targets {
+			jump.Targets = append(jump.Targets, target)
+		}
+		sort.Ints(jump.Targets)
+		for t := range pv.tables {
+			jump.tables = append(jump.tables, t)
+		}
+		sort.Sort(jumpTablesByAddr(jump.tables))
+	}
+	return jumps
+}
+
+// the values the index registers are known to have before an instruction
+type indexValues struct {
+	x []int
+	y []int
+}
+
+// works out the values of X and Y at every instruction which is indexed
+// by them, where all of the possible values are known
+func (p *Program) indexValues() map[int]indexValues {
+	a := &valueSetAnalyzer{
+		p:         p,
+		pointers:  make(map[int]*pointerValues),
+		forgetRam: true,
+	}
+	values := make(map[int]indexValues)
+	a.startRun()
+	for e := p.List.Front(); e != nil; e = e.Next() {
+		switch t := e.Value.(type) {
+		case *LabelStatement, *DataStatement, *OrgPseudoOp:
+			a.startRun()
+		case *Instruction:
+			switch opCodeDataMap[t.OpCode].addrMode {
+			case zeroXIndexAddr, absXAddr, zeroYIndexAddr, absYAddr:
+				if a.x.consts != nil || a.y.consts != nil {
+					values[t.Offset] = indexValues{a.x.consts, a.y.consts}
+				}
+			}
+			a.visit(t)
+			if !fallsThrough(t.OpCode) {
+				a.startRun()
+			}
+		}
+	}
+	return values
+}
+
+// reads the entries of a jump table until one does not point to an
+// instruction
+func (p *Program) jumpTableTargets(t jumpTable) []int {
+	stride := 1
+	if t.isWords() {
+		stride = 2
+	}
+	var targets []int
+	for n := 0; n*stride < 0x100; n++ {
+		loAddr := t.lo + n*stride
+		hiAddr := t.hi + n*stride
+		if !t.isWords() && ((t.lo < t.hi && loAddr >= t.hi) || (t.hi < t.lo && hiAddr >= t.lo)) {
+			break
+		}
+		lo, ok := p.romByte(loAddr)
+		if !ok {
+			break
+		}
+		hi, ok := p.romByte(hiAddr)
+		if !ok {
+			break
+		}
+		target := int(hi)<<8 | int(lo)
+		if t.rts {
+			target += 1
+		}
+		if p.instructionAt(target) == nil {
+			break
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// the addresses which j can jump to that are known to be instructions
+func (p *Program) indirectJumpTargets(j *IndirectJump) []int {
+	seen := make(map[int]bool)
+	var targets []int
+	add := func(addr int) {
+		if !seen[addr] && p.instructionAt(addr) != nil {
+			seen[addr] = true
+			targets = append(targets, addr)
+		}
+	}
+	for _, addr := range j.Targets {
+		add(addr)
+	}
+	for _, t := range j.tables {
+		for _, addr := range p.jumpTableTargets(t) {
+			add(addr)
+		}
+	}
+	sort.Ints(targets)
+	return targets
+}
+
+type jumpTablesByAddr []jumpTable
+
+func (s jumpTablesByAddr) Len() int           { return len(s) }
+func (s jumpTablesByAddr) Less(i, j int) bool { return s[i].lo < s[j].lo }
+func (s jumpTablesByAddr) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
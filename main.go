@@ -2,6 +2,7 @@ package main
 
 import (
 	"./jamulator"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -16,11 +17,38 @@ var (
 	unRomFlag       bool
 	compileFlag     bool
 	romFlag         bool
-	disableOptFlag  bool
+	optFlags        [4]bool
+	optSizeFlag     bool
+	targetTriple    string
+	targetCpu       string
+	llcPath         string
+	linkerPath      string
+	runtimeName     string
+	runtimeArchive  string
+	linkLibs        string
+	keepTempsFlag   bool
 	dumpFlag        bool
 	dumpPreFlag     bool
 	debugFlag       bool
+	eagerFlagsFlag  bool
+	batchCyclesFlag bool
+	traceFlag       bool
 	recompileFlag   bool
+	timingFlag      bool
+	timingLabels    string
+	cfgFlag         bool
+	cdlFile         string
+	hintsFile       string
+	showBytesFlag   bool
+	reportFlag      bool
+	tblFile         string
+	chrPngFlag      bool
+	chrPalette      string
+	screenFlag      bool
+	nametableSpec   string
+	paletteSpec     string
+	chrBank         int
+	patternTable    int
 )
 
 // TODO: change this to use commands
@@ -30,12 +58,42 @@ func init() {
 	flag.BoolVar(&disassembleFlag, "dis", false, "Disassemble 6502 machine code")
 	flag.BoolVar(&romFlag, "rom", false, "Assemble a jam package into an NES ROM")
 	flag.BoolVar(&unRomFlag, "unrom", false, "Disassemble an NES ROM into a jam package")
-	flag.BoolVar(&compileFlag, "c", false, "Compile into a native executable")
-	flag.BoolVar(&disableOptFlag, "O0", false, "Disable optimizations")
+	flag.BoolVar(&compileFlag, "c", false, "Compile into LLVM bitcode, or IR or native assembly if the output file ends in .ll or .s")
+	flag.BoolVar(&optFlags[0], "O0", false, "Disable optimizations")
+	flag.BoolVar(&optFlags[1], "O1", false, "Optimize with the LLVM -O1 pass pipeline")
+	flag.BoolVar(&optFlags[2], "O2", false, "Optimize with the LLVM -O2 pass pipeline. This is the default")
+	flag.BoolVar(&optFlags[3], "O3", false, "Optimize with the LLVM -O3 pass pipeline")
+	flag.BoolVar(&optSizeFlag, "Os", false, "Optimize for size")
+	flag.StringVar(&targetTriple, "target", "", "LLVM target triple to compile for, such as aarch64-linux-gnu. Defaults to the host, which is the only target -recompile can link")
+	flag.StringVar(&targetCpu, "mcpu", "", "CPU to compile for, such as cortex-a53")
+	flag.StringVar(&llcPath, "llc", "", "llc to compile with -recompile. Defaults to $JAMULATOR_LLC, then llc")
+	flag.StringVar(&linkerPath, "cc", "", "C compiler to link with -recompile. Defaults to $JAMULATOR_CC, then $CC, then gcc")
+	flag.StringVar(&runtimeName, "runtime", "sdl", "Runtime to link with -recompile: sdl, which opens a window, or headless, which runs without a display")
+	flag.StringVar(&runtimeArchive, "runtime-archive", "", "Archive of the runtime to link with -recompile. Defaults to $JAMULATOR_RUNTIME for sdl or $JAMULATOR_HEADLESS_RUNTIME for headless, then runtime/runtime.a or runtime/headless.a next to jamulator or in the current directory")
+	flag.StringVar(&linkLibs, "libs", "", "Space separated linker flags for the libraries the runtime needs. Defaults to what the runtime needs: $JAMULATOR_LIBS, then \"-lGLEW -lGL -lSDL -lSDL_gfx\" for sdl, and none for headless")
+	flag.BoolVar(&keepTempsFlag, "keep-temps", false, "Keep the bitcode and object file that -recompile makes, and print where they are")
 	flag.BoolVar(&dumpFlag, "d", false, "Dump LLVM IR code for generated code")
 	flag.BoolVar(&dumpPreFlag, "dd", false, "Dump LLVM IR code for generated code before verifying module")
 	flag.BoolVar(&debugFlag, "g", false, "Include debug print statements in generated code")
+	flag.BoolVar(&eagerFlagsFlag, "eager-flags", false, "Compute status flags after every instruction instead of only where they are read, to check the generated code against")
+	flag.BoolVar(&batchCyclesFlag, "batch-cycles", false, "Report CPU cycles to the runtime once per basic block instead of after every instruction. Faster, but interrupts are taken later; accesses to the PPU, APU and controllers still see exact timing")
+	flag.BoolVar(&traceFlag, "trace", false, "Print the registers after every instruction and every write to memory from generated code, to compare against the reference interpreter")
 	flag.BoolVar(&recompileFlag, "recompile", false, "Recompile an NES ROM into a native binary")
+	flag.BoolVar(&timingFlag, "timing", false, "Report cycle counts of the NMI handler and its subroutines")
+	flag.BoolVar(&cfgFlag, "cfg", false, "Export the control flow graph as Graphviz DOT, or JSON if the output file ends in .json")
+	flag.StringVar(&cdlFile, "cdl", "", "Code/data log from an emulator to guide disassembly of an NES ROM or 6502 machine code")
+	flag.StringVar(&hintsFile, "hints", "", "Hints file with labels, comments, and code and data ranges to guide disassembly of an NES ROM or 6502 machine code")
+	flag.BoolVar(&showBytesFlag, "bytes", false, "Annotate disassembled instructions with their address and bytes")
+	flag.BoolVar(&reportFlag, "report", false, "Report how much of a ROM was identified as code and data, and what could not be resolved. Writes JSON to the output file if one is given")
+	flag.StringVar(&tblFile, "tbl", "", "Text table (.tbl) with the game's string encoding, used to find strings when disassembling and to encode them when assembling")
+	flag.BoolVar(&chrPngFlag, "chr-png", false, "Save CHR ROM as PNG tile sheets instead of raw .chr files when disassembling an NES ROM")
+	flag.StringVar(&chrPalette, "chr-palette", "", "Four comma separated hex RGB colors to draw -chr-png tile sheets with, darkest first")
+	flag.BoolVar(&screenFlag, "screen", false, "Render a background from an NES ROM or jam package to PNG, given -nametable and -screen-palette")
+	flag.StringVar(&nametableSpec, "nametable", "", "PRG ROM address such as $c000, or file, of the 1024 bytes of nametable and attributes to render with -screen")
+	flag.StringVar(&paletteSpec, "screen-palette", "", "PRG ROM address such as $c000, or file, of the 16 bytes of background palette to render with -screen")
+	flag.IntVar(&chrBank, "chr-bank", 0, "8KB CHR ROM bank to render -screen tiles from. Both pattern tables come from this one bank, as if the mapper did not switch CHR")
+	flag.IntVar(&patternTable, "pattern-table", 0, "Which half of the CHR bank, 0 or 1, to render -screen tiles from")
+	flag.StringVar(&timingLabels, "timing-labels", "", "Comma separated list of extra labels to analyze with -timing")
 }
 
 func usageAndQuit() {
@@ -48,10 +106,52 @@ func removeExtension(filename string) string {
 	return filename[0 : len(filename)-len(path.Ext(filename))]
 }
 
-func compileFlags() (flags jamulator.CompileFlags) {
-	if disableOptFlag {
-		flags |= jamulator.DisableOptFlag
+func compileOptions() (*jamulator.CompileOptions, error) {
+	opts := &jamulator.CompileOptions{
+		Flags:    compileFlags(),
+		OptLevel: 2,
+		Target:   targetTriple,
+		CPU:      targetCpu,
+	}
+	count := 0
+	for level, set := range optFlags {
+		if set {
+			opts.OptLevel = level
+			count += 1
+		}
+	}
+	if optSizeFlag {
+		opts.OptLevel = 2
+		opts.SizeLevel = 1
+		count += 1
+	}
+	if count > 1 {
+		return nil, errors.New("only one of -O0, -O1, -O2, -O3 and -Os can be given")
+	}
+	return opts, nil
+}
+
+// the toolchain from the environment, with the flags that override it
+func toolchain() *jamulator.Toolchain {
+	t := jamulator.DefaultToolchain()
+	if llcPath != "" {
+		t.Llc = llcPath
+	}
+	if linkerPath != "" {
+		t.Linker = linkerPath
+	}
+	t.Runtime = runtimeName
+	if runtimeArchive != "" {
+		t.RuntimeArchive = runtimeArchive
 	}
+	if linkLibs != "" {
+		t.Libs = strings.Fields(linkLibs)
+	}
+	t.KeepTemps = keepTempsFlag
+	return t
+}
+
+func compileFlags() (flags jamulator.CompileFlags) {
 	if dumpFlag {
 		flags |= jamulator.DumpModuleFlag
 	}
@@ -61,6 +161,15 @@ func compileFlags() (flags jamulator.CompileFlags) {
 	if debugFlag {
 		flags |= jamulator.IncludeDebugFlag
 	}
+	if eagerFlagsFlag {
+		flags |= jamulator.EagerFlagsFlag
+	}
+	if batchCyclesFlag {
+		flags |= jamulator.BatchCyclesFlag
+	}
+	if traceFlag {
+		flags |= jamulator.TraceFlag
+	}
 	return
 }
 
@@ -69,8 +178,13 @@ func compile(filename string, program *jamulator.Program) {
 	if flag.NArg() == 2 {
 		outfile = flag.Arg(1)
 	}
+	opts, err := compileOptions()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
 	fmt.Fprintf(os.Stderr, "Compiling to %s\n", outfile)
-	c, err := program.CompileToFilename(outfile, compileFlags())
+	c, err := program.CompileToFilename(outfile, opts)
 	if err != nil {
 		panic(err)
 	}
@@ -83,15 +197,253 @@ func compile(filename string, program *jamulator.Program) {
 	}
 }
 
+// the text table given with -tbl, or nil
+func textTable() (*jamulator.TextTable, error) {
+	if len(tblFile) == 0 {
+		return nil, nil
+	}
+	return jamulator.LoadTextTableFile(tblFile)
+}
+
+func disassembleOptions(rom *jamulator.Rom) (*jamulator.DisassembleOptions, error) {
+	opts := new(jamulator.DisassembleOptions)
+	opts.ShowBytes = showBytesFlag
+	if len(cdlFile) > 0 {
+		cdl, err := rom.LoadCdlFile(cdlFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.Cdl = cdl
+	}
+	if len(hintsFile) > 0 {
+		hints, err := jamulator.LoadDisassemblyHintsFile(hintsFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.Hints = hints
+	}
+	table, err := textTable()
+	if err != nil {
+		return nil, err
+	}
+	opts.TextTable = table
+	opts.ChrPng = chrPngFlag
+	if len(chrPalette) > 0 {
+		opts.ChrPalette, err = jamulator.ParseChrPalette(chrPalette)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+// loads an NES ROM, assembly source, or 6502 machine code based on the
+// file extension
+func loadProgram(filename string) (*jamulator.Program, error) {
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".nes":
+		rom, err := jamulator.LoadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		opts, err := disassembleOptions(rom)
+		if err != nil {
+			return nil, err
+		}
+		program, err := rom.Disassemble(opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, warning := range program.Warnings {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+		}
+		return program, nil
+	case ".asm":
+		table, err := textTable()
+		if err != nil {
+			return nil, err
+		}
+		programAst, err := jamulator.ParseFileWithTextTable(filename, table)
+		if err != nil {
+			return nil, err
+		}
+		program := programAst.ToProgramWithTextTable(table)
+		if len(program.Errors) > 0 {
+			return nil, errors.New(strings.Join(program.Errors, "\n"))
+		}
+		return program, nil
+	}
+	return disassembleFile(filename)
+}
+
+// disassembles 6502 machine code with the same options as an NES ROM
+func disassembleFile(filename string) (*jamulator.Program, error) {
+	rom, err := jamulator.LoadPrgFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := disassembleOptions(rom)
+	if err != nil {
+		return nil, err
+	}
+	return rom.Disassemble(opts)
+}
+
+func timing(filename string) {
+	program, err := loadProgram(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	var labels []string
+	if len(timingLabels) > 0 {
+		labels = strings.Split(timingLabels, ",")
+	}
+	report, err := program.AnalyzeTiming(labels)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	err = report.WriteText(os.Stdout)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func disassemblyReport(filename string) {
+	program, err := loadProgram(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	if program.Report == nil {
+		fmt.Fprintf(os.Stderr, "%s was not disassembled; no report to make\n", filename)
+		os.Exit(1)
+	}
+	err = program.Report.WriteText(os.Stdout)
+	if err != nil {
+		panic(err)
+	}
+	if flag.NArg() != 2 {
+		return
+	}
+	fd, err := os.Create(flag.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	defer fd.Close()
+	fmt.Fprintf(os.Stderr, "writing report %s\n", flag.Arg(1))
+	err = program.Report.WriteJson(fd)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func renderScreen(filename string) {
+	var rom *jamulator.Rom
+	var err error
+	if strings.ToLower(path.Ext(filename)) == ".jam" {
+		rom, err = jamulator.AssembleRomFile(filename)
+	} else {
+		rom, err = jamulator.LoadFile(filename)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	if len(nametableSpec) == 0 || len(paletteSpec) == 0 {
+		fmt.Fprintf(os.Stderr, "-screen needs -nametable and -screen-palette\n")
+		os.Exit(1)
+	}
+	if chrBank < 0 || chrBank >= len(rom.ChrRom) {
+		fmt.Fprintf(os.Stderr, "%s has no CHR bank %d\n", filename, chrBank)
+		os.Exit(1)
+	}
+	screen := &jamulator.Screen{
+		Chr:          rom.ChrRom[chrBank],
+		PatternTable: patternTable,
+	}
+	screen.Nametable, err = rom.ReadScreenData(nametableSpec, jamulator.NametableSize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	screen.Palette, err = rom.ReadScreenData(paletteSpec, jamulator.ScreenPaletteSize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	outfile := removeExtension(filename) + ".png"
+	if flag.NArg() == 2 {
+		outfile = flag.Arg(1)
+	}
+	fmt.Fprintf(os.Stderr, "writing screen %s\n", outfile)
+	err = screen.RenderToFile(outfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func exportCfg(filename string) {
+	program, err := loadProgram(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	outfile := removeExtension(filename) + ".dot"
+	if flag.NArg() == 2 {
+		outfile = flag.Arg(1)
+	}
+	fd, err := os.Create(outfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	defer fd.Close()
+	fmt.Fprintf(os.Stderr, "writing control flow graph %s\n", outfile)
+	g := program.ControlFlowGraph()
+	if strings.ToLower(path.Ext(outfile)) == ".json" {
+		err = g.WriteJson(fd)
+	} else {
+		err = g.WriteDot(fd)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
 func main() {
 	flag.Parse()
 	if flag.NArg() != 1 && flag.NArg() != 2 {
 		usageAndQuit()
 	}
 	filename := flag.Arg(0)
+	if timingFlag {
+		timing(filename)
+		return
+	}
+	if cfgFlag {
+		exportCfg(filename)
+		return
+	}
+	if reportFlag {
+		disassemblyReport(filename)
+		return
+	}
+	if screenFlag {
+		renderScreen(filename)
+		return
+	}
 	if astFlag || assembleFlag {
 		fmt.Fprintf(os.Stderr, "Parsing %s\n", filename)
-		programAst, err := jamulator.ParseFile(filename)
+		table, err := textTable()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		programAst, err := jamulator.ParseFileWithTextTable(filename, table)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 			os.Exit(1)
@@ -103,7 +455,7 @@ func main() {
 			return
 		}
 		fmt.Fprintf(os.Stderr, "Assembling %s\n", filename)
-		program := programAst.ToProgram()
+		program := programAst.ToProgramWithTextTable(table)
 		if len(program.Errors) > 0 {
 			for _, err := range program.Errors {
 				fmt.Fprintln(os.Stderr, err)
@@ -133,13 +485,18 @@ func main() {
 			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 			os.Exit(1)
 		}
+		opts, err := disassembleOptions(rom)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
 		if unRomFlag {
 			outdir := removeExtension(filename)
 			if flag.NArg() == 2 {
 				outdir = flag.Arg(1)
 			}
 			fmt.Fprintf(os.Stderr, "disassembling to %s\n", outdir)
-			err = rom.DisassembleToDir(outdir)
+			err = rom.DisassembleToDir(outdir, opts)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 				os.Exit(1)
@@ -151,7 +508,12 @@ func main() {
 		if flag.NArg() == 2 {
 			outfile = flag.Arg(1)
 		}
-		err = rom.RecompileToBinary(outfile, compileFlags())
+		compileOpts, err := compileOptions()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		err = rom.RecompileToBinary(outfile, compileOpts, opts, toolchain())
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 			os.Exit(1)
@@ -159,7 +521,7 @@ func main() {
 		return
 	} else if disassembleFlag {
 		fmt.Fprintf(os.Stderr, "disassembling %s\n", filename)
-		p, err := jamulator.DisassembleFile(filename)
+		p, err := disassembleFile(filename)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 			os.Exit(1)
@@ -0,0 +1,145 @@
+#include "rom.h"
+#include "system.h"
+#include "stdio.h"
+#include "stdlib.h"
+#include "string.h"
+
+// a runtime without a window, for running recompiled games where there
+// is no display, such as in tests. the PPU still draws every frame, and
+// frames can be hashed or saved to compare against.
+
+static char * movieFilename = NULL;
+// frames are counted from 1. 0 means no limit.
+static long frameLimit = 0;
+static long dumpFrame = 0;
+static char * dumpFilename = NULL;
+static bool hashFrames = false;
+static char * ramFilename = NULL;
+static long frameCount = 0;
+
+void flush_events() {}
+
+static int frameWidth() {
+    return p->overscanEnabled ? 240 : 256;
+}
+
+static int frameHeight() {
+    return p->overscanEnabled ? 224 : 240;
+}
+
+// the framebuffer can be bigger than the frame, which is at the start
+static int framePixels() {
+    return frameWidth() * frameHeight();
+}
+
+// FNV-1a over the RGB bytes of the frame
+static uint64_t hashFrame() {
+    uint64_t h = 0xcbf29ce484222325ULL;
+    for (int i = 0; i < framePixels(); ++i) {
+        for (int shift = 16; shift >= 0; shift -= 8) {
+            h ^= (p->framebuffer[i] >> shift) & 0xff;
+            h *= 0x100000001b3ULL;
+        }
+    }
+    return h;
+}
+
+static void writePpm(char * filename) {
+    FILE *fd = fopen(filename, "wb");
+    if (fd == NULL) {
+        perror("Error opening frame file");
+        exit(1);
+    }
+    fprintf(fd, "P6\n%d %d\n255\n", frameWidth(), frameHeight());
+    for (int i = 0; i < framePixels(); ++i) {
+        uint8_t rgb[3] = {
+            (p->framebuffer[i] >> 16) & 0xff,
+            (p->framebuffer[i] >> 8) & 0xff,
+            p->framebuffer[i] & 0xff,
+        };
+        fwrite(rgb, 1, 3, fd);
+    }
+    if (ferror(fd) != 0) {
+        perror("Error writing frame");
+        exit(1);
+    }
+    fclose(fd);
+}
+
+// saves the 2KB of RAM when the runtime exits
+static void dumpRam() {
+    FILE *fd = fopen(ramFilename, "wb");
+    if (fd == NULL) {
+        perror("Error opening RAM file");
+        return;
+    }
+    for (int a = 0; a < 0x800; ++a) {
+        fputc(rom_ram_read(a), fd);
+    }
+    if (ferror(fd) != 0) {
+        perror("Error writing RAM");
+    }
+    fclose(fd);
+}
+
+void render() {
+    frameCount += 1;
+    if (hashFrames) {
+        printf("%ld %016llx\n", frameCount, (unsigned long long) hashFrame());
+    }
+    if (frameCount == dumpFrame) {
+        writePpm(dumpFilename);
+    }
+    if (frameCount == frameLimit) {
+        fflush(stdout);
+        exit(0);
+    }
+}
+
+void printUsage(char * command) {
+    fprintf(stderr, "Usage:\n%s [-movie file] [-frames N] [-dump-frame K out.ppm] [-hash-frames] [-dump-ram out.bin]\n", command);
+    exit(1);
+}
+
+static long parseCount(char * command, char * arg) {
+    char * end;
+    long n = strtol(arg, &end, 10);
+    if (*arg == '\0' || *end != '\0' || n < 1) {
+        printUsage(command);
+    }
+    return n;
+}
+
+void parseFlags(int argc, char* argv[]) {
+    for (int i = 1; i < argc; ++i) {
+        char * arg = argv[i];
+        if (strcmp(arg, "-movie") == 0 && i < argc - 1) {
+            movieFilename = argv[i + 1];
+            i += 1;
+        } else if (strcmp(arg, "-frames") == 0 && i < argc - 1) {
+            frameLimit = parseCount(argv[0], argv[i + 1]);
+            i += 1;
+        } else if (strcmp(arg, "-dump-frame") == 0 && i < argc - 2) {
+            dumpFrame = parseCount(argv[0], argv[i + 1]);
+            dumpFilename = argv[i + 2];
+            i += 2;
+        } else if (strcmp(arg, "-hash-frames") == 0) {
+            hashFrames = true;
+        } else if (strcmp(arg, "-dump-ram") == 0 && i < argc - 1) {
+            ramFilename = argv[i + 1];
+            i += 1;
+        } else {
+            printUsage(argv[0]);
+        }
+    }
+}
+
+int main(int argc, char* argv[]) {
+    parseFlags(argc, argv);
+    System_loadMovie(movieFilename);
+    if (ramFilename != NULL) {
+        atexit(&dumpRam);
+    }
+    System_init(&render);
+    System_run();
+}
@@ -0,0 +1,161 @@
+#include "rom.h"
+#include "assert.h"
+#include "system.h"
+#include "stdio.h"
+#include "stdlib.h"
+
+Ppu* p;
+static int interruptRequested = ROM_INTERRUPT_NONE;
+
+typedef struct {
+    uint64_t cycle;
+    uint8_t padIndex;
+    uint8_t btnIndex;
+    uint8_t btnState;
+} MovieFrame;
+static MovieFrame* movie = NULL;
+static uint64_t movieFrameCount;
+static uint64_t frameIndex = 0;
+static uint64_t cycleIndex = 0;
+
+void System_loadMovie(char* filename) {
+    if (filename == NULL) return;
+    FILE *fd = fopen(filename, "rb");
+    if (fd == NULL) {
+        perror("Error opening movie file");
+        exit(1);
+    }
+    size_t n = fread(&movieFrameCount, 8, 1, fd);
+    movie = malloc(sizeof(MovieFrame) * movieFrameCount);
+    for (size_t i = 0; i < movieFrameCount; ++i) {
+        n = fread(&movie[i].cycle, 8, 1, fd);
+        n = fread(&movie[i].padIndex, 1, 1, fd);
+        n = fread(&movie[i].btnIndex, 1, 1, fd);
+        n = fread(&movie[i].btnState, 1, 1, fd);
+    }
+    if (ferror(fd) != 0) {
+        perror("Error reading movie");
+        exit(1);
+    }
+    fclose(fd);
+}
+
+void setPadStateFromMovie() {
+    if (movie == NULL) return;
+    while (frameIndex < movieFrameCount && cycleIndex >= movie[frameIndex].cycle) {
+        rom_set_button_state(
+                movie[frameIndex].padIndex,
+                movie[frameIndex].btnIndex,
+                movie[frameIndex].btnState);
+        frameIndex += 1;
+    }
+    if (frameIndex >= movieFrameCount) exit(0);
+}
+
+void step(uint8_t cycles) {
+    cycleIndex += cycles;
+    for (int i = 0; i < 3 * cycles; ++i) {
+        Ppu_step(p);
+    }
+}
+
+void rom_cycle(uint8_t cycles) {
+    flush_events();
+    setPadStateFromMovie();
+    step(cycles);
+    int req = interruptRequested;
+    if (req != ROM_INTERRUPT_NONE) {
+        interruptRequested = ROM_INTERRUPT_NONE;
+        rom_start(req);
+    }
+}
+
+void vblankInterrupt() {
+    interruptRequested = ROM_INTERRUPT_NMI;
+}
+
+void System_init(void (*render)()) {
+    p = Ppu_new();
+    p->render = render;
+    p->vblankInterrupt = &vblankInterrupt;
+    p->readRam = &rom_ram_read;
+    Nametable_setMirroring(&p->nametables, rom_mirroring);
+    assert(rom_chr_bank_count == 1);
+    rom_read_chr(p->vram);
+}
+
+void System_run() {
+    rom_start(ROM_INTERRUPT_RESET);
+    Ppu_dispose(p);
+}
+
+uint8_t rom_ppu_read_status() {
+    return Ppu_readStatus(p);
+}
+
+uint8_t rom_ppu_read_oamdata(){
+    return Ppu_readOamData(p);
+}
+uint8_t rom_ppu_read_data(){
+    return Ppu_readData(p);
+}
+
+void rom_ppu_write_control(uint8_t b) {
+    Ppu_writeControl(p, b);
+}
+
+void rom_ppu_write_mask(uint8_t b) {
+    Ppu_writeMask(p, b);
+}
+
+void rom_ppu_write_oamaddress(uint8_t b) {
+    Ppu_writeOamAddress(p, b);
+}
+
+void rom_ppu_write_address(uint8_t b) {
+    Ppu_writeAddress(p, b);
+}
+
+void rom_ppu_write_data(uint8_t b) {
+    Ppu_writeData(p, b);
+}
+
+void rom_ppu_write_oamdata(uint8_t b) {
+    Ppu_writeOamData(p, b);
+}
+
+void rom_ppu_write_scroll(uint8_t b) {
+    Ppu_writeScroll(p, b);
+}
+void rom_ppu_write_dma(uint8_t b) {
+    Ppu_writeDma(p, b);
+
+    // Halt the CPU for 512 cycles
+    step(255);
+    step(255);
+    step(2);
+}
+
+uint8_t rom_apu_read_status() {
+    return 0;
+}
+void rom_apu_write_square1control(uint8_t b){}
+void rom_apu_write_square1sweeps(uint8_t b){}
+void rom_apu_write_square1low(uint8_t b){}
+void rom_apu_write_square1high(uint8_t b){}
+void rom_apu_write_square2control(uint8_t b){}
+void rom_apu_write_square2sweeps(uint8_t b){}
+void rom_apu_write_square2low(uint8_t b){}
+void rom_apu_write_square2high(uint8_t b){}
+void rom_apu_write_trianglecontrol(uint8_t b){}
+void rom_apu_write_trianglelow(uint8_t b){}
+void rom_apu_write_trianglehigh(uint8_t b){}
+void rom_apu_write_noisebase(uint8_t b){}
+void rom_apu_write_noiseperiod(uint8_t b){}
+void rom_apu_write_noiselength(uint8_t b){}
+void rom_apu_write_dmcflags(uint8_t b){}
+void rom_apu_write_dmcdirectload(uint8_t b){}
+void rom_apu_write_dmcsampleaddress(uint8_t b){}
+void rom_apu_write_dmcsamplelength(uint8_t b){}
+void rom_apu_write_controlflags1(uint8_t b){}
+void rom_apu_write_controlflags2(uint8_t b){}
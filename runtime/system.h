@@ -0,0 +1,19 @@
+#include "ppu.h"
+
+// the parts of the runtime which are the same however frames are shown.
+// main.c shows them in a window, and headless.c does not show them at
+// all.
+
+extern Ppu* p;
+
+// loads the movie of button presses to play back. may be NULL.
+void System_loadMovie(char* filename);
+
+// sets up the PPU, which calls render after every frame
+void System_init(void (*render)());
+
+// runs the ROM from reset
+void System_run();
+
+// each runtime defines this. it is called before every rom_cycle.
+void flush_events();